@@ -1,6 +1,8 @@
 package thunder
 
 import (
+	"time"
+
 	"github.com/imba3r/thunder/store"
 	"github.com/imba3r/thunder/pubsub"
 )
@@ -13,6 +15,8 @@ type adapter struct {
 type document struct {
 	document store.Document
 	pubsub   pubsub.PubSub
+	// store is the adapter, whose transactions publish their changes.
+	store store.Store
 }
 
 type collection struct {
@@ -20,10 +24,24 @@ type collection struct {
 	pubsub     pubsub.PubSub
 }
 
+// transaction records the documents written within a transaction so that
+// their changes can be published once it has been committed.
+type transaction struct {
+	tx      store.Tx
+	keys    []string
+	changes map[string][]byte
+}
+
 var _ store.Store = &adapter{}
 
-func newAdapter(store store.Store, pubsub pubsub.PubSub) *adapter {
-	return &adapter{store, pubsub}
+func newAdapter(s store.Store, pubsub pubsub.PubSub) *adapter {
+	a := &adapter{s, pubsub}
+	// Expired documents are gone just like deleted ones.
+	s.OnExpire(func(key string) {
+		publishCollection(pubsub, store.CollectionKey(key), nil)
+		pubsub.Publish(key, nil)
+	})
+	return a
 }
 
 func (a *adapter) Open(enc store.Encoding) error {
@@ -32,7 +50,7 @@ func (a *adapter) Open(enc store.Encoding) error {
 
 func (a *adapter) Document(path string) (store.Document, error) {
 	d, err := a.store.Document(path)
-	return &document{d, a.pubsub}, err
+	return &document{d, a.pubsub, a}, err
 }
 
 func (a *adapter) Collection(path string) (store.Collection, error) {
@@ -40,6 +58,35 @@ func (a *adapter) Collection(path string) (store.Collection, error) {
 	return &collection{c, a.pubsub}, err
 }
 
+func (a *adapter) CollectionGroup(name string) (store.CollectionGroup, error) {
+	return a.store.CollectionGroup(name)
+}
+
+func (a *adapter) RunTransaction(f func(tx store.Tx) error) error {
+	var t *transaction
+	err := a.store.RunTransaction(func(tx store.Tx) error {
+		// Start over with every attempt of the transaction.
+		t = &transaction{tx: tx, changes: make(map[string][]byte)}
+		return f(t)
+	})
+	if err == nil {
+		t.publish(a.pubsub)
+	}
+	return err
+}
+
+func (a *adapter) RootCollections() ([]string, error) {
+	return a.store.RootCollections()
+}
+
+func (a *adapter) OnExpire(f func(key string)) {
+	a.store.OnExpire(f)
+}
+
+func (a *adapter) EnableSearch(collectionKey string, fields ...string) error {
+	return a.store.EnableSearch(collectionKey, fields...)
+}
+
 func (a *adapter) Close() {
 	a.store.Close()
 }
@@ -48,53 +95,216 @@ func (d *document) Key() string {
 	return d.document.Key();
 }
 
-func (d *document) Get() ([]byte, error) {
-	return d.document.Get()
+func (d *document) Get(fields ...string) ([]byte, error) {
+	return d.document.Get(fields...)
 }
 
-func (d *document) Set(data []byte) error {
-	err := d.document.Set(data)
-	if err == nil {
-		collectionKey := store.CollectionKey(d.document.Key())
-		d.pubsub.Publish(collectionKey, data)
-		d.pubsub.Publish(d.document.Key(), data)
-	}
-	return err
+func (d *document) GetWithMetadata() ([]byte, store.Metadata, error) {
+	return d.document.GetWithMetadata()
+}
+
+func (d *document) Set(data []byte, preconditions ...store.Precondition) error {
+	return d.SetWithTTL(data, 0, preconditions...)
 }
 
-func (d *document) Update(data []byte) error {
-	err := d.document.Update(data)
+func (d *document) SetWithTTL(data []byte, ttl time.Duration, preconditions ...store.Precondition) error {
+	err := d.document.SetWithTTL(data, ttl, preconditions...)
 	if err == nil {
 		collectionKey := store.CollectionKey(d.document.Key())
-		d.pubsub.Publish(collectionKey, data)
+		publishCollection(d.pubsub, collectionKey, data)
 		d.pubsub.Publish(d.document.Key(), data)
 	}
 	return err
 }
 
-func (d *document) Delete() error {
-	err := d.document.Delete()
+func (d *document) Update(data []byte, preconditions ...store.Precondition) error {
+	// The transaction publishes the merged document rather than the
+	// patch, read before concurrent writes could change it.
+	return d.store.RunTransaction(func(tx store.Tx) error {
+		return tx.Update(d.document.Key(), data, preconditions...)
+	})
+}
+
+func (d *document) Delete(preconditions ...store.Precondition) error {
+	err := d.document.Delete(preconditions...)
 	if err == nil {
 		collectionKey := store.CollectionKey(d.document.Key())
-		d.pubsub.Publish(collectionKey, nil)
+		publishCollection(d.pubsub, collectionKey, nil)
 		d.pubsub.Publish(d.document.Key(), nil)
 	}
 	return err
 }
 
+func (d *document) DeleteRecursive(preconditions ...store.Precondition) ([]string, error) {
+	keys, err := d.document.DeleteRecursive(preconditions...)
+	publishDeleted(d.pubsub, keys)
+	return keys, err
+}
+
+func (d *document) Collections() ([]string, error) {
+	return d.document.Collections()
+}
+
 func (c *collection) Key() string {
 	return c.collection.Key();
 }
 
 func (c *collection) Add(data []byte) (store.Document, error) {
-	doc, err := c.collection.Add(data)
+	return c.AddWithTTL(data, 0)
+}
+
+func (c *collection) AddWithTTL(data []byte, ttl time.Duration) (store.Document, error) {
+	doc, err := c.collection.AddWithTTL(data, ttl)
 	if err == nil {
-		c.pubsub.Publish(c.collection.Key(), data)
+		publishCollection(c.pubsub, c.collection.Key(), data)
 		c.pubsub.Publish(doc.Key(), data)
 	}
 	return doc, err
 }
 
-func (c *collection) Items(q store.Query, o store.Order, l store.Limit) ([]store.CollectionItem, error) {
-	return c.collection.Items(q, o, l)
+func (c *collection) Delete(recursive bool) ([]string, error) {
+	// Documents may have been deleted even if an error occurred.
+	keys, err := c.collection.Delete(recursive)
+	publishDeleted(c.pubsub, keys)
+	return keys, err
+}
+
+func (c *collection) Items(q store.Query, o store.Order, l store.Limit, fields ...string) ([]store.CollectionItem, error) {
+	return c.collection.Items(q, o, l, fields...)
+}
+
+func (c *collection) Explain(q store.Query, o store.Order, l store.Limit) (store.Explanation, error) {
+	return c.collection.Explain(q, o, l)
+}
+
+func (c *collection) Aggregate(q store.Query, groupBy []string, aggregations []store.Aggregation) ([]store.AggregateGroup, error) {
+	return c.collection.Aggregate(q, groupBy, aggregations)
+}
+
+func (c *collection) Search(text string, limit int) ([]store.SearchResult, error) {
+	return c.collection.Search(text, limit)
+}
+
+func (t *transaction) Get(key string) ([]byte, error) {
+	return t.tx.Get(key)
+}
+
+func (t *transaction) GetWithMetadata(key string) ([]byte, store.Metadata, error) {
+	return t.tx.GetWithMetadata(key)
+}
+
+func (t *transaction) Set(key string, data []byte, preconditions ...store.Precondition) error {
+	err := t.tx.Set(key, data, preconditions...)
+	if err == nil {
+		t.record(key, data)
+	}
+	return err
+}
+
+func (t *transaction) SetWithTTL(key string, data []byte, ttl time.Duration, preconditions ...store.Precondition) error {
+	err := t.tx.SetWithTTL(key, data, ttl, preconditions...)
+	if err == nil {
+		t.record(key, data)
+	}
+	return err
+}
+
+func (t *transaction) Update(key string, data []byte, preconditions ...store.Precondition) error {
+	err := t.tx.Update(key, data, preconditions...)
+	if err == nil {
+		// Record the merged document rather than the patch.
+		merged, err := t.tx.Get(key)
+		if err != nil {
+			return err
+		}
+		t.record(key, merged)
+	}
+	return err
+}
+
+func (t *transaction) Delete(key string, preconditions ...store.Precondition) error {
+	err := t.tx.Delete(key, preconditions...)
+	if err == nil {
+		t.record(key, nil)
+	}
+	return err
+}
+
+func (t *transaction) Add(collectionKey string, data []byte) (string, error) {
+	key, err := t.tx.Add(collectionKey, data)
+	if err == nil {
+		t.record(key, data)
+	}
+	return key, err
+}
+
+func (t *transaction) AddWithTTL(collectionKey string, data []byte, ttl time.Duration) (string, error) {
+	key, err := t.tx.AddWithTTL(collectionKey, data, ttl)
+	if err == nil {
+		t.record(key, data)
+	}
+	return key, err
+}
+
+// publish publishes the changes of the committed transaction. Collections
+// and collection groups are notified once, no matter how many of their
+// documents changed, to avoid recomputing collection subscriptions for
+// every single document.
+func (t *transaction) publish(ps pubsub.PubSub) {
+	var collectionKeys []string
+	collectionChanges := make(map[string][]byte)
+	for _, key := range t.keys {
+		collectionKey := store.CollectionKey(key)
+		if _, exists := collectionChanges[collectionKey]; !exists {
+			collectionKeys = append(collectionKeys, collectionKey)
+		}
+		collectionChanges[collectionKey] = t.changes[key]
+	}
+	var groupKeys []string
+	groupChanges := make(map[string][]byte)
+	for _, collectionKey := range collectionKeys {
+		ps.Publish(collectionKey, collectionChanges[collectionKey])
+		groupKey := CollectionGroupKey(store.CollectionName(collectionKey))
+		if _, exists := groupChanges[groupKey]; !exists {
+			groupKeys = append(groupKeys, groupKey)
+		}
+		groupChanges[groupKey] = collectionChanges[collectionKey]
+	}
+	for _, groupKey := range groupKeys {
+		ps.Publish(groupKey, groupChanges[groupKey])
+	}
+	for _, key := range t.keys {
+		ps.Publish(key, t.changes[key])
+	}
+}
+
+// CollectionGroupKey returns the key under which changes to the documents
+// of the collection group with the given name are published. It starts with
+// a zero byte so that it never equals the key of a document or collection.
+func CollectionGroupKey(name string) string {
+	return "\x00group/" + name
+}
+
+// publishCollection publishes the change of a document to the subscribers
+// of its collection and collection group.
+func publishCollection(ps pubsub.PubSub, collectionKey string, data []byte) {
+	ps.Publish(collectionKey, data)
+	ps.Publish(CollectionGroupKey(store.CollectionName(collectionKey)), data)
+}
+
+// publishDeleted publishes the deletion of the documents. Like with
+// transactions, collections are notified once.
+func publishDeleted(ps pubsub.PubSub, keys []string) {
+	t := &transaction{changes: make(map[string][]byte)}
+	for _, key := range keys {
+		t.record(key, nil)
+	}
+	t.publish(ps)
+}
+
+func (t *transaction) record(key string, data []byte) {
+	if _, exists := t.changes[key]; !exists {
+		t.keys = append(t.keys, key)
+	}
+	t.changes[key] = data
 }
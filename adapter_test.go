@@ -0,0 +1,203 @@
+package thunder
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/imba3r/thunder/store"
+	"github.com/imba3r/thunder/store/memory"
+)
+
+func newTestThunder(t *testing.T) *Thunder {
+	s := memory.New()
+	if err := s.Open(store.Json); err != nil {
+		t.Fatal(err)
+	}
+	return New(s, false)
+}
+
+func expectPublished(t *testing.T, c chan []byte, expected string) {
+	t.Helper()
+	select {
+	case data := <-c:
+		if string(data) != expected {
+			t.Errorf("Expected %s to be published, got %s", expected, data)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected %s to be published", expected)
+	}
+}
+
+func expectNotPublished(t *testing.T, c chan []byte) {
+	t.Helper()
+	select {
+	case data := <-c:
+		t.Errorf("Expected nothing to be published, got %s", data)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestAdapter_Update(t *testing.T) {
+	th := newTestThunder(t)
+	d, _ := th.Store.Document("users/1")
+	d.Set([]byte(`{"name":"alice","age":30}`))
+
+	c := th.PubSub.Subscribe("users/1")
+	users := th.PubSub.Subscribe("users")
+	if err := d.Update([]byte(`{"age":31}`)); err != nil {
+		t.Fatal(err)
+	}
+	expectPublished(t, c, `{"age":31,"name":"alice"}`)
+	expectPublished(t, users, `{"age":31,"name":"alice"}`)
+
+	missing, _ := th.Store.Document("users/2")
+	if err := missing.Update([]byte(`{"age":31}`)); !store.IsNotFound(err) {
+		t.Errorf("Expected not found error, got %v", err)
+	}
+	expectNotPublished(t, users)
+}
+
+func TestAdapter_RunTransaction(t *testing.T) {
+	th := newTestThunder(t)
+	c := th.PubSub.Subscribe("accounts/a")
+
+	err := th.Store.RunTransaction(func(tx store.Tx) error {
+		tx.Set("accounts/a", []byte(`{"balance":1}`))
+		// Nothing is published before the transaction commits.
+		expectNotPublished(t, c)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectPublished(t, c, `{"balance":1}`)
+
+	err = th.Store.RunTransaction(func(tx store.Tx) error {
+		tx.Set("accounts/a", []byte(`{"balance":2}`))
+		return errors.New("abort")
+	})
+	if err == nil {
+		t.Errorf("Expected error of aborted transaction")
+	}
+	expectNotPublished(t, c)
+}
+
+func TestAdapter_Batch(t *testing.T) {
+	th := newTestThunder(t)
+	c := th.PubSub.Subscribe("users")
+
+	b := store.NewBatch()
+	for i := 0; i < 10; i++ {
+		b.Add("users", []byte(`{}`))
+	}
+	b.Set("users/x", []byte(`{"last":true}`))
+	if _, err := b.Commit(th.Store); err != nil {
+		t.Fatal(err)
+	}
+	// The collection is notified once for the whole batch.
+	expectPublished(t, c, `{"last":true}`)
+	expectNotPublished(t, c)
+}
+
+func TestAdapter_Expiry(t *testing.T) {
+	th := newTestThunder(t)
+	c := th.PubSub.Subscribe("sessions/a")
+	d, _ := th.Store.Document("sessions/a")
+	if err := d.SetWithTTL([]byte(`{"user":"alice"}`), 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	expectPublished(t, c, `{"user":"alice"}`)
+
+	// Expired documents are published as deleted once they are removed.
+	select {
+	case data := <-c:
+		if data != nil {
+			t.Errorf("Expected expired document to be published as deleted, got %s", data)
+		}
+	case <-time.After(3 * store.SweepInterval):
+		t.Errorf("Expected expired document to be published")
+	}
+}
+
+func TestAdapter_DeleteRecursive(t *testing.T) {
+	th := newTestThunder(t)
+	for _, key := range []string{"users/1", "users/1/posts/1", "users/1/posts/2"} {
+		d, _ := th.Store.Document(key)
+		d.Set([]byte(`{}`))
+	}
+	posts := th.PubSub.Subscribe("users/1/posts")
+	post := th.PubSub.Subscribe("users/1/posts/2")
+
+	d, _ := th.Store.Document("users/1")
+	if _, err := d.DeleteRecursive(); err != nil {
+		t.Fatal(err)
+	}
+	// The collection is notified once for all of its documents.
+	expectPublished(t, posts, "")
+	expectNotPublished(t, posts)
+	expectPublished(t, post, "")
+}
+
+func TestAdapter_CollectionGroup(t *testing.T) {
+	th := newTestThunder(t)
+	c := th.PubSub.Subscribe(CollectionGroupKey("comments"))
+
+	d, _ := th.Store.Document("users/1/posts/1/comments/1")
+	if err := d.Set([]byte(`{"text":"first"}`)); err != nil {
+		t.Fatal(err)
+	}
+	expectPublished(t, c, `{"text":"first"}`)
+
+	d, _ = th.Store.Document("users/1/posts/1")
+	if err := d.Set([]byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	expectNotPublished(t, c)
+
+	// The group is notified once for all of its documents.
+	err := th.Store.RunTransaction(func(tx store.Tx) error {
+		tx.Set("users/1/posts/1/comments/2", []byte(`{"text":"second"}`))
+		tx.Set("users/2/posts/1/comments/1", []byte(`{"text":"third"}`))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectPublished(t, c, `{"text":"third"}`)
+	expectNotPublished(t, c)
+
+	g, err := th.Store.CollectionGroup("comments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := g.Items(store.Query{}, store.Order{}, store.Limit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 3 {
+		t.Errorf("Expected 3 items, got %d", len(items))
+	}
+}
+
+func TestAdapter_Search(t *testing.T) {
+	th := newTestThunder(t)
+	if err := th.Store.EnableSearch("notes", "text"); err != nil {
+		t.Fatal(err)
+	}
+	c := th.PubSub.Subscribe("notes")
+
+	notes, _ := th.Store.Collection("notes")
+	if _, err := notes.Add([]byte(`{"text":"searching notes"}`)); err != nil {
+		t.Fatal(err)
+	}
+	expectPublished(t, c, `{"text":"searching notes"}`)
+
+	results, err := notes.Search("search", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || string(results[0].Value) != `{"text":"searching notes"}` {
+		t.Errorf("Expected added note to be found, got %v", results)
+	}
+}
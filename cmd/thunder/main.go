@@ -1,21 +1,107 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"log"
 	"net/http"
+	"strings"
 
 	"github.com/imba3r/thunder"
+	"github.com/imba3r/thunder/store"
 	"github.com/imba3r/thunder/store/badger"
+	"github.com/imba3r/thunder/store/bolt"
+	"github.com/imba3r/thunder/store/fs"
+	"github.com/imba3r/thunder/store/memory"
+	"github.com/imba3r/thunder/store/sqlite"
 	"github.com/imba3r/thunder/websocket"
-	"github.com/imba3r/thunder/store"
 )
 
+// indexFlags collects the indexes given as collection.field, e.g.
+// users.age or users/1/posts.author.name, or collection.field,field,... for
+// composite indexes, e.g. users.city,age.
+type indexFlags []store.Index
+
+func (f *indexFlags) String() string {
+	var indexes []string
+	for _, index := range *f {
+		indexes = append(indexes, index.Collection+"."+strings.Join(index.Fields, ","))
+	}
+	return strings.Join(indexes, " ")
+}
+
+func (f *indexFlags) Set(value string) error {
+	i := strings.Index(value, ".")
+	if i <= 0 || !store.IsCollectionKey(value[:i]) {
+		return fmt.Errorf("invalid index %q, expected collection.field", value)
+	}
+	fields := strings.Split(value[i+1:], ",")
+	for _, field := range fields {
+		if field == "" {
+			return fmt.Errorf("invalid index %q, expected collection.field", value)
+		}
+	}
+	*f = append(*f, store.Index{Collection: value[:i], Fields: fields})
+	return nil
+}
+
 func main() {
-	bs := badger.New("/tmp/store");
+	backend := flag.String("store", "badger", "store backend: badger, bolt, fs, memory or sqlite")
+	path := flag.String("path", "/tmp/store", "path of the store's data")
+	addr := flag.String("addr", ":3000", "address to listen on")
+	var indexes indexFlags
+	flag.Var(&indexes, "index", "index fields of a collection, given as collection.field[,field...] (badger only, repeatable)")
+	var searches indexFlags
+	flag.Var(&searches, "search", "enable full-text search of fields of a collection, given as collection.field[,field...] (repeatable)")
+	rebuildIndexes := flag.Bool("rebuild-indexes", false, "drop and rebuild all indexes and exit")
+	flag.Parse()
+
+	if len(indexes) > 0 && *backend != "badger" {
+		log.Fatal("indexes are only supported by the badger store")
+	}
+
+	var s store.Store
+	switch *backend {
+	case "badger":
+		s = badger.New(*path, indexes...)
+	case "bolt":
+		s = bolt.New(*path)
+	case "fs":
+		s = fs.New(*path)
+	case "memory":
+		s = memory.New()
+	case "sqlite":
+		s = sqlite.New(*path)
+	default:
+		log.Fatal("unknown store backend: ", *backend)
+	}
+
+	if *rebuildIndexes {
+		rebuilder, ok := s.(interface{ RebuildIndexes() error })
+		if !ok {
+			log.Fatal("indexes are only supported by the badger store")
+		}
+		if err := s.Open(store.Json); err != nil {
+			log.Fatal(err)
+		}
+		defer s.Close()
+		if err := rebuilder.RebuildIndexes(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	t := thunder.New(s, true)
+	if err := t.Open(store.Json); err != nil {
+		log.Fatal(err)
+	}
+	for _, search := range searches {
+		if err := t.Store.EnableSearch(search.Collection, search.Fields...); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	t := thunder.New(bs, true)
-	t.Open(store.Json)
-	
 	h := websocket.NewWebSocketHandler(t)
 	http.HandleFunc("/thunder", h.HandlerFunc())
-	http.ListenAndServe(":3000", nil)
+	http.ListenAndServe(*addr, nil)
 }
@@ -8,6 +8,10 @@ import (
 type PubSub interface {
 	Publish(key string, data []byte)
 	Subscribe(key string) chan []byte
+	// SubscribeWithFunc subscribes to the key like Subscribe, but the
+	// subscriber receives the result of f rather than the published data.
+	// The function is called for each publication, separately for every
+	// subscriber, so subscribers of a key may receive different data.
 	SubscribeWithFunc(key string, f func() ([]byte, error)) chan []byte
 	Unsubscribe(key string, channel chan []byte)
 }
@@ -27,8 +31,12 @@ type cmd struct {
 
 type topic struct {
 	key         string
-	f           func() ([]byte, error)
-	subscribers []chan []byte
+	subscribers []subscriber
+}
+
+type subscriber struct {
+	channel chan []byte
+	f       func() ([]byte, error)
 }
 
 type registry struct {
@@ -108,18 +116,18 @@ func (r *registry) doPublish(key string, data []byte) {
 	if !exists {
 		return
 	}
-	payload := data
-	var err error
-	if t.f != nil {
-		payload, err = t.f()
-		if err != nil {
-			log.Println("[ERR] Subscribe Func returned error: ", err)
-			return
-		}
-	}
 	for _, sub := range t.subscribers {
+		payload := data
+		if sub.f != nil {
+			var err error
+			payload, err = sub.f()
+			if err != nil {
+				log.Println("[ERR] Subscribe Func returned error: ", err)
+				continue
+			}
+		}
 		select {
-		case sub <- payload:
+		case sub.channel <- payload:
 		default:
 		}
 	}
@@ -130,11 +138,10 @@ func (r *registry) doSubscribe(key string, f func() ([]byte, error), channel cha
 	if !exists {
 		r.topics[key] = &topic{
 			key:         key,
-			f:           f,
-			subscribers: []chan []byte{channel},
+			subscribers: []subscriber{{channel, f}},
 		}
 	} else {
-		t.subscribers = append(t.subscribers, channel)
+		t.subscribers = append(t.subscribers, subscriber{channel, f})
 	}
 }
 
@@ -146,7 +153,7 @@ func (r *registry) doUnsubscribe(topicName string, channel chan []byte) {
 	}
 	position := -1
 	for i, sub := range t.subscribers {
-		if sub == channel {
+		if sub.channel == channel {
 			position = i
 		}
 	}
@@ -0,0 +1,205 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Jeffail/gabs"
+)
+
+type AggregateFunction string
+
+const (
+	// Count counts the documents, or those with the field present and not
+	// null if a field is given.
+	Count AggregateFunction = "count"
+	// Sum and Avg add up and average the numbers of the field, ignoring
+	// values of other types. Avg is null if there are no numbers.
+	Sum AggregateFunction = "sum"
+	Avg AggregateFunction = "avg"
+	// Min and Max return the least and greatest value of the field as
+	// CompareJSON orders them, ignoring missing fields and null. They are
+	// null if there are no values.
+	Min AggregateFunction = "min"
+	Max AggregateFunction = "max"
+)
+
+// Aggregation computes a value over the field of the documents of a
+// collection. Its result is named by Alias, or the function followed by the
+// field in parentheses if Alias is empty, e.g. "sum(price)".
+type Aggregation struct {
+	Function AggregateFunction `json:"function"`
+	Field    string            `json:"field,omitempty"`
+	Alias    string            `json:"alias,omitempty"`
+}
+
+// Name returns the name of the result of the aggregation.
+func (a Aggregation) Name() string {
+	if a.Alias != "" {
+		return a.Alias
+	}
+	if a.Field == "" {
+		return string(a.Function)
+	}
+	return fmt.Sprintf("%s(%s)", a.Function, a.Field)
+}
+
+// AggregateGroup holds the results of the aggregations over the documents
+// whose group-by fields equal the values of Group. Missing fields group
+// like null.
+type AggregateGroup struct {
+	Group  []interface{}          `json:"group,omitempty"`
+	Values map[string]interface{} `json:"values"`
+}
+
+// ValidateAggregations returns an error if the aggregations can't be
+// computed, e.g. because of an unknown function or clashing names.
+func ValidateAggregations(groupBy []string, aggregations []Aggregation) error {
+	for _, field := range groupBy {
+		if field == "" {
+			return fmt.Errorf("empty group-by field")
+		}
+	}
+	if len(aggregations) == 0 {
+		return fmt.Errorf("no aggregations")
+	}
+	names := make(map[string]bool)
+	for _, a := range aggregations {
+		switch a.Function {
+		case Count:
+		case Sum, Avg, Min, Max:
+			if a.Field == "" {
+				return fmt.Errorf("aggregation %s requires a field", a.Function)
+			}
+		default:
+			return fmt.Errorf("unknown aggregate function: %s", a.Function)
+		}
+		if names[a.Name()] {
+			return fmt.Errorf("duplicate aggregation name: %s", a.Name())
+		}
+		names[a.Name()] = true
+	}
+	return nil
+}
+
+// Aggregate computes the aggregations over the items matching the query,
+// grouped by the values of the group-by fields, for stores that compute
+// aggregations from the items read by the given function. Groups are
+// ordered by their values as CompareJSON orders them. Without group-by
+// fields, there is a single group, even if no items match.
+func Aggregate(items func(Query, Order, Limit, ...string) ([]CollectionItem, error), q Query, groupBy []string, aggregations []Aggregation) ([]AggregateGroup, error) {
+	if err := ValidateAggregations(groupBy, aggregations); err != nil {
+		return nil, err
+	}
+	matching, err := items(q, Order{}, Limit{})
+	if err != nil {
+		return nil, err
+	}
+	return AggregateItems(matching, groupBy, aggregations), nil
+}
+
+// AggregateItems computes valid aggregations over the items, see Aggregate.
+func AggregateItems(items []CollectionItem, groupBy []string, aggregations []Aggregation) []AggregateGroup {
+	// Groups are told apart and ordered by their encoded values.
+	var encodings []string
+	groups := make(map[string]*aggregator)
+	if len(groupBy) == 0 {
+		encodings = append(encodings, "")
+		groups[""] = newAggregator(nil, aggregations)
+	}
+	for _, item := range items {
+		j, err := gabs.ParseJSON(item.Value)
+		if err != nil {
+			continue
+		}
+		group := make([]interface{}, len(groupBy))
+		var encoded []byte
+		for i, field := range groupBy {
+			group[i] = j.Path(field).Data()
+			encoded = appendIndexValue(encoded, group[i])
+		}
+		g, exists := groups[string(encoded)]
+		if !exists {
+			g = newAggregator(group, aggregations)
+			groups[string(encoded)] = g
+			encodings = append(encodings, string(encoded))
+		}
+		g.add(j)
+	}
+	sort.Strings(encodings)
+	result := make([]AggregateGroup, len(encodings))
+	for i, encoded := range encodings {
+		result[i] = groups[encoded].result()
+	}
+	return result
+}
+
+// aggregator accumulates the aggregations of a group.
+type aggregator struct {
+	group        []interface{}
+	aggregations []Aggregation
+	counts       []int
+	sums         []float64
+	values       []interface{}
+}
+
+func newAggregator(group []interface{}, aggregations []Aggregation) *aggregator {
+	return &aggregator{
+		group:        group,
+		aggregations: aggregations,
+		counts:       make([]int, len(aggregations)),
+		sums:         make([]float64, len(aggregations)),
+		values:       make([]interface{}, len(aggregations)),
+	}
+}
+
+func (g *aggregator) add(j *gabs.Container) {
+	for i, a := range g.aggregations {
+		if a.Function == Count && a.Field == "" {
+			g.counts[i]++
+			continue
+		}
+		value := j.Path(a.Field).Data()
+		if value == nil {
+			continue
+		}
+		switch a.Function {
+		case Count:
+			g.counts[i]++
+		case Sum, Avg:
+			if n, isNumber := value.(float64); isNumber {
+				g.counts[i]++
+				g.sums[i] += n
+			}
+		case Min:
+			if g.values[i] == nil || CompareJSON(value, g.values[i]) < 0 {
+				g.values[i] = value
+			}
+		case Max:
+			if g.values[i] == nil || CompareJSON(value, g.values[i]) > 0 {
+				g.values[i] = value
+			}
+		}
+	}
+}
+
+func (g *aggregator) result() AggregateGroup {
+	values := make(map[string]interface{}, len(g.aggregations))
+	for i, a := range g.aggregations {
+		switch a.Function {
+		case Count:
+			values[a.Name()] = g.counts[i]
+		case Sum:
+			values[a.Name()] = g.sums[i]
+		case Avg:
+			if g.counts[i] > 0 {
+				values[a.Name()] = g.sums[i] / float64(g.counts[i])
+			} else {
+				values[a.Name()] = nil
+			}
+		case Min, Max:
+			values[a.Name()] = g.values[i]
+		}
+	}
+	return AggregateGroup{Group: g.group, Values: values}
+}
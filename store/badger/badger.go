@@ -3,6 +3,8 @@ package badger
 import (
 	"fmt"
 	"bytes"
+	"sort"
+	"time"
 
 	"github.com/dgraph-io/badger"
 
@@ -15,6 +17,9 @@ type badgerStore struct {
 
 	db      *badger.DB
 	options badger.Options
+	indexes  []store.Index
+	sweeper  *store.Sweeper
+	searcher *store.Searcher
 }
 
 type document struct {
@@ -27,6 +32,16 @@ type collection struct {
 	store *badgerStore
 }
 
+type collectionGroup struct {
+	name  string
+	store *badgerStore
+}
+
+type tx struct {
+	txn   *badger.Txn
+	store *badgerStore
+}
+
 type query struct {
 	collection *collection
 	limit      int
@@ -35,13 +50,38 @@ type query struct {
 }
 
 var _ store.Store = &badgerStore{}
+var _ store.Tx = &tx{}
+
+// Documents with a time-to-live are written with badger's native TTL and
+// indexed by their expiration time under expiryPrefix, which is no valid
+// collection key, so that the sweeper learns which documents expired.
+var expiryPrefix = []byte("\x00expiry/")
 
-func New(path string) store.Store {
+// Documents of collections with indexes have an entry per index under
+// indexPrefix, followed by the ID of the index, the encoded values of the
+// indexed fields and the document's ID. The entries hold the keys of their
+// documents.
+var indexPrefix = []byte("\x00index/")
+
+// Indexes whose entries are complete are marked by a key under builtPrefix
+// followed by the ID of the index. Indexes declared after documents have
+// been written lack the marker until they have been built.
+var builtPrefix = []byte("\x00built/")
+
+// New returns a store that keeps its documents in a badger database at the
+// given path and maintains the given indexes. Indexes that haven't been
+// built yet, e.g. because they were declared on collections holding
+// documents already, are built when the store is opened.
+func New(path string, indexes ...store.Index) store.Store {
 	opts := badger.DefaultOptions
 	opts.Dir = path
 	opts.ValueDir = path
 
-	return &badgerStore{path: path, options: opts};
+	bs := &badgerStore{path: path, options: opts, indexes: indexes}
+	bs.sweeper = store.NewSweeper(bs.sweep)
+	bs.searcher = store.NewSearcher()
+	bs.sweeper.OnExpire(bs.searcher.Remove)
+	return bs
 }
 
 func (bs *badgerStore) Open(enc store.Encoding) error {
@@ -52,6 +92,11 @@ func (bs *badgerStore) Open(enc store.Encoding) error {
 
 	bs.enc = enc
 	bs.db = db
+	if err := bs.buildIndexes(); err != nil {
+		db.Close()
+		return err
+	}
+	bs.sweeper.Start()
 	return nil
 }
 
@@ -69,100 +114,432 @@ func (bs *badgerStore) Collection(key string) (store.Collection, error) {
 	return nil, fmt.Errorf("not a document path: %s", key)
 }
 
+func (bs *badgerStore) CollectionGroup(name string) (store.CollectionGroup, error) {
+	if store.IsCollectionGroupName(name) {
+		return &collectionGroup{name, bs}, nil
+	}
+	return nil, fmt.Errorf("not a collection group name: %s", name)
+}
+
+// maxTransactionAttempts limits how often a transaction is retried when
+// it conflicts with concurrent transactions.
+const maxTransactionAttempts = 10
+
+func (bs *badgerStore) RunTransaction(f func(tx store.Tx) error) error {
+	var err error
+	for attempt := 0; attempt < maxTransactionAttempts; attempt++ {
+		var t *store.SearchTx
+		err = bs.db.Update(func(txn *badger.Txn) error {
+			t = bs.searcher.Tx(&tx{txn, bs})
+			return f(t)
+		})
+		if err == nil {
+			t.Commit()
+		}
+		if err != badger.ErrConflict {
+			return err
+		}
+	}
+	return err
+}
+
+func (bs *badgerStore) RootCollections() ([]string, error) {
+	return bs.collections("")
+}
+
+// collections returns the keys of the collections directly below the given
+// document key, or at the root if it is empty. Once a collection has been
+// found, iteration skips all of its keys by seeking past them.
+func (bs *badgerStore) collections(parentKey string) ([]string, error) {
+	var prefix []byte
+	if parentKey != "" {
+		prefix = []byte(parentKey + "/")
+	}
+	var keys []string
+	err := bs.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); {
+			key := string(it.Item().Key())
+			// Skip the keys of the expiry and field indexes, which
+			// start with a zero byte.
+			if key[0] == 0 {
+				it.Seek([]byte{1})
+				continue
+			}
+			// Skip sequences.
+			if !store.IsDocumentKey(key) {
+				it.Next()
+				continue
+			}
+			collectionKey := store.ChildCollectionKey(key, parentKey)
+			keys = append(keys, collectionKey)
+			it.Seek(pastPrefix([]byte(collectionKey + "/")))
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// pastPrefix returns the first key following all keys with the given prefix,
+// which ends with a slash. '0' is the character following '/'.
+func pastPrefix(prefix []byte) []byte {
+	past := append([]byte{}, prefix...)
+	past[len(past)-1] = '0'
+	return past
+}
+
+func (bs *badgerStore) OnExpire(f func(key string)) {
+	bs.sweeper.OnExpire(f)
+}
+
+func (bs *badgerStore) EnableSearch(collectionKey string, fields ...string) error {
+	c, err := bs.Collection(collectionKey)
+	if err != nil {
+		return err
+	}
+	return bs.searcher.Enable(collectionKey, fields, c.Items)
+}
+
 func (bs *badgerStore) Close() {
+	bs.sweeper.Stop()
 	bs.db.Close();
 }
 
-func (d *document) Key() string {
-	return d.key
+// sweep removes the documents that have expired by now, walking the expiry
+// index in order of expiration time. Badger may have dropped the documents
+// already, which is why the index is kept.
+func (bs *badgerStore) sweep(now time.Time) ([]string, error) {
+	var keys []string
+	err := bs.db.Update(func(txn *badger.Txn) error {
+		keys = nil
+		var due [][]byte
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		for it.Seek(expiryPrefix); it.ValidForPrefix(expiryPrefix); it.Next() {
+			k := it.Item().Key()
+			expireTime, _, err := store.ParseExpiryIndexKey(k[len(expiryPrefix):])
+			if err != nil {
+				it.Close()
+				return err
+			}
+			if now.Before(expireTime) {
+				break
+			}
+			due = append(due, append([]byte{}, k...))
+		}
+		it.Close()
+
+		for _, k := range due {
+			if err := txn.Delete(k); err != nil {
+				return err
+			}
+			expireTime, key, _ := store.ParseExpiryIndexKey(k[len(expiryPrefix):])
+			item, err := txn.Get([]byte(key))
+			if err == badger.ErrKeyNotFound {
+				keys = append(keys, key)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			v, err := item.Value()
+			if err != nil {
+				return err
+			}
+			meta, data, err := store.DecodeRecord(v)
+			if err != nil {
+				return err
+			}
+			// The document has been written again since.
+			if !meta.ExpireTime.Equal(expireTime) {
+				continue
+			}
+			if err := txn.Delete([]byte(key)); err != nil {
+				return err
+			}
+			if err := (&tx{txn, bs}).indexFields(key, data, nil, nil); err != nil {
+				return err
+			}
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
 }
 
-func (d *document) Get() ([]byte, error) {
-	var value []byte
-	err := d.store.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(d.key))
+// deleteBatchSize bounds the number of writes per transaction of recursive
+// deletes and index rebuilds, which would exceed the size limits of badger
+// transactions for large collections otherwise.
+const deleteBatchSize = 1000
+
+// batchSize returns the number of documents that may be written per
+// transaction given that each write updates all indexes.
+func (bs *badgerStore) batchSize() int {
+	return deleteBatchSize / (1 + len(bs.indexes))
+}
+
+// deletePrefix deletes the documents below the given prefix whose keys
+// match in transactions of at most batchSize documents each. It returns
+// the keys of the deleted documents in order.
+func (bs *badgerStore) deletePrefix(prefix []byte, match func(key string) bool) ([]string, error) {
+	var keys []string
+	start := prefix
+	batchSize := bs.batchSize()
+	for {
+		var batch []string
+		err := bs.db.Update(func(txn *badger.Txn) error {
+			batch = nil
+			var metas []store.Metadata
+			var datas [][]byte
+			it := txn.NewIterator(badger.DefaultIteratorOptions)
+			for it.Seek(start); it.ValidForPrefix(prefix) && len(batch) < batchSize; it.Next() {
+				item := it.Item()
+				key := string(item.Key())
+				// Sequences of subcollections share the prefix.
+				if !store.IsDocumentKey(key) || !match(key) {
+					continue
+				}
+				v, err := item.ValueCopy(nil)
+				if err != nil {
+					it.Close()
+					return err
+				}
+				meta, data, err := store.DecodeRecord(v)
+				if err != nil {
+					it.Close()
+					return err
+				}
+				batch = append(batch, key)
+				metas = append(metas, meta)
+				datas = append(datas, data)
+			}
+			it.Close()
+
+			t := &tx{txn, bs}
+			for i, key := range batch {
+				if err := txn.Delete([]byte(key)); err != nil {
+					return err
+				}
+				if err := t.index(key, &metas[i], time.Time{}); err != nil {
+					return err
+				}
+				if err := t.indexFields(key, datas[i], nil, nil); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
 		if err != nil {
-			return err
+			return keys, err
 		}
-		v, err := item.Value()
-		if err != nil {
-			return err
+		for _, key := range batch {
+			bs.searcher.Remove(key)
 		}
-		value = make([]byte, len(v))
-		copy(value, v)
-		return nil
-	})
+		keys = append(keys, batch...)
+		if len(batch) < batchSize {
+			return keys, nil
+		}
+		// Continue right after the last deleted key.
+		start = append([]byte(batch[len(batch)-1]), 0)
+	}
+}
+
+func (d *document) Key() string {
+	return d.key
+}
+
+func (d *document) Get(fields ...string) ([]byte, error) {
+	data, _, err := d.GetWithMetadata()
 	if err != nil {
 		return nil, err
 	}
-	return value, nil
+	return store.ProjectJSON(data, fields), nil
+}
+
+func (d *document) GetWithMetadata() ([]byte, store.Metadata, error) {
+	var data []byte
+	var meta store.Metadata
+	err := d.store.db.View(func(txn *badger.Txn) error {
+		var err error
+		data, meta, err = (&tx{txn, d.store}).GetWithMetadata(d.key)
+		return err
+	})
+	if err != nil {
+		return nil, store.Metadata{}, err
+	}
+	return data, meta, nil
 }
 
-func (d *document) Set(data []byte) error {
-	return d.store.db.Update(func(txn *badger.Txn) error {
-		return txn.Set([]byte(d.key), data)
+func (d *document) Set(data []byte, preconditions ...store.Precondition) error {
+	return d.store.RunTransaction(func(tx store.Tx) error {
+		return tx.Set(d.key, data, preconditions...)
 	})
 }
 
-func (d *document) Update(data []byte) error {
-	// TODO check if it exists
-	return d.store.db.Update(func(txn *badger.Txn) error {
-		return txn.Set([]byte(d.key), data)
+func (d *document) SetWithTTL(data []byte, ttl time.Duration, preconditions ...store.Precondition) error {
+	return d.store.RunTransaction(func(tx store.Tx) error {
+		return tx.SetWithTTL(d.key, data, ttl, preconditions...)
 	})
 }
 
-func (d *document) Delete() error {
-	return d.store.db.Update(func(txn *badger.Txn) error {
-		return txn.Delete([]byte(d.key))
+func (d *document) Update(data []byte, preconditions ...store.Precondition) error {
+	return d.store.RunTransaction(func(tx store.Tx) error {
+		return tx.Update(d.key, data, preconditions...)
 	})
 }
 
-func (c *collection) Key() string {
-	return c.key
+func (d *document) Delete(preconditions ...store.Precondition) error {
+	return d.store.RunTransaction(func(tx store.Tx) error {
+		return tx.Delete(d.key, preconditions...)
+	})
 }
 
-func (c *collection) Add(data []byte) (store.Document, error) {
-	seq, err := c.store.db.GetSequence([]byte(c.key), 1)
-	defer seq.Release()
+func (d *document) DeleteRecursive(preconditions ...store.Precondition) ([]string, error) {
+	var keys []string
+	err := d.store.db.Update(func(txn *badger.Txn) error {
+		t := &tx{txn, d.store}
+		v, meta, err := t.get(d.key)
+		if err != nil {
+			return err
+		}
+		if err := store.CheckPreconditions(d.key, meta, preconditions); err != nil {
+			return err
+		}
+		keys = nil
+		if meta == nil {
+			return nil
+		}
+		keys = append(keys, d.key)
+		if err := txn.Delete([]byte(d.key)); err != nil {
+			return err
+		}
+		if err := t.index(d.key, meta, time.Time{}); err != nil {
+			return err
+		}
+		return t.indexFields(d.key, v, nil, nil)
+	})
 	if err != nil {
 		return nil, err
 	}
-	num, err := seq.Next()
+	for _, key := range keys {
+		d.store.searcher.Remove(key)
+	}
+	deleted, err := d.store.deletePrefix([]byte(d.key+"/"), func(string) bool {
+		return true
+	})
+	return append(keys, deleted...), err
+}
+
+func (d *document) Collections() ([]string, error) {
+	return d.store.collections(d.key)
+}
+
+func (c *collection) Key() string {
+	return c.key
+}
+
+func (c *collection) Add(data []byte) (store.Document, error) {
+	return c.AddWithTTL(data, 0)
+}
+
+func (c *collection) AddWithTTL(data []byte, ttl time.Duration) (store.Document, error) {
+	var key string
+	err := c.store.RunTransaction(func(tx store.Tx) error {
+		var err error
+		key, err = tx.AddWithTTL(c.key, data, ttl)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	d, err := c.store.Document(fmt.Sprintf("%s/%d", c.key, num))
+	return c.store.Document(key)
+}
+
+func (c *collection) Delete(recursive bool) ([]string, error) {
+	return c.store.deletePrefix([]byte(c.key+"/"), func(key string) bool {
+		return recursive || store.CollectionKey(key) == c.key
+	})
+}
+
+func (c *collection) Items(q store.Query, o store.Order, l store.Limit, fields ...string) ([]store.CollectionItem, error) {
+	items, _, err := c.items(q, o, l)
 	if err != nil {
 		return nil, err
 	}
-	return d, d.Set(data)
+	return store.ProjectItems(items, fields), nil
+}
+
+func (c *collection) Explain(q store.Query, o store.Order, l store.Limit) (store.Explanation, error) {
+	_, explanation, err := c.items(q, o, l)
+	return explanation, err
+}
+
+func (c *collection) Aggregate(q store.Query, groupBy []string, aggregations []store.Aggregation) ([]store.AggregateGroup, error) {
+	return store.Aggregate(c.Items, q, groupBy, aggregations)
 }
 
-func (c *collection) Items(q store.Query, o store.Order, l store.Limit) ([]store.CollectionItem, error) {
-	queryItems := q != (store.Query{})
-	orderItems := o != (store.Order{})
-	limitItems := l != (store.Limit{})
+func (c *collection) Search(text string, limit int) ([]store.SearchResult, error) {
+	return c.store.searcher.Search(c.key, text, limit, func(key string) ([]byte, error) {
+		return (&document{key, c.store}).Get()
+	})
+}
+
+func (c *collection) items(q store.Query, o store.Order, l store.Limit) ([]store.CollectionItem, store.Explanation, error) {
+	if err := q.Validate(); err != nil {
+		return nil, store.Explanation{}, err
+	}
+	if err := l.Validate(o); err != nil {
+		return nil, store.Explanation{}, err
+	}
+	if plan := store.PlanQuery(c.store.indexes, c.key, q, o); plan.Index != nil {
+		return c.scanIndex(plan, q, o, l)
+	}
+	queryItems := !q.IsEmpty()
+	orderItems := !o.IsEmpty()
 	limit := l.Limit + l.Offset
 
+	now := time.Now()
+	explanation := store.Explanation{Scan: store.FullScan}
 	var items []store.CollectionItem
 	err := c.store.db.View(func(txn *badger.Txn) error {
 		it := txn.NewIterator(badger.DefaultIteratorOptions)
 		defer it.Close()
 
-		// Iterate with collection key as prefix.
+		// Iterate with collection key as prefix. Unordered items are
+		// iterated in key order, which allows seeking to the start
+		// cursor and stopping at the end cursor.
 		prefix := append([]byte(c.key), byte('/'))
 		prefixLength := len(prefix)
+		start := prefix
+		if startKey := l.StartKey(); !orderItems && startKey > string(prefix) {
+			start = []byte(startKey)
+		}
 		var itemCopy []byte
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		for it.Seek(start); it.ValidForPrefix(prefix); it.Next() {
 			item := it.Item()
 			key := item.Key()
 			collectionItem := !bytes.ContainsAny(key[prefixLength:], "/")
 			if collectionItem {
 				// If items are unordered we may break during
 				// iteration once the limit has been reached.
-				if limitItems && !orderItems && len(items) == limit {
+				if l.Limit > 0 && !orderItems && len(items) == limit {
 					break
 				}
+				if !orderItems {
+					position := l.Position(store.CollectionItem{Key: string(key)}, o)
+					if position < 0 {
+						continue
+					}
+					if position > 0 {
+						break
+					}
+				}
 
 				// Copy the item contents as they are no longer
 				// valid outside of the current transaction.
@@ -170,6 +547,14 @@ func (c *collection) Items(q store.Query, o store.Order, l store.Limit) ([]store
 				if err != nil {
 					return err
 				}
+				meta, itemCopy, err := store.DecodeRecord(itemCopy)
+				if err != nil {
+					return err
+				}
+				if meta.Expired(now) {
+					continue
+				}
+				explanation.Examined++
 
 				// Filter out items that don't match the query (if any).
 				if queryItems && !store.MatchesJSON(itemCopy, q) {
@@ -185,11 +570,613 @@ func (c *collection) Items(q store.Query, o store.Order, l store.Limit) ([]store
 		store.OrderJSON(items, o)
 	}
 	// .. and limit.
-	if limitItems && len(items) >= l.Offset {
-		items = items[l.Offset:]
+	items = store.LimitItems(items, o, l)
+	explanation.Returned = len(items)
+	return items, explanation, err
+}
+
+// scanIndex returns the items of the collection read by scanning the index
+// of the plan. Ordered scans stop once the limit has been reached.
+func (c *collection) scanIndex(plan store.Plan, q store.Query, o store.Order, l store.Limit) ([]store.CollectionItem, store.Explanation, error) {
+	queryItems := !q.IsEmpty()
+	cursors := l.StartAt != nil || l.StartAfter != nil || l.EndAt != nil || l.EndBefore != nil
+	limit := l.Limit + l.Offset
+	prefix := indexEntryPrefix(*plan.Index)
+	from := append(append([]byte{}, prefix...), plan.From...)
+	to := pastBytes(prefix)
+	if plan.To != nil {
+		to = append(append([]byte{}, prefix...), plan.To...)
+	}
+
+	now := time.Now()
+	explanation := store.Explanation{Scan: store.IndexScan, Index: plan.Index}
+	var items []store.CollectionItem
+	err := c.store.db.View(func(txn *badger.Txn) error {
+		// read adds the document of an index entry to the items and
+		// reports whether the scan is done.
+		read := func(key string, values []byte) (bool, error) {
+			item, err := txn.Get([]byte(key))
+			if err == badger.ErrKeyNotFound {
+				return false, nil
+			}
+			if err != nil {
+				return false, err
+			}
+			v, err := item.ValueCopy(nil)
+			if err != nil {
+				return false, err
+			}
+			meta, data, err := store.DecodeRecord(v)
+			if err != nil {
+				return false, err
+			}
+			// Entries of documents that expired and were written again
+			// before the sweeper got to them are stale until they
+			// expire, too.
+			if meta.Expired(now) || !bytes.Equal(plan.Index.Encode(data), values) {
+				return false, nil
+			}
+			explanation.Examined++
+			if queryItems && !store.MatchesJSON(data, q) {
+				return false, nil
+			}
+			collectionItem := store.CollectionItem{Key: key, Value: data}
+			if plan.Ordered && cursors {
+				position := l.Position(collectionItem, o)
+				if position < 0 {
+					return false, nil
+				}
+				if position > 0 {
+					return true, nil
+				}
+			}
+			items = append(items, collectionItem)
+			return plan.Ordered && l.Limit > 0 && len(items) == limit, nil
+		}
+
+		// Entries with equal values of the sorted fields are buffered
+		// to read their documents in key order.
+		type entry struct {
+			key    string
+			values []byte
+		}
+		var run []entry
+		var runValues []byte
+		flush := func() (bool, error) {
+			sort.Slice(run, func(i, j int) bool {
+				return run[i].key < run[j].key
+			})
+			for _, e := range run {
+				if done, err := read(e.key, e.values); done || err != nil {
+					return true, err
+				}
+			}
+			run = run[:0]
+			return false, nil
+		}
+
+		opts := badger.DefaultIteratorOptions
+		opts.Reverse = plan.Reverse
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		inRange := func(k []byte) bool {
+			return bytes.Compare(k, from) >= 0 && bytes.Compare(k, to) < 0
+		}
+		if plan.Reverse {
+			it.Seek(to)
+			// Seeking in reverse stops at the key itself if it exists.
+			if it.Valid() && !inRange(it.Item().Key()) {
+				it.Next()
+			}
+		} else {
+			it.Seek(from)
+		}
+		for ; it.Valid() && inRange(it.Item().Key()); it.Next() {
+			key, values, err := c.indexEntry(it.Item(), len(prefix))
+			if err != nil {
+				return err
+			}
+			sorted := store.IndexValuesPrefix(values, plan.Sorted)
+			if !bytes.Equal(sorted, runValues) {
+				if done, err := flush(); done || err != nil {
+					return err
+				}
+				runValues = sorted
+			}
+			run = append(run, entry{key, values})
+		}
+		_, err := flush()
+		return err
+	})
+	if err != nil {
+		return nil, store.Explanation{}, err
+	}
+	if !plan.Ordered {
+		if o.IsEmpty() {
+			sort.Slice(items, func(i, j int) bool {
+				return items[i].Key < items[j].Key
+			})
+		} else {
+			store.OrderJSON(items, o)
+		}
+	}
+	items = store.LimitItems(items, o, l)
+	explanation.Returned = len(items)
+	return items, explanation, nil
+}
+
+// pastBytes returns the first key following all keys with the given prefix.
+func pastBytes(prefix []byte) []byte {
+	past := append([]byte{}, prefix...)
+	for i := len(past) - 1; i >= 0; i-- {
+		if past[i] < 0xff {
+			past[i]++
+			return past[:i+1]
+		}
+	}
+	return nil
+}
+
+// indexEntry returns the key of the document of the index entry and the
+// encoded values of the indexed fields.
+func (c *collection) indexEntry(item *badger.Item, prefixLength int) (string, []byte, error) {
+	v, err := item.Value()
+	if err != nil {
+		return "", nil, err
+	}
+	key := string(v)
+	k := item.Key()
+	id := key[len(c.key)+1:]
+	return key, append([]byte{}, k[prefixLength:len(k)-len(id)]...), nil
+}
+
+func (g *collectionGroup) Name() string {
+	return g.name
+}
+
+func (g *collectionGroup) Items(q store.Query, o store.Order, l store.Limit, fields ...string) ([]store.CollectionItem, error) {
+	items, _, err := g.items(q, o, l)
+	if err != nil {
+		return nil, err
+	}
+	return store.ProjectItems(items, fields), nil
+}
+
+func (g *collectionGroup) Explain(q store.Query, o store.Order, l store.Limit) (store.Explanation, error) {
+	_, explanation, err := g.items(q, o, l)
+	return explanation, err
+}
+
+func (g *collectionGroup) Aggregate(q store.Query, groupBy []string, aggregations []store.Aggregation) ([]store.AggregateGroup, error) {
+	return store.Aggregate(g.Items, q, groupBy, aggregations)
+}
+
+// items reads the documents of the group by iterating all keys, skipping
+// the expiry and field indexes, which start with a zero byte.
+func (g *collectionGroup) items(q store.Query, o store.Order, l store.Limit) ([]store.CollectionItem, store.Explanation, error) {
+	if err := q.Validate(); err != nil {
+		return nil, store.Explanation{}, err
+	}
+	if err := l.Validate(o); err != nil {
+		return nil, store.Explanation{}, err
+	}
+	now := time.Now()
+	var items []store.CollectionItem
+	err := g.store.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek([]byte{1}); it.Valid(); it.Next() {
+			item := it.Item()
+			key := string(item.Key())
+			if !store.InCollectionGroup(key, g.name) {
+				continue
+			}
+			v, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			meta, data, err := store.DecodeRecord(v)
+			if err != nil {
+				return err
+			}
+			if !meta.Expired(now) {
+				items = append(items, store.CollectionItem{Key: key, Value: data})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, store.Explanation{}, err
+	}
+	items, explanation := store.GroupItems(items, q, o, l)
+	return items, explanation, nil
+}
+
+// RebuildIndexes drops all index entries and indexes the documents of the
+// indexed collections again, e.g. to repair the indexes.
+func (bs *badgerStore) RebuildIndexes() error {
+	if err := bs.dropPrefix(indexPrefix); err != nil {
+		return err
+	}
+	if err := bs.dropPrefix(builtPrefix); err != nil {
+		return err
+	}
+	return bs.buildIndexes()
+}
+
+// buildIndexes builds the declared indexes which haven't been built yet
+// and drops the entries of indexes which are no longer declared, whose
+// entries aren't maintained and would be stale once declared again.
+func (bs *badgerStore) buildIndexes() error {
+	declared := make(map[string]bool)
+	for _, index := range bs.indexes {
+		declared[string(index.ID())] = true
+	}
+	var built [][]byte
+	err := bs.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(builtPrefix); it.ValidForPrefix(builtPrefix); it.Next() {
+			built = append(built, append([]byte{}, it.Item().Key()[len(builtPrefix):]...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range built {
+		if declared[string(id)] {
+			delete(declared, string(id))
+			continue
+		}
+		if err := bs.dropIndex(id); err != nil {
+			return err
+		}
+	}
+	// Build the remaining indexes, dropping the entries of builds that
+	// have been interrupted first. Documents are indexed for all indexes
+	// of their collection, so each collection is indexed once.
+	var unbuilt []store.Index
+	for _, index := range bs.indexes {
+		if declared[string(index.ID())] {
+			unbuilt = append(unbuilt, index)
+			if err := bs.dropPrefix(indexEntryPrefix(index)); err != nil {
+				return err
+			}
+		}
+	}
+	indexed := make(map[string]bool)
+	for _, index := range unbuilt {
+		if indexed[index.Collection] {
+			continue
+		}
+		indexed[index.Collection] = true
+		if err := bs.indexCollection(index.Collection); err != nil {
+			return err
+		}
+	}
+	return bs.db.Update(func(txn *badger.Txn) error {
+		for _, index := range unbuilt {
+			if err := txn.Set(builtKey(index.ID()), []byte{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// dropIndex deletes the entries and the marker of the index with the given
+// ID.
+func (bs *badgerStore) dropIndex(id []byte) error {
+	if err := bs.dropPrefix(append(append([]byte{}, indexPrefix...), id...)); err != nil {
+		return err
+	}
+	return bs.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(builtKey(id))
+	})
+}
+
+func builtKey(id []byte) []byte {
+	return append(append([]byte{}, builtPrefix...), id...)
+}
+
+// dropPrefix deletes all keys with the given prefix in transactions of at
+// most deleteBatchSize keys each.
+func (bs *badgerStore) dropPrefix(prefix []byte) error {
+	for {
+		var batch [][]byte
+		err := bs.db.Update(func(txn *badger.Txn) error {
+			batch = nil
+			opts := badger.DefaultIteratorOptions
+			opts.PrefetchValues = false
+			it := txn.NewIterator(opts)
+			for it.Seek(prefix); it.ValidForPrefix(prefix) && len(batch) < deleteBatchSize; it.Next() {
+				batch = append(batch, append([]byte{}, it.Item().Key()...))
+			}
+			it.Close()
+
+			for _, k := range batch {
+				if err := txn.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil || len(batch) < deleteBatchSize {
+			return err
+		}
+	}
+}
+
+// indexCollection writes the index entries of the documents of the
+// collection in transactions of at most batchSize documents each.
+func (bs *badgerStore) indexCollection(collectionKey string) error {
+	prefix := []byte(collectionKey + "/")
+	start := prefix
+	batchSize := bs.batchSize()
+	now := time.Now()
+	for {
+		var last []byte
+		n := 0
+		err := bs.db.Update(func(txn *badger.Txn) error {
+			last, n = nil, 0
+			t := &tx{txn, bs}
+			it := txn.NewIterator(badger.DefaultIteratorOptions)
+			defer it.Close()
+			for it.Seek(start); it.ValidForPrefix(prefix) && n < batchSize; it.Next() {
+				item := it.Item()
+				key := string(item.Key())
+				last = append(last[:0], item.Key()...)
+				if bytes.ContainsAny(item.Key()[len(prefix):], "/") {
+					continue
+				}
+				v, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				meta, data, err := store.DecodeRecord(v)
+				if err != nil {
+					return err
+				}
+				if meta.Expired(now) {
+					continue
+				}
+				if err := t.indexFields(key, nil, data, &meta); err != nil {
+					return err
+				}
+				n++
+			}
+			return nil
+		})
+		if err != nil || n < batchSize {
+			return err
+		}
+		// Continue right after the last indexed key.
+		start = append(append([]byte{}, last...), 0)
+	}
+}
+
+func (t *tx) Get(key string) ([]byte, error) {
+	data, _, err := t.GetWithMetadata(key)
+	return data, err
+}
+
+func (t *tx) GetWithMetadata(key string) ([]byte, store.Metadata, error) {
+	v, meta, err := t.get(key)
+	if err != nil {
+		return nil, store.Metadata{}, err
+	}
+	if meta == nil {
+		return nil, store.Metadata{}, &store.NotFoundError{Key: key}
+	}
+	// Copy the value as it is no longer valid
+	// outside of the current transaction.
+	data := make([]byte, len(v))
+	copy(data, v)
+	return data, *meta, nil
+}
+
+// get returns the data and metadata of the document or nil metadata if it
+// does not exist or has expired. The data is only valid for the life of the
+// transaction.
+func (t *tx) get(key string) ([]byte, *store.Metadata, error) {
+	if !store.IsDocumentKey(key) {
+		return nil, nil, fmt.Errorf("not a document path: %s", key)
+	}
+	item, err := t.txn.Get([]byte(key))
+	if err == badger.ErrKeyNotFound {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	v, err := item.Value()
+	if err != nil {
+		return nil, nil, err
+	}
+	meta, data, err := store.DecodeRecord(v)
+	if err != nil {
+		return nil, nil, err
+	}
+	if meta.Expired(time.Now()) {
+		return nil, nil, nil
+	}
+	return data, &meta, nil
+}
+
+// put writes the document, given its current data and metadata or nil if it
+// does not exist, and keeps the expiry and field indexes up to date.
+func (t *tx) put(key string, data []byte, currentData []byte, current *store.Metadata, meta store.Metadata) error {
+	record, err := store.EncodeRecord(meta, data)
+	if err != nil {
+		return err
+	}
+	if meta.ExpireTime.IsZero() {
+		err = t.txn.Set([]byte(key), record)
+	} else {
+		// Badger expires entries with a precision of seconds, round up so
+		// it never drops them before the sweeper got to see them.
+		err = t.txn.SetWithTTL([]byte(key), record, time.Until(meta.ExpireTime)+time.Second)
+	}
+	if err != nil {
+		return err
+	}
+	if err := t.index(key, current, meta.ExpireTime); err != nil {
+		return err
+	}
+	return t.indexFields(key, currentData, data, &meta)
+}
+
+// index replaces the expiry index entry of the document for its current
+// expiration time with one for the given time, if any.
+func (t *tx) index(key string, current *store.Metadata, expireTime time.Time) error {
+	if current != nil && current.ExpireTime.Equal(expireTime) {
+		return nil
+	}
+	if current != nil && !current.ExpireTime.IsZero() {
+		if err := t.txn.Delete(expiryIndexKey(current.ExpireTime, key)); err != nil {
+			return err
+		}
+	}
+	if expireTime.IsZero() {
+		return nil
+	}
+	return t.txn.Set(expiryIndexKey(expireTime, key), []byte{})
+}
+
+func expiryIndexKey(expireTime time.Time, key string) []byte {
+	return append(append([]byte{}, expiryPrefix...), store.ExpiryIndexKey(expireTime, key)...)
+}
+
+// indexFields replaces the index entries of the document for its current
+// data, if any, with entries for the given data, if any. Entries expire
+// along with their documents.
+func (t *tx) indexFields(key string, current []byte, data []byte, meta *store.Metadata) error {
+	collectionKey := store.CollectionKey(key)
+	id := key[len(collectionKey)+1:]
+	for _, index := range t.store.indexes {
+		if index.Collection != collectionKey {
+			continue
+		}
+		prefix := indexEntryPrefix(index)
+		if current != nil {
+			if err := t.txn.Delete(indexEntryKey(prefix, index.Encode(current), id)); err != nil {
+				return err
+			}
+		}
+		if data == nil {
+			continue
+		}
+		entry := indexEntryKey(prefix, index.Encode(data), id)
+		var err error
+		if meta.ExpireTime.IsZero() {
+			err = t.txn.Set(entry, []byte(key))
+		} else {
+			err = t.txn.SetWithTTL(entry, []byte(key), time.Until(meta.ExpireTime)+time.Second)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexEntryPrefix returns the prefix of the entries of the index.
+func indexEntryPrefix(index store.Index) []byte {
+	return append(append([]byte{}, indexPrefix...), index.ID()...)
+}
+
+func indexEntryKey(prefix []byte, value []byte, id string) []byte {
+	return append(append(append([]byte{}, prefix...), value...), id...)
+}
+
+func (t *tx) Set(key string, data []byte, preconditions ...store.Precondition) error {
+	return t.SetWithTTL(key, data, 0, preconditions...)
+}
+
+func (t *tx) SetWithTTL(key string, data []byte, ttl time.Duration, preconditions ...store.Precondition) error {
+	v, meta, err := t.get(key)
+	if err != nil {
+		return err
+	}
+	if err := store.CheckPreconditions(key, meta, preconditions); err != nil {
+		return err
+	}
+	return t.put(key, data, v, meta, store.NextMetadataWithTTL(meta, ttl))
+}
+
+func (t *tx) Update(key string, data []byte, preconditions ...store.Precondition) error {
+	v, meta, err := t.get(key)
+	if err != nil {
+		return err
+	}
+	if err := store.CheckPreconditions(key, meta, preconditions); err != nil {
+		return err
+	}
+	if meta == nil {
+		return &store.NotFoundError{Key: key}
+	}
+	merged, err := store.MergeJSON(v, data)
+	if err != nil {
+		return err
+	}
+	return t.put(key, merged, v, meta, store.NextMetadata(meta))
+}
+
+func (t *tx) Delete(key string, preconditions ...store.Precondition) error {
+	v, meta, err := t.get(key)
+	if err != nil {
+		return err
 	}
-	if limitItems && len(items) >= l.Limit {
-		items = items[:l.Limit]
+	if err := store.CheckPreconditions(key, meta, preconditions); err != nil {
+		return err
+	}
+	if meta == nil {
+		return nil
+	}
+	if err := t.txn.Delete([]byte(key)); err != nil {
+		return err
+	}
+	if err := t.index(key, meta, time.Time{}); err != nil {
+		return err
+	}
+	return t.indexFields(key, v, nil, nil)
+}
+
+func (t *tx) Add(collectionKey string, data []byte) (string, error) {
+	return t.AddWithTTL(collectionKey, data, 0)
+}
+
+func (t *tx) AddWithTTL(collectionKey string, data []byte, ttl time.Duration) (string, error) {
+	if !store.IsCollectionKey(collectionKey) {
+		return "", fmt.Errorf("not a collection path: %s", collectionKey)
+	}
+	// Sequences live outside of transactions, numbers handed out to
+	// transactions that are rolled back are lost.
+	seq, err := t.store.db.GetSequence([]byte(collectionKey), 1)
+	if err != nil {
+		return "", err
+	}
+	defer seq.Release()
+	// Skip the IDs of documents that have been set explicitly.
+	for {
+		num, err := seq.Next()
+		if err != nil {
+			return "", err
+		}
+		key := fmt.Sprintf("%s/%d", collectionKey, num)
+		_, meta, err := t.get(key)
+		if err != nil {
+			return "", err
+		}
+		if meta == nil {
+			return key, t.SetWithTTL(key, data, ttl)
+		}
 	}
-	return items, err
 }
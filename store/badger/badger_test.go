@@ -0,0 +1,293 @@
+package badger_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/imba3r/thunder/store"
+	"github.com/imba3r/thunder/store/badger"
+	"github.com/imba3r/thunder/store/storetest"
+)
+
+func TestConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thunder-badger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	n := 0
+	storetest.RunConformance(t, func() store.Store {
+		n++
+		return badger.New(filepath.Join(dir, fmt.Sprint(n)))
+	})
+}
+
+func TestCollectionDeleteBatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thunder-badger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := badger.New(dir)
+	if err := s.Open(store.Json); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Deletes span several transactions beyond 1000 documents.
+	for i := 0; i < 2500; i += 500 {
+		b := store.NewBatch()
+		for j := i; j < i+500; j++ {
+			b.Set(fmt.Sprintf("items/%04d", j), []byte(`{}`))
+		}
+		if _, err := b.Commit(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, _ := s.Collection("items")
+	keys, err := c.Delete(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2500 {
+		t.Errorf("Expected 2500 deleted documents, got %d", len(keys))
+	}
+	items, err := c.Items(store.Query{}, store.Order{}, store.Limit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 0 {
+		t.Errorf("Expected no items, got %d", len(items))
+	}
+}
+
+func TestConformanceIndexed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thunder-badger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var indexes []store.Index
+	for _, field := range []string{"n", "s", "v", "o", "a", "b"} {
+		indexes = append(indexes, store.Index{Collection: "items", Fields: []string{field}})
+	}
+	// Composite indexes serve the conformance tests of queries and orders
+	// by several fields.
+	indexes = append(indexes,
+		store.Index{Collection: "items", Fields: []string{"n", "s"}},
+		store.Index{Collection: "items", Fields: []string{"a", "b"}},
+		store.Index{Collection: "items", Fields: []string{"s", "n"}})
+	n := 0
+	storetest.RunConformance(t, func() store.Store {
+		n++
+		return badger.New(filepath.Join(dir, fmt.Sprint(n)), indexes...)
+	})
+}
+
+func TestRebuildIndexes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thunder-badger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	age := store.Index{Collection: "users", Fields: []string{"age"}}
+	q := store.Query{Field: "age", Operator: store.Eq, Value: 22}
+	expectUsers := func(s store.Store, expected string) {
+		t.Helper()
+		c, _ := s.Collection("users")
+		explanation, err := c.Explain(q, store.Order{}, store.Limit{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if explanation.Index == nil {
+			t.Errorf("Expected index scan, got %+v", explanation)
+		}
+		items, err := c.Items(q, store.Order{}, store.Limit{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for _, item := range items {
+			keys = append(keys, item.Key)
+		}
+		if strings.Join(keys, ",") != expected {
+			t.Errorf("Expected %s, got %v", expected, keys)
+		}
+	}
+
+	s := badger.New(dir)
+	if err := s.Open(store.Json); err != nil {
+		t.Fatal(err)
+	}
+	b := store.NewBatch()
+	for i := 0; i < 10; i++ {
+		b.Set(fmt.Sprintf("users/%d", i), []byte(fmt.Sprintf(`{"age":%d}`, 20+i%5)))
+	}
+	if _, err := b.Commit(s); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// Documents written before the index was declared are indexed once
+	// the store is opened.
+	s = badger.New(dir, age)
+	if err := s.Open(store.Json); err != nil {
+		t.Fatal(err)
+	}
+	expectUsers(s, "users/2,users/7")
+	if err := s.(interface{ RebuildIndexes() error }).RebuildIndexes(); err != nil {
+		t.Fatal(err)
+	}
+	expectUsers(s, "users/2,users/7")
+	s.Close()
+
+	// Writes while the index isn't declared aren't indexed, the index is
+	// built again once it is declared again.
+	s = badger.New(dir)
+	if err := s.Open(store.Json); err != nil {
+		t.Fatal(err)
+	}
+	d, _ := s.Document("users/2")
+	if err := d.Set([]byte(`{"age":30}`)); err != nil {
+		t.Fatal(err)
+	}
+	d, _ = s.Document("users/3")
+	if err := d.Set([]byte(`{"age":22}`)); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s = badger.New(dir, age)
+	if err := s.Open(store.Json); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	expectUsers(s, "users/3,users/7")
+}
+
+func TestExplain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thunder-badger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	age := store.Index{Collection: "users", Fields: []string{"age"}}
+	cityAge := store.Index{Collection: "users", Fields: []string{"city", "age"}}
+	s := badger.New(dir, age, cityAge)
+	if err := s.Open(store.Json); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	b := store.NewBatch()
+	for i := 0; i < 20; i++ {
+		city := []string{"Berlin", "Paris"}[i%2]
+		b.Set(fmt.Sprintf("users/%02d", i), []byte(fmt.Sprintf(`{"age":%d,"city":%q,"name":"user%d"}`, 20+i, city, i)))
+	}
+	if _, err := b.Commit(s); err != nil {
+		t.Fatal(err)
+	}
+	c, _ := s.Collection("users")
+
+	berlin := store.Query{Field: "city", Operator: store.Eq, Value: "Berlin"}
+	tests := []struct {
+		query    store.Query
+		order    store.Order
+		limit    store.Limit
+		index    *store.Index
+		examined int
+		returned int
+	}{
+		{store.Query{}, store.Order{}, store.Limit{}, nil, 20, 20},
+		{store.Query{Field: "name", Operator: store.Eq, Value: "user3"}, store.Order{}, store.Limit{}, nil, 20, 1},
+		{store.Query{Field: "age", Operator: store.Lt, Value: 25}, store.Order{}, store.Limit{}, &age, 5, 5},
+		{store.And(berlin, store.Query{Field: "age", Operator: store.Ge, Value: 30}), store.Order{}, store.Limit{}, &cityAge, 5, 5},
+		{berlin, store.Order{OrderBy: "age", Ascending: false}, store.Limit{Limit: 3}, &cityAge, 3, 3},
+		// Ordered scans stop at the limit, apart from the items skipped.
+		{store.Query{}, store.Order{OrderBy: "age", Ascending: true}, store.Limit{Limit: 2, Offset: 3}, &age, 5, 2},
+		{store.Query{Field: "name", Operator: store.Prefix, Value: "user1"}, store.Order{OrderBy: "age", Ascending: true}, store.Limit{Limit: 2}, &age, 11, 2},
+	}
+	for i, test := range tests {
+		explanation, err := c.Explain(test.query, test.order, test.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.index == nil && (explanation.Scan != store.FullScan || explanation.Index != nil) {
+			t.Errorf("%d: expected full scan, got %+v", i, explanation)
+		}
+		if test.index != nil && (explanation.Scan != store.IndexScan || explanation.Index == nil ||
+			strings.Join(explanation.Index.Fields, ",") != strings.Join(test.index.Fields, ",")) {
+			t.Errorf("%d: expected scan of index %v, got %+v", i, test.index.Fields, explanation)
+		}
+		if explanation.Examined != test.examined || explanation.Returned != test.returned {
+			t.Errorf("%d: expected %d examined and %d returned, got %+v", i, test.examined, test.returned, explanation)
+		}
+	}
+
+	// Descending scans of composite indexes return the same items as full
+	// scans would.
+	items, err := c.Items(berlin, store.Order{OrderBy: "age", Ascending: false}, store.Limit{Limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 3 || items[0].Key != "users/18" || items[1].Key != "users/16" || items[2].Key != "users/14" {
+		t.Errorf("Expected users/18, users/16 and users/14, got %v", items)
+	}
+}
+
+func TestOverlappingIndexes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thunder-badger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The entries of the index on age and city don't lie within the
+	// entries of the index on age.
+	age := store.Index{Collection: "users", Fields: []string{"age"}}
+	ageCity := store.Index{Collection: "users", Fields: []string{"age", "city"}}
+	s := badger.New(dir, age, ageCity)
+	if err := s.Open(store.Json); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	b := store.NewBatch()
+	for i := 0; i < 10; i++ {
+		b.Set(fmt.Sprintf("users/%d", i), []byte(fmt.Sprintf(`{"age":%d,"city":"Berlin"}`, 20+i)))
+	}
+	if _, err := b.Commit(s); err != nil {
+		t.Fatal(err)
+	}
+	c, _ := s.Collection("users")
+
+	q := store.Query{Field: "age", Operator: store.Ge, Value: 25}
+	o := store.Order{OrderBy: "age", Ascending: false}
+	explanation, err := c.Explain(q, o, store.Limit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if explanation.Index == nil || len(explanation.Index.Fields) != 1 || explanation.Examined != 5 {
+		t.Errorf("Expected 5 entries of the index on age to be examined, got %+v", explanation)
+	}
+	items, err := c.Items(q, o, store.Limit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, item := range items {
+		keys = append(keys, item.Key)
+	}
+	if strings.Join(keys, ",") != "users/9,users/8,users/7,users/6,users/5" {
+		t.Errorf("Expected users 9 to 5, got %v", keys)
+	}
+}
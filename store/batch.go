@@ -0,0 +1,82 @@
+package store
+
+// Batch collects writes that are committed together in a single
+// transaction, which is a lot cheaper than committing bulk imports
+// document by document. Batches are not safe for concurrent use.
+type Batch struct {
+	writes []batchWrite
+}
+
+type batchOperation int
+
+const (
+	batchSet batchOperation = iota
+	batchUpdate
+	batchDelete
+	batchAdd
+)
+
+type batchWrite struct {
+	op            batchOperation
+	key           string
+	data          []byte
+	preconditions []Precondition
+}
+
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+func (b *Batch) Set(key string, data []byte, preconditions ...Precondition) {
+	b.writes = append(b.writes, batchWrite{batchSet, key, data, preconditions})
+}
+
+func (b *Batch) Update(key string, data []byte, preconditions ...Precondition) {
+	b.writes = append(b.writes, batchWrite{batchUpdate, key, data, preconditions})
+}
+
+func (b *Batch) Delete(key string, preconditions ...Precondition) {
+	b.writes = append(b.writes, batchWrite{batchDelete, key, nil, preconditions})
+}
+
+func (b *Batch) Add(collectionKey string, data []byte) {
+	b.writes = append(b.writes, batchWrite{batchAdd, collectionKey, data, nil})
+}
+
+// Len returns the number of writes in the batch.
+func (b *Batch) Len() int {
+	return len(b.writes)
+}
+
+// Commit applies all writes of the batch to the store in a single
+// transaction. It returns the keys of the written documents in the order
+// the writes were added to the batch, including the generated keys of
+// added documents. Either all writes are applied or none is.
+func (b *Batch) Commit(s Store) ([]string, error) {
+	var keys []string
+	err := s.RunTransaction(func(tx Tx) error {
+		keys = make([]string, len(b.writes))
+		for i, w := range b.writes {
+			var err error
+			keys[i] = w.key
+			switch w.op {
+			case batchSet:
+				err = tx.Set(w.key, w.data, w.preconditions...)
+			case batchUpdate:
+				err = tx.Update(w.key, w.data, w.preconditions...)
+			case batchDelete:
+				err = tx.Delete(w.key, w.preconditions...)
+			case batchAdd:
+				keys[i], err = tx.Add(w.key, w.data)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
@@ -0,0 +1,786 @@
+package bolt
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/imba3r/thunder/store"
+)
+
+// Collections map to buckets. Root collections are top-level buckets and
+// the subcollections of a document are nested into the bucket of the
+// document's collection, named "<document id>/<collection id>". Documents
+// are plain key/value pairs of their collection's bucket, which lets
+// collection iteration skip nested buckets instead of filtering keys.
+// Documents with a time-to-live are indexed by their expiration time in
+// the top-level expiryBucket, which is no valid collection key.
+type boltStore struct {
+	path string
+	enc  store.Encoding
+
+	db       *bolt.DB
+	sweeper  *store.Sweeper
+	searcher *store.Searcher
+}
+
+type document struct {
+	key   string
+	store *boltStore
+}
+
+type collection struct {
+	key   string
+	store *boltStore
+}
+
+type collectionGroup struct {
+	name  string
+	store *boltStore
+}
+
+type tx struct {
+	btx *bolt.Tx
+}
+
+var _ store.Store = &boltStore{}
+var _ store.Tx = &tx{}
+
+var expiryBucket = []byte("\x00expiry")
+
+func New(path string) store.Store {
+	bs := &boltStore{path: path}
+	bs.sweeper = store.NewSweeper(bs.sweep)
+	bs.searcher = store.NewSearcher()
+	bs.sweeper.OnExpire(bs.searcher.Remove)
+	return bs
+}
+
+func (bs *boltStore) Open(enc store.Encoding) error {
+	db, err := bolt.Open(bs.path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+
+	bs.enc = enc
+	bs.db = db
+	bs.sweeper.Start()
+	return nil
+}
+
+func (bs *boltStore) Document(key string) (store.Document, error) {
+	if store.IsDocumentKey(key) {
+		return &document{key, bs}, nil
+	}
+	return nil, fmt.Errorf("not a document path: %s", key)
+}
+
+func (bs *boltStore) Collection(key string) (store.Collection, error) {
+	if store.IsCollectionKey(key) {
+		return &collection{key, bs}, nil
+	}
+	return nil, fmt.Errorf("not a collection path: %s", key)
+}
+
+func (bs *boltStore) CollectionGroup(name string) (store.CollectionGroup, error) {
+	if store.IsCollectionGroupName(name) {
+		return &collectionGroup{name, bs}, nil
+	}
+	return nil, fmt.Errorf("not a collection group name: %s", name)
+}
+
+func (bs *boltStore) RunTransaction(f func(tx store.Tx) error) error {
+	var t *store.SearchTx
+	err := bs.db.Update(func(btx *bolt.Tx) error {
+		t = bs.searcher.Tx(&tx{btx})
+		return f(t)
+	})
+	if err == nil {
+		t.Commit()
+	}
+	return err
+}
+
+func (bs *boltStore) RootCollections() ([]string, error) {
+	var keys []string
+	err := bs.db.View(func(btx *bolt.Tx) error {
+		return btx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if !bytes.Equal(name, expiryBucket) && hasDocuments(b) {
+				keys = append(keys, string(name))
+			}
+			return nil
+		})
+	})
+	return keys, err
+}
+
+// hasDocuments reports whether the bucket or any of its nested buckets
+// holds a document. Buckets are kept when their documents are deleted.
+func hasDocuments(b *bolt.Bucket) bool {
+	cursor := b.Cursor()
+	for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+		if v != nil || hasDocuments(b.Bucket(k)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (bs *boltStore) OnExpire(f func(key string)) {
+	bs.sweeper.OnExpire(f)
+}
+
+func (bs *boltStore) EnableSearch(collectionKey string, fields ...string) error {
+	c, err := bs.Collection(collectionKey)
+	if err != nil {
+		return err
+	}
+	return bs.searcher.Enable(collectionKey, fields, c.Items)
+}
+
+func (bs *boltStore) Close() {
+	bs.sweeper.Stop()
+	bs.db.Close()
+}
+
+// sweep removes the documents that have expired by now, walking the expiry
+// index in order of expiration time.
+func (bs *boltStore) sweep(now time.Time) ([]string, error) {
+	var keys []string
+	err := bs.db.Update(func(btx *bolt.Tx) error {
+		keys = nil
+		index := btx.Bucket(expiryBucket)
+		if index == nil {
+			return nil
+		}
+		var due [][]byte
+		cursor := index.Cursor()
+		for k, _ := cursor.First(); k != nil; k, _ = cursor.Next() {
+			expireTime, _, err := store.ParseExpiryIndexKey(k)
+			if err != nil {
+				return err
+			}
+			if now.Before(expireTime) {
+				break
+			}
+			due = append(due, append([]byte{}, k...))
+		}
+		for _, k := range due {
+			if err := index.Delete(k); err != nil {
+				return err
+			}
+			expireTime, key, _ := store.ParseExpiryIndexKey(k)
+			b := bucket(btx, store.CollectionKey(key))
+			if b == nil {
+				continue
+			}
+			v := b.Get(documentID(key))
+			if v == nil {
+				continue
+			}
+			meta, _, err := store.DecodeRecord(v)
+			if err != nil {
+				return err
+			}
+			// The document has been written again since.
+			if !meta.ExpireTime.Equal(expireTime) {
+				continue
+			}
+			if err := b.Delete(documentID(key)); err != nil {
+				return err
+			}
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// bucketNames returns the names of the nested buckets leading to the
+// bucket of the given collection key.
+func bucketNames(collectionKey string) []string {
+	split := strings.Split(collectionKey, "/")
+	names := []string{split[0]}
+	for i := 1; i+1 < len(split); i += 2 {
+		names = append(names, split[i]+"/"+split[i+1])
+	}
+	return names
+}
+
+// bucket returns the bucket of the given collection key or nil if it
+// does not exist.
+func bucket(tx *bolt.Tx, collectionKey string) *bolt.Bucket {
+	var b *bolt.Bucket
+	for i, name := range bucketNames(collectionKey) {
+		if i == 0 {
+			b = tx.Bucket([]byte(name))
+		} else {
+			b = b.Bucket([]byte(name))
+		}
+		if b == nil {
+			return nil
+		}
+	}
+	return b
+}
+
+// createBucket returns the bucket of the given collection key, creating
+// it and all of its parents if necessary.
+func createBucket(tx *bolt.Tx, collectionKey string) (*bolt.Bucket, error) {
+	var b *bolt.Bucket
+	var err error
+	for i, name := range bucketNames(collectionKey) {
+		if i == 0 {
+			b, err = tx.CreateBucketIfNotExists([]byte(name))
+		} else {
+			b, err = b.CreateBucketIfNotExists([]byte(name))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// documentID returns the last segment of the given document key, which
+// is the key of the document within its collection's bucket.
+func documentID(documentKey string) []byte {
+	return []byte(documentKey[strings.LastIndex(documentKey, "/")+1:])
+}
+
+func (d *document) Key() string {
+	return d.key
+}
+
+func (d *document) Get(fields ...string) ([]byte, error) {
+	data, _, err := d.GetWithMetadata()
+	if err != nil {
+		return nil, err
+	}
+	return store.ProjectJSON(data, fields), nil
+}
+
+func (d *document) GetWithMetadata() ([]byte, store.Metadata, error) {
+	var data []byte
+	var meta store.Metadata
+	err := d.store.db.View(func(btx *bolt.Tx) error {
+		var err error
+		data, meta, err = (&tx{btx}).GetWithMetadata(d.key)
+		return err
+	})
+	if err != nil {
+		return nil, store.Metadata{}, err
+	}
+	return data, meta, nil
+}
+
+func (d *document) Set(data []byte, preconditions ...store.Precondition) error {
+	return d.store.RunTransaction(func(tx store.Tx) error {
+		return tx.Set(d.key, data, preconditions...)
+	})
+}
+
+func (d *document) SetWithTTL(data []byte, ttl time.Duration, preconditions ...store.Precondition) error {
+	return d.store.RunTransaction(func(tx store.Tx) error {
+		return tx.SetWithTTL(d.key, data, ttl, preconditions...)
+	})
+}
+
+func (d *document) Update(data []byte, preconditions ...store.Precondition) error {
+	return d.store.RunTransaction(func(tx store.Tx) error {
+		return tx.Update(d.key, data, preconditions...)
+	})
+}
+
+func (d *document) Delete(preconditions ...store.Precondition) error {
+	return d.store.RunTransaction(func(tx store.Tx) error {
+		return tx.Delete(d.key, preconditions...)
+	})
+}
+
+func (d *document) DeleteRecursive(preconditions ...store.Precondition) ([]string, error) {
+	var keys []string
+	err := d.store.db.Update(func(btx *bolt.Tx) error {
+		t := &tx{btx}
+		_, meta, err := t.get(d.key)
+		if err != nil {
+			return err
+		}
+		if err := store.CheckPreconditions(d.key, meta, preconditions); err != nil {
+			return err
+		}
+		keys = nil
+		b := bucket(btx, store.CollectionKey(d.key))
+		if b == nil {
+			return nil
+		}
+		id := documentID(d.key)
+		if err := t.deleteDocument(b, d.key, &keys); err != nil {
+			return err
+		}
+		// The subcollections of the document are the nested buckets
+		// prefixed with its ID.
+		prefix := append(append([]byte{}, id...), '/')
+		var names [][]byte
+		cursor := b.Cursor()
+		for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			if v == nil {
+				names = append(names, append([]byte{}, k...))
+			}
+		}
+		for _, name := range names {
+			key := store.CollectionKey(d.key) + "/" + string(name)
+			if err := t.deleteDocuments(b.Bucket(name), key, true, &keys); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		d.store.searcher.Remove(key)
+	}
+	return keys, nil
+}
+
+func (d *document) Collections() ([]string, error) {
+	var keys []string
+	err := d.store.db.View(func(btx *bolt.Tx) error {
+		b := bucket(btx, store.CollectionKey(d.key))
+		if b == nil {
+			return nil
+		}
+		prefix := append(documentID(d.key), '/')
+		cursor := b.Cursor()
+		for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			if v == nil && hasDocuments(b.Bucket(k)) {
+				keys = append(keys, d.key+"/"+string(k[len(prefix):]))
+			}
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (c *collection) Key() string {
+	return c.key
+}
+
+func (c *collection) Add(data []byte) (store.Document, error) {
+	return c.AddWithTTL(data, 0)
+}
+
+func (c *collection) AddWithTTL(data []byte, ttl time.Duration) (store.Document, error) {
+	var key string
+	err := c.store.RunTransaction(func(tx store.Tx) error {
+		var err error
+		key, err = tx.AddWithTTL(c.key, data, ttl)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.store.Document(key)
+}
+
+func (c *collection) Delete(recursive bool) ([]string, error) {
+	var keys []string
+	err := c.store.db.Update(func(btx *bolt.Tx) error {
+		keys = nil
+		b := bucket(btx, c.key)
+		if b == nil {
+			return nil
+		}
+		return (&tx{btx}).deleteDocuments(b, c.key, recursive, &keys)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		c.store.searcher.Remove(key)
+	}
+	return keys, nil
+}
+
+func (c *collection) Items(q store.Query, o store.Order, l store.Limit, fields ...string) ([]store.CollectionItem, error) {
+	items, _, err := c.items(q, o, l)
+	if err != nil {
+		return nil, err
+	}
+	return store.ProjectItems(items, fields), nil
+}
+
+func (c *collection) Explain(q store.Query, o store.Order, l store.Limit) (store.Explanation, error) {
+	_, explanation, err := c.items(q, o, l)
+	return explanation, err
+}
+
+func (c *collection) Aggregate(q store.Query, groupBy []string, aggregations []store.Aggregation) ([]store.AggregateGroup, error) {
+	return store.Aggregate(c.Items, q, groupBy, aggregations)
+}
+
+func (c *collection) Search(text string, limit int) ([]store.SearchResult, error) {
+	return c.store.searcher.Search(c.key, text, limit, func(key string) ([]byte, error) {
+		return (&document{key, c.store}).Get()
+	})
+}
+
+func (c *collection) items(q store.Query, o store.Order, l store.Limit) ([]store.CollectionItem, store.Explanation, error) {
+	if err := q.Validate(); err != nil {
+		return nil, store.Explanation{}, err
+	}
+	if err := l.Validate(o); err != nil {
+		return nil, store.Explanation{}, err
+	}
+	queryItems := !q.IsEmpty()
+	orderItems := !o.IsEmpty()
+	limit := l.Limit + l.Offset
+
+	now := time.Now()
+	explanation := store.Explanation{Scan: store.FullScan}
+	var items []store.CollectionItem
+	err := c.store.db.View(func(tx *bolt.Tx) error {
+		b := bucket(tx, c.key)
+		if b == nil {
+			return nil
+		}
+		// Unordered items are iterated in key order, which allows
+		// seeking to the start cursor and stopping at the end cursor.
+		cursor := b.Cursor()
+		k, v := cursor.First()
+		if startKey := l.StartKey(); !orderItems && startKey > c.key+"/" {
+			k, v = cursor.Seek([]byte(strings.TrimPrefix(startKey, c.key+"/")))
+		}
+		for ; k != nil; k, v = cursor.Next() {
+			// Nested buckets hold subcollections.
+			if v == nil {
+				continue
+			}
+			// If items are unordered we may break during
+			// iteration once the limit has been reached.
+			if l.Limit > 0 && !orderItems && len(items) == limit {
+				break
+			}
+			if !orderItems {
+				position := l.Position(store.CollectionItem{Key: c.key + "/" + string(k)}, o)
+				if position < 0 {
+					continue
+				}
+				if position > 0 {
+					break
+				}
+			}
+			meta, data, err := store.DecodeRecord(v)
+			if err != nil {
+				return err
+			}
+			if meta.Expired(now) {
+				continue
+			}
+			explanation.Examined++
+			// Filter out items that don't match the query (if any).
+			if queryItems && !store.MatchesJSON(data, q) {
+				continue
+			}
+			value := make([]byte, len(data))
+			copy(value, data)
+			items = append(items, store.CollectionItem{Key: c.key + "/" + string(k), Value: value})
+		}
+		return nil
+	})
+	// Sort..
+	if orderItems {
+		store.OrderJSON(items, o)
+	}
+	// .. and limit.
+	items = store.LimitItems(items, o, l)
+	explanation.Returned = len(items)
+	return items, explanation, err
+}
+
+func (g *collectionGroup) Name() string {
+	return g.name
+}
+
+func (g *collectionGroup) Items(q store.Query, o store.Order, l store.Limit, fields ...string) ([]store.CollectionItem, error) {
+	items, _, err := g.items(q, o, l)
+	if err != nil {
+		return nil, err
+	}
+	return store.ProjectItems(items, fields), nil
+}
+
+func (g *collectionGroup) Explain(q store.Query, o store.Order, l store.Limit) (store.Explanation, error) {
+	_, explanation, err := g.items(q, o, l)
+	return explanation, err
+}
+
+func (g *collectionGroup) Aggregate(q store.Query, groupBy []string, aggregations []store.Aggregation) ([]store.AggregateGroup, error) {
+	return store.Aggregate(g.Items, q, groupBy, aggregations)
+}
+
+func (g *collectionGroup) items(q store.Query, o store.Order, l store.Limit) ([]store.CollectionItem, store.Explanation, error) {
+	if err := q.Validate(); err != nil {
+		return nil, store.Explanation{}, err
+	}
+	if err := l.Validate(o); err != nil {
+		return nil, store.Explanation{}, err
+	}
+	now := time.Now()
+	var items []store.CollectionItem
+	// walk reads the documents of the bucket of the given collection key
+	// if it belongs to the group and descends into its nested buckets.
+	var walk func(b *bolt.Bucket, collectionKey string) error
+	walk = func(b *bolt.Bucket, collectionKey string) error {
+		member := store.CollectionName(collectionKey) == g.name
+		return b.ForEach(func(k, v []byte) error {
+			if v == nil {
+				return walk(b.Bucket(k), collectionKey+"/"+string(k))
+			}
+			if !member {
+				return nil
+			}
+			meta, data, err := store.DecodeRecord(v)
+			if err != nil {
+				return err
+			}
+			if !meta.Expired(now) {
+				value := make([]byte, len(data))
+				copy(value, data)
+				items = append(items, store.CollectionItem{Key: collectionKey + "/" + string(k), Value: value})
+			}
+			return nil
+		})
+	}
+	err := g.store.db.View(func(btx *bolt.Tx) error {
+		return btx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if bytes.Equal(name, expiryBucket) {
+				return nil
+			}
+			return walk(b, string(name))
+		})
+	})
+	if err != nil {
+		return nil, store.Explanation{}, err
+	}
+	items, explanation := store.GroupItems(items, q, o, l)
+	return items, explanation, nil
+}
+
+func (t *tx) Get(key string) ([]byte, error) {
+	data, _, err := t.GetWithMetadata(key)
+	return data, err
+}
+
+func (t *tx) GetWithMetadata(key string) ([]byte, store.Metadata, error) {
+	v, meta, err := t.get(key)
+	if err != nil {
+		return nil, store.Metadata{}, err
+	}
+	if meta == nil {
+		return nil, store.Metadata{}, &store.NotFoundError{Key: key}
+	}
+	// Values are only valid for the life of the transaction.
+	data := make([]byte, len(v))
+	copy(data, v)
+	return data, *meta, nil
+}
+
+// get returns the data and metadata of the document or nil metadata if it
+// does not exist or has expired. The data is only valid for the life of the
+// transaction.
+func (t *tx) get(key string) ([]byte, *store.Metadata, error) {
+	if !store.IsDocumentKey(key) {
+		return nil, nil, fmt.Errorf("not a document path: %s", key)
+	}
+	b := bucket(t.btx, store.CollectionKey(key))
+	if b == nil {
+		return nil, nil, nil
+	}
+	v := b.Get(documentID(key))
+	if v == nil {
+		return nil, nil, nil
+	}
+	meta, data, err := store.DecodeRecord(v)
+	if err != nil {
+		return nil, nil, err
+	}
+	if meta.Expired(time.Now()) {
+		return nil, nil, nil
+	}
+	return data, &meta, nil
+}
+
+// put writes the document, given its current metadata or nil if it does
+// not exist, and keeps the expiry index up to date.
+func (t *tx) put(key string, data []byte, current *store.Metadata, meta store.Metadata) error {
+	record, err := store.EncodeRecord(meta, data)
+	if err != nil {
+		return err
+	}
+	b, err := createBucket(t.btx, store.CollectionKey(key))
+	if err != nil {
+		return err
+	}
+	if err := b.Put(documentID(key), record); err != nil {
+		return err
+	}
+	return t.index(key, current, meta.ExpireTime)
+}
+
+// index replaces the expiry index entry of the document for its current
+// expiration time with one for the given time, if any.
+func (t *tx) index(key string, current *store.Metadata, expireTime time.Time) error {
+	if current != nil && current.ExpireTime.Equal(expireTime) {
+		return nil
+	}
+	if current != nil && !current.ExpireTime.IsZero() {
+		if index := t.btx.Bucket(expiryBucket); index != nil {
+			if err := index.Delete(store.ExpiryIndexKey(current.ExpireTime, key)); err != nil {
+				return err
+			}
+		}
+	}
+	if expireTime.IsZero() {
+		return nil
+	}
+	index, err := t.btx.CreateBucketIfNotExists(expiryBucket)
+	if err != nil {
+		return err
+	}
+	return index.Put(store.ExpiryIndexKey(expireTime, key), []byte{})
+}
+
+// deleteDocument deletes the document from the bucket of its collection,
+// whether it has expired or not, and appends its key to keys.
+func (t *tx) deleteDocument(b *bolt.Bucket, key string, keys *[]string) error {
+	v := b.Get(documentID(key))
+	if v == nil {
+		return nil
+	}
+	meta, _, err := store.DecodeRecord(v)
+	if err != nil {
+		return err
+	}
+	if err := b.Delete(documentID(key)); err != nil {
+		return err
+	}
+	*keys = append(*keys, key)
+	return t.index(key, &meta, time.Time{})
+}
+
+// deleteDocuments deletes the documents of the bucket of the given
+// collection key and, if recursive, of its nested buckets. Buckets are kept
+// along with their sequences so that keys of deleted documents aren't
+// handed out again.
+func (t *tx) deleteDocuments(b *bolt.Bucket, collectionKey string, recursive bool, keys *[]string) error {
+	var ids, names [][]byte
+	cursor := b.Cursor()
+	for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+		if v != nil {
+			ids = append(ids, append([]byte{}, k...))
+		} else if recursive {
+			names = append(names, append([]byte{}, k...))
+		}
+	}
+	for _, id := range ids {
+		if err := t.deleteDocument(b, collectionKey+"/"+string(id), keys); err != nil {
+			return err
+		}
+	}
+	for _, name := range names {
+		if err := t.deleteDocuments(b.Bucket(name), collectionKey+"/"+string(name), true, keys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *tx) Set(key string, data []byte, preconditions ...store.Precondition) error {
+	return t.SetWithTTL(key, data, 0, preconditions...)
+}
+
+func (t *tx) SetWithTTL(key string, data []byte, ttl time.Duration, preconditions ...store.Precondition) error {
+	_, meta, err := t.get(key)
+	if err != nil {
+		return err
+	}
+	if err := store.CheckPreconditions(key, meta, preconditions); err != nil {
+		return err
+	}
+	return t.put(key, data, meta, store.NextMetadataWithTTL(meta, ttl))
+}
+
+func (t *tx) Update(key string, data []byte, preconditions ...store.Precondition) error {
+	v, meta, err := t.get(key)
+	if err != nil {
+		return err
+	}
+	if err := store.CheckPreconditions(key, meta, preconditions); err != nil {
+		return err
+	}
+	if meta == nil {
+		return &store.NotFoundError{Key: key}
+	}
+	merged, err := store.MergeJSON(v, data)
+	if err != nil {
+		return err
+	}
+	return t.put(key, merged, meta, store.NextMetadata(meta))
+}
+
+func (t *tx) Delete(key string, preconditions ...store.Precondition) error {
+	_, meta, err := t.get(key)
+	if err != nil {
+		return err
+	}
+	if err := store.CheckPreconditions(key, meta, preconditions); err != nil {
+		return err
+	}
+	if meta == nil {
+		return nil
+	}
+	if err := bucket(t.btx, store.CollectionKey(key)).Delete(documentID(key)); err != nil {
+		return err
+	}
+	return t.index(key, meta, time.Time{})
+}
+
+func (t *tx) Add(collectionKey string, data []byte) (string, error) {
+	return t.AddWithTTL(collectionKey, data, 0)
+}
+
+func (t *tx) AddWithTTL(collectionKey string, data []byte, ttl time.Duration) (string, error) {
+	if !store.IsCollectionKey(collectionKey) {
+		return "", fmt.Errorf("not a collection path: %s", collectionKey)
+	}
+	b, err := createBucket(t.btx, collectionKey)
+	if err != nil {
+		return "", err
+	}
+	// Bucket sequences start at one, IDs start at zero like those of the
+	// other stores. Skip the IDs of documents that have been set
+	// explicitly.
+	for {
+		num, err := b.NextSequence()
+		if err != nil {
+			return "", err
+		}
+		key := fmt.Sprintf("%s/%d", collectionKey, num-1)
+		_, meta, err := t.get(key)
+		if err != nil {
+			return "", err
+		}
+		if meta == nil {
+			return key, t.put(key, data, nil, store.NextMetadataWithTTL(nil, ttl))
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package bolt_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/imba3r/thunder/store"
+	"github.com/imba3r/thunder/store/bolt"
+	"github.com/imba3r/thunder/store/storetest"
+)
+
+func TestConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thunder-bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	n := 0
+	storetest.RunConformance(t, func() store.Store {
+		n++
+		return bolt.New(filepath.Join(dir, fmt.Sprintf("%d.db", n)))
+	})
+}
@@ -0,0 +1,123 @@
+package store
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// typeRank orders the JSON types: null sorts before booleans, numbers,
+// strings, arrays and objects, in that order.
+func typeRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case float64:
+		return 2
+	case string:
+		return 3
+	case []interface{}:
+		return 4
+	case map[string]interface{}:
+		return 5
+	}
+	return 6
+}
+
+// CompareJSON compares two decoded JSON values and returns -1, 0 or 1 if a
+// sorts before, equal to or after b. Values of different types sort by
+// type, see typeRank. Within a type false sorts before true, numbers and
+// strings sort naturally, arrays element by element and objects by their
+// sorted keys and then by the values of the keys.
+func CompareJSON(a interface{}, b interface{}) int {
+	rankA, rankB := typeRank(a), typeRank(b)
+	if rankA != rankB {
+		return compareInts(rankA, rankB)
+	}
+	switch a := a.(type) {
+	case bool:
+		b := b.(bool)
+		if a == b {
+			return 0
+		}
+		if !a {
+			return -1
+		}
+		return 1
+	case float64:
+		b := b.(float64)
+		if a < b {
+			return -1
+		}
+		if a > b {
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(a, b.(string))
+	case []interface{}:
+		b := b.([]interface{})
+		for i := 0; i < len(a) && i < len(b); i++ {
+			if c := CompareJSON(a[i], b[i]); c != 0 {
+				return c
+			}
+		}
+		return compareInts(len(a), len(b))
+	case map[string]interface{}:
+		b := b.(map[string]interface{})
+		keysA, keysB := sortedKeys(a), sortedKeys(b)
+		for i := 0; i < len(keysA) && i < len(keysB); i++ {
+			if c := strings.Compare(keysA[i], keysB[i]); c != 0 {
+				return c
+			}
+			if c := CompareJSON(a[keysA[i]], b[keysB[i]]); c != 0 {
+				return c
+			}
+		}
+		return compareInts(len(keysA), len(keysB))
+	}
+	return 0
+}
+
+func compareInts(a int, b int) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// NormalizeJSON converts a Go value to the value encoding/json decodes its
+// JSON representation to, e.g. integers to float64 and structs to maps.
+func NormalizeJSON(v interface{}) (interface{}, error) {
+	switch v.(type) {
+	case nil, bool, float64, string:
+		return v, nil
+	case int:
+		return float64(v.(int)), nil
+	case json.RawMessage:
+		var normalized interface{}
+		err := json.Unmarshal(v.(json.RawMessage), &normalized)
+		return normalized, err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var normalized interface{}
+	err = json.Unmarshal(data, &normalized)
+	return normalized, err
+}
@@ -0,0 +1,128 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/Jeffail/gabs"
+)
+
+// Cursor is a position within the ordered items of a collection, given by
+// the values of the order fields and the key of an item. Cursors may hold
+// fewer values than there are order fields, in which case they are
+// positioned relative to all items with these values and the key is
+// ignored.
+//
+// Cursors marshal to opaque tokens that are passed back to continue a
+// listing. They unmarshal from these tokens as well as from JSON objects
+// holding the values and key.
+type Cursor struct {
+	Values []interface{} `json:"values,omitempty"`
+	Key    string        `json:"key,omitempty"`
+}
+
+// cursorFields is the JSON representation of a cursor.
+type cursorFields struct {
+	Values []interface{} `json:"values,omitempty"`
+	Key    string        `json:"key,omitempty"`
+}
+
+// NewCursor returns the cursor positioned at the item within items sorted
+// by the order.
+func NewCursor(item CollectionItem, o Order) Cursor {
+	return Cursor{Values: orderValues(item.Value, o.Fields()), Key: item.Key}
+}
+
+func (c Cursor) MarshalText() ([]byte, error) {
+	data, err := json.Marshal(cursorFields(c))
+	if err != nil {
+		return nil, err
+	}
+	token := make([]byte, base64.RawURLEncoding.EncodedLen(len(data)))
+	base64.RawURLEncoding.Encode(token, data)
+	return token, nil
+}
+
+func (c *Cursor) UnmarshalText(token []byte) error {
+	data := make([]byte, base64.RawURLEncoding.DecodedLen(len(token)))
+	if _, err := base64.RawURLEncoding.Decode(data, token); err != nil {
+		return fmt.Errorf("invalid cursor: %v", err)
+	}
+	return json.Unmarshal(data, (*cursorFields)(c))
+}
+
+func (c *Cursor) UnmarshalJSON(data []byte) error {
+	var token string
+	if err := json.Unmarshal(data, &token); err == nil {
+		return c.UnmarshalText([]byte(token))
+	}
+	return json.Unmarshal(data, (*cursorFields)(c))
+}
+
+// validate returns an error if the cursor can't be compared to items
+// sorted by the given fields.
+func (c *Cursor) validate(fields []Order) error {
+	if c == nil {
+		return nil
+	}
+	if len(c.Values) > len(fields) {
+		return fmt.Errorf("cursor has %d values for %d order fields", len(c.Values), len(fields))
+	}
+	for _, value := range c.Values {
+		if _, err := NormalizeJSON(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalize returns a copy of the cursor with normalized values.
+func (c *Cursor) normalize() *Cursor {
+	if c == nil {
+		return nil
+	}
+	normalized := &Cursor{Values: make([]interface{}, len(c.Values)), Key: c.Key}
+	for i, value := range c.Values {
+		normalized.Values[i], _ = NormalizeJSON(value)
+	}
+	return normalized
+}
+
+// compare returns -1, 0 or 1 if the item with the given values of the
+// order fields and key sorts before, at or after the cursor.
+func (c *Cursor) compare(fields []Order, values []interface{}, key string) int {
+	for f, field := range fields {
+		if f >= len(c.Values) {
+			return 0
+		}
+		cmp := CompareJSON(values[f], c.Values[f])
+		if !field.Ascending {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp
+		}
+	}
+	if c.Key == "" {
+		return 0
+	}
+	return strings.Compare(key, c.Key)
+}
+
+// orderValues returns the values of the order fields of the JSON document.
+func orderValues(data []byte, fields []Order) []interface{} {
+	values := make([]interface{}, len(fields))
+	if len(fields) == 0 {
+		return values
+	}
+	j, err := gabs.ParseJSON(data)
+	if err != nil {
+		return values
+	}
+	for f, field := range fields {
+		values[f] = j.Path(field.OrderBy).Data()
+	}
+	return values
+}
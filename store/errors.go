@@ -0,0 +1,34 @@
+package store
+
+import "fmt"
+
+// NotFoundError is returned by operations that require an existing document.
+type NotFoundError struct {
+	Key string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("document not found: %s", e.Key)
+}
+
+// IsNotFound reports whether the error is a *NotFoundError.
+func IsNotFound(err error) bool {
+	_, ok := err.(*NotFoundError)
+	return ok
+}
+
+// ConflictError is returned by writes whose preconditions do not hold.
+type ConflictError struct {
+	Key    string
+	Reason string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("conflict writing %s: %s", e.Key, e.Reason)
+}
+
+// IsConflict reports whether the error is a *ConflictError.
+func IsConflict(err error) bool {
+	_, ok := err.(*ConflictError)
+	return ok
+}
@@ -0,0 +1,117 @@
+package store
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// SweepInterval is how often stores look for expired documents.
+var SweepInterval = time.Second
+
+// Sweeper periodically removes the expired documents of a store and calls
+// the functions registered with OnExpire with the key of every document it
+// removed. The sweep function removes the documents that expired at the
+// given time and returns their keys.
+type Sweeper struct {
+	sweep func(now time.Time) ([]string, error)
+
+	mutex sync.Mutex
+	funcs []func(key string)
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func NewSweeper(sweep func(now time.Time) ([]string, error)) *Sweeper {
+	return &Sweeper{sweep: sweep}
+}
+
+// OnExpire registers a function to be called with the key of every expired
+// document that has been removed.
+func (s *Sweeper) OnExpire(f func(key string)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.funcs = append(s.funcs, f)
+}
+
+// Start starts sweeping in the background until Stop is called.
+func (s *Sweeper) Start() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stop != nil {
+		return
+	}
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.run(s.stop, s.done)
+}
+
+// Stop stops sweeping and waits for a running sweep to finish.
+func (s *Sweeper) Stop() {
+	s.mutex.Lock()
+	stop, done := s.stop, s.done
+	s.stop, s.done = nil, nil
+	s.mutex.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+func (s *Sweeper) run(stop, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.Sweep()
+		}
+	}
+}
+
+// Sweep removes the documents that have expired by now.
+func (s *Sweeper) Sweep() {
+	keys, err := s.sweep(time.Now())
+	if err != nil {
+		log.Println("[ERR] store.Sweeper", err)
+	}
+	if len(keys) == 0 {
+		return
+	}
+	s.mutex.Lock()
+	funcs := append([]func(key string){}, s.funcs...)
+	s.mutex.Unlock()
+	for _, key := range keys {
+		for _, f := range funcs {
+			f(key)
+		}
+	}
+}
+
+// ExpiryIndexKey returns the key of the document's entry in an index of
+// expiration times, for key/value backends which have to look up expired
+// documents without scanning all of them. Entries sort by expiration time.
+func ExpiryIndexKey(expireTime time.Time, documentKey string) []byte {
+	buf := make([]byte, 8, 8+len(documentKey))
+	binary.BigEndian.PutUint64(buf, uint64(expireTime.UnixNano()))
+	return append(buf, documentKey...)
+}
+
+// ParseExpiryIndexKey returns the expiration time and document key of an
+// index entry created by ExpiryIndexKey.
+func ParseExpiryIndexKey(indexKey []byte) (time.Time, string, error) {
+	if len(indexKey) < 8 {
+		return time.Time{}, "", fmt.Errorf("invalid expiry index key")
+	}
+	expireTime := time.Unix(0, int64(binary.BigEndian.Uint64(indexKey))).UTC()
+	return expireTime, string(indexKey[8:]), nil
+}
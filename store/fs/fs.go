@@ -0,0 +1,710 @@
+package fs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/imba3r/thunder/store"
+)
+
+const (
+	documentExt  = ".json"
+	metadataExt  = ".meta"
+	sequenceFile = ".sequence"
+)
+
+// Documents are stored as JSON files and collections as directories below
+// the store's root path, e.g. the document "users/1/posts/2" is stored in
+// "<path>/users/1/posts/2.json". Files are written to a temporary file
+// first and renamed into place so readers never see partial writes. The
+// metadata of a document is kept in a hidden file next to it, e.g.
+// "<path>/users/1/posts/.2.meta", so the document files stay plain JSON.
+// The data files are authoritative: metadata files hold the checksum of
+// the data they were written with and are ignored once it doesn't match,
+// e.g. because the document has been edited by hand or a crash happened in
+// between writing the two files.
+type fsStore struct {
+	path string
+	enc  store.Encoding
+
+	// mutex serializes reads and writes, most notably the
+	// read-modify-write cycle of collection sequences, so that readers
+	// never see one file of a document written without the other.
+	mutex sync.Mutex
+
+	sweeper  *store.Sweeper
+	searcher *store.Searcher
+}
+
+type document struct {
+	key   string
+	store *fsStore
+}
+
+type collection struct {
+	key   string
+	store *fsStore
+}
+
+type collectionGroup struct {
+	name  string
+	store *fsStore
+}
+
+var _ store.Store = &fsStore{}
+
+func New(path string) store.Store {
+	fs := &fsStore{path: path}
+	fs.sweeper = store.NewSweeper(fs.sweep)
+	fs.searcher = store.NewSearcher()
+	return fs
+}
+
+func (fs *fsStore) Open(enc store.Encoding) error {
+	if err := os.MkdirAll(fs.path, 0755); err != nil {
+		return err
+	}
+
+	fs.enc = enc
+	fs.sweeper.Start()
+	return nil
+}
+
+func (fs *fsStore) Document(key string) (store.Document, error) {
+	if store.IsDocumentKey(key) && validKey(key) {
+		return &document{key, fs}, nil
+	}
+	return nil, fmt.Errorf("not a document path: %s", key)
+}
+
+func (fs *fsStore) Collection(key string) (store.Collection, error) {
+	if store.IsCollectionKey(key) && validKey(key) {
+		return &collection{key, fs}, nil
+	}
+	return nil, fmt.Errorf("not a collection path: %s", key)
+}
+
+// RunTransaction buffers the writes of the transaction and applies them
+// once it has been committed. While concurrent readers won't see partial
+// writes of single documents, they may observe a transaction being applied
+// and a crash while applying a transaction may leave it half-way applied.
+func (fs *fsStore) RunTransaction(f func(tx store.Tx) error) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	tx := store.NewBufferedTx(fs.get, fs.next)
+	if err := f(tx); err != nil {
+		return err
+	}
+	writes := tx.Writes()
+	for _, w := range writes {
+		if !validKey(w.Key) {
+			return fmt.Errorf("not a document path: %s", w.Key)
+		}
+	}
+	for _, w := range writes {
+		if err := fs.write(w.Key, w.Data, w.Metadata); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CollectionGroup returns the group of the collections with the given name,
+// whose items are read by walking the whole directory tree of the store.
+func (fs *fsStore) CollectionGroup(name string) (store.CollectionGroup, error) {
+	if store.IsCollectionGroupName(name) && validKey(name) {
+		return &collectionGroup{name, fs}, nil
+	}
+	return nil, fmt.Errorf("not a collection group name: %s", name)
+}
+
+func (fs *fsStore) RootCollections() ([]string, error) {
+	return fs.collections("")
+}
+
+// collections returns the keys of the collections directly below the given
+// document key, or at the root if it is empty.
+func (fs *fsStore) collections(parentKey string) ([]string, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	infos, err := ioutil.ReadDir(fs.dir(parentKey))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, info := range infos {
+		if !info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		key := info.Name()
+		if parentKey != "" {
+			key = parentKey + "/" + key
+		}
+		found, err := fs.hasDocuments(key)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// errFound stops walking directories once a document has been found.
+var errFound = errors.New("found")
+
+// hasDocuments reports whether a document lies below the given collection
+// key. Directories are kept when their documents are deleted.
+func (fs *fsStore) hasDocuments(collectionKey string) (bool, error) {
+	err := filepath.Walk(fs.dir(collectionKey), func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		base := filepath.Base(name)
+		if !info.IsDir() && !strings.HasPrefix(base, ".") && strings.HasSuffix(base, documentExt) {
+			return errFound
+		}
+		return nil
+	})
+	if err == errFound {
+		return true, nil
+	}
+	return false, err
+}
+
+func (fs *fsStore) OnExpire(f func(key string)) {
+	fs.sweeper.OnExpire(f)
+}
+
+func (fs *fsStore) EnableSearch(collectionKey string, fields ...string) error {
+	c, err := fs.Collection(collectionKey)
+	if err != nil {
+		return err
+	}
+	return fs.searcher.Enable(collectionKey, fields, c.Items)
+}
+
+func (fs *fsStore) Close() {
+	fs.sweeper.Stop()
+}
+
+// sweep removes all documents that have expired by now. Expiration times
+// are kept in the metadata files only, so all of them are read.
+func (fs *fsStore) sweep(now time.Time) ([]string, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	var keys []string
+	err := filepath.Walk(fs.path, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		base := filepath.Base(name)
+		if info.IsDir() || !strings.HasPrefix(base, ".") || !strings.HasSuffix(base, metadataExt) {
+			return nil
+		}
+		rel, err := filepath.Rel(fs.path, filepath.Dir(name))
+		if err != nil {
+			return err
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(base, "."), metadataExt)
+		key := filepath.ToSlash(rel) + "/" + id
+		_, meta, err := fs.read(key)
+		if store.IsNotFound(err) {
+			// A metadata file left behind by a crash.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if meta.Expired(now) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		if err := fs.write(key, nil, store.Metadata{}); err != nil {
+			return keys[:i], err
+		}
+	}
+	return keys, nil
+}
+
+// validKey reports whether all segments of the key can safely be used
+// as file names below the store's root path.
+func validKey(key string) bool {
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." ||
+			strings.HasPrefix(segment, ".") || strings.ContainsRune(segment, os.PathSeparator) {
+			return false
+		}
+	}
+	return true
+}
+
+func (fs *fsStore) dir(collectionKey string) string {
+	return filepath.Join(fs.path, filepath.FromSlash(collectionKey))
+}
+
+func (fs *fsStore) file(documentKey string) string {
+	return filepath.Join(fs.path, filepath.FromSlash(documentKey)) + documentExt
+}
+
+func (fs *fsStore) metadataFile(documentKey string) string {
+	dir, id := filepath.Split(filepath.Join(fs.path, filepath.FromSlash(documentKey)))
+	return filepath.Join(dir, "."+id+metadataExt)
+}
+
+// next returns the next value of the collection's sequence, which is
+// stored in a file of the collection's directory. Like badger sequences,
+// the first value handed out is zero. The caller must hold the mutex.
+func (fs *fsStore) next(collectionKey string) (uint64, error) {
+	if !validKey(collectionKey) {
+		return 0, fmt.Errorf("not a collection path: %s", collectionKey)
+	}
+	var num uint64
+	sequence := filepath.Join(fs.dir(collectionKey), sequenceFile)
+	content, err := ioutil.ReadFile(sequence)
+	if err == nil {
+		num, err = strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid sequence file %s: %v", sequence, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+	return num, writeFile(sequence, []byte(strconv.FormatUint(num+1, 10)))
+}
+
+// fileMetadata is the content of a metadata file.
+type fileMetadata struct {
+	store.Metadata
+	// Checksum is the hex encoded SHA-256 checksum of the document's data.
+	Checksum string `json:"checksum"`
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// get returns the document's data and metadata unless it has expired. The
+// caller must hold the mutex.
+func (fs *fsStore) get(documentKey string) ([]byte, store.Metadata, error) {
+	data, meta, err := fs.read(documentKey)
+	if err == nil && meta.Expired(time.Now()) {
+		return nil, store.Metadata{}, &store.NotFoundError{Key: documentKey}
+	}
+	return data, meta, err
+}
+
+// read returns the document's data and metadata. Documents without a
+// metadata file, e.g. fixtures created by hand, and documents whose data
+// doesn't match the checksum of their metadata file, e.g. fixtures edited
+// by hand, have empty metadata. The caller must hold the mutex.
+func (fs *fsStore) read(documentKey string) ([]byte, store.Metadata, error) {
+	var meta store.Metadata
+	if !validKey(documentKey) {
+		return nil, meta, fmt.Errorf("not a document path: %s", documentKey)
+	}
+	data, err := ioutil.ReadFile(fs.file(documentKey))
+	if os.IsNotExist(err) {
+		return nil, meta, &store.NotFoundError{Key: documentKey}
+	}
+	if err != nil {
+		return nil, meta, err
+	}
+	content, err := ioutil.ReadFile(fs.metadataFile(documentKey))
+	if os.IsNotExist(err) {
+		return data, meta, nil
+	}
+	var fileMeta fileMetadata
+	if err == nil {
+		err = json.Unmarshal(content, &fileMeta)
+	}
+	if err != nil {
+		return nil, meta, err
+	}
+	if fileMeta.Checksum != checksum(data) {
+		return data, meta, nil
+	}
+	return data, fileMeta.Metadata, nil
+}
+
+// write replaces the document's files with the given data and metadata or
+// removes them if data is nil, and updates the search index. The caller
+// must hold the mutex.
+func (fs *fsStore) write(documentKey string, data []byte, meta store.Metadata) error {
+	if data != nil {
+		content, err := json.Marshal(fileMetadata{meta, checksum(data)})
+		if err != nil {
+			return err
+		}
+		if err := writeFile(fs.file(documentKey), data); err != nil {
+			return err
+		}
+		if err := writeFile(fs.metadataFile(documentKey), content); err != nil {
+			return err
+		}
+		fs.searcher.Update(documentKey, data)
+		return nil
+	}
+	for _, name := range []string{fs.file(documentKey), fs.metadataFile(documentKey)} {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	fs.searcher.Remove(documentKey)
+	return nil
+}
+
+// deleteDir deletes the documents in the directory of the given key and,
+// if recursive, in its subdirectories. It returns the keys of the deleted
+// documents in order. Directories and sequences are kept so that keys of
+// deleted documents aren't handed out again. The caller must hold the
+// mutex.
+func (fs *fsStore) deleteDir(key string, recursive bool) ([]string, error) {
+	root := fs.dir(key)
+	var keys []string
+	err := filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			if name != root && !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		base := filepath.Base(name)
+		if strings.HasPrefix(base, ".") || !strings.HasSuffix(base, documentExt) {
+			return nil
+		}
+		rel, err := filepath.Rel(fs.path, name)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, strings.TrimSuffix(filepath.ToSlash(rel), documentExt))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		if err := fs.write(key, nil, store.Metadata{}); err != nil {
+			return keys[:i], err
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// writeFile atomically replaces the contents of the given file.
+func writeFile(name string, data []byte) error {
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+func (d *document) Key() string {
+	return d.key
+}
+
+func (d *document) Get(fields ...string) ([]byte, error) {
+	data, _, err := d.GetWithMetadata()
+	if err != nil {
+		return nil, err
+	}
+	return store.ProjectJSON(data, fields), nil
+}
+
+func (d *document) GetWithMetadata() ([]byte, store.Metadata, error) {
+	d.store.mutex.Lock()
+	defer d.store.mutex.Unlock()
+
+	return d.store.get(d.key)
+}
+
+func (d *document) Set(data []byte, preconditions ...store.Precondition) error {
+	return d.store.RunTransaction(func(tx store.Tx) error {
+		return tx.Set(d.key, data, preconditions...)
+	})
+}
+
+func (d *document) SetWithTTL(data []byte, ttl time.Duration, preconditions ...store.Precondition) error {
+	return d.store.RunTransaction(func(tx store.Tx) error {
+		return tx.SetWithTTL(d.key, data, ttl, preconditions...)
+	})
+}
+
+func (d *document) Update(data []byte, preconditions ...store.Precondition) error {
+	return d.store.RunTransaction(func(tx store.Tx) error {
+		return tx.Update(d.key, data, preconditions...)
+	})
+}
+
+func (d *document) Delete(preconditions ...store.Precondition) error {
+	return d.store.RunTransaction(func(tx store.Tx) error {
+		return tx.Delete(d.key, preconditions...)
+	})
+}
+
+func (d *document) DeleteRecursive(preconditions ...store.Precondition) ([]string, error) {
+	d.store.mutex.Lock()
+	defer d.store.mutex.Unlock()
+
+	var current *store.Metadata
+	_, meta, err := d.store.get(d.key)
+	if err == nil {
+		current = &meta
+	} else if !store.IsNotFound(err) {
+		return nil, err
+	}
+	if err := store.CheckPreconditions(d.key, current, preconditions); err != nil {
+		return nil, err
+	}
+	if err := d.store.write(d.key, nil, store.Metadata{}); err != nil {
+		return nil, err
+	}
+	var keys []string
+	if current != nil {
+		keys = append(keys, d.key)
+	}
+	// The subcollections of the document live in a directory of its name.
+	deleted, err := d.store.deleteDir(d.key, true)
+	return append(keys, deleted...), err
+}
+
+func (d *document) Collections() ([]string, error) {
+	return d.store.collections(d.key)
+}
+
+func (c *collection) Key() string {
+	return c.key
+}
+
+func (c *collection) Add(data []byte) (store.Document, error) {
+	return c.AddWithTTL(data, 0)
+}
+
+func (c *collection) AddWithTTL(data []byte, ttl time.Duration) (store.Document, error) {
+	var key string
+	err := c.store.RunTransaction(func(tx store.Tx) error {
+		var err error
+		key, err = tx.AddWithTTL(c.key, data, ttl)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.store.Document(key)
+}
+
+func (c *collection) Delete(recursive bool) ([]string, error) {
+	c.store.mutex.Lock()
+	defer c.store.mutex.Unlock()
+
+	return c.store.deleteDir(c.key, recursive)
+}
+
+func (c *collection) Items(q store.Query, o store.Order, l store.Limit, fields ...string) ([]store.CollectionItem, error) {
+	items, _, err := c.items(q, o, l)
+	if err != nil {
+		return nil, err
+	}
+	return store.ProjectItems(items, fields), nil
+}
+
+func (c *collection) Explain(q store.Query, o store.Order, l store.Limit) (store.Explanation, error) {
+	_, explanation, err := c.items(q, o, l)
+	return explanation, err
+}
+
+func (c *collection) Aggregate(q store.Query, groupBy []string, aggregations []store.Aggregation) ([]store.AggregateGroup, error) {
+	return store.Aggregate(c.Items, q, groupBy, aggregations)
+}
+
+func (c *collection) Search(text string, limit int) ([]store.SearchResult, error) {
+	return c.store.searcher.Search(c.key, text, limit, func(key string) ([]byte, error) {
+		return (&document{key, c.store}).Get()
+	})
+}
+
+func (c *collection) items(q store.Query, o store.Order, l store.Limit) ([]store.CollectionItem, store.Explanation, error) {
+	if err := q.Validate(); err != nil {
+		return nil, store.Explanation{}, err
+	}
+	if err := l.Validate(o); err != nil {
+		return nil, store.Explanation{}, err
+	}
+	queryItems := !q.IsEmpty()
+	orderItems := !o.IsEmpty()
+
+	c.store.mutex.Lock()
+	defer c.store.mutex.Unlock()
+
+	explanation := store.Explanation{Scan: store.FullScan}
+	infos, err := ioutil.ReadDir(c.store.dir(c.key))
+	if os.IsNotExist(err) {
+		return nil, explanation, nil
+	}
+	if err != nil {
+		return nil, store.Explanation{}, err
+	}
+
+	// Directories hold subcollections, dot files are internal.
+	var ids []string
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, documentExt) {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(name, documentExt))
+	}
+	// Iterate in key order, the same order badger iterates them in.
+	sort.Strings(ids)
+
+	var items []store.CollectionItem
+	for _, id := range ids {
+		key := c.key + "/" + id
+		value, _, err := c.store.get(key)
+		if store.IsNotFound(err) {
+			// Expired.
+			continue
+		}
+		if err != nil {
+			return nil, store.Explanation{}, err
+		}
+		explanation.Examined++
+		if queryItems && !store.MatchesJSON(value, q) {
+			continue
+		}
+		items = append(items, store.CollectionItem{Key: key, Value: value})
+	}
+	if orderItems {
+		store.OrderJSON(items, o)
+	}
+	items = store.LimitItems(items, o, l)
+	explanation.Returned = len(items)
+	return items, explanation, nil
+}
+
+func (g *collectionGroup) Name() string {
+	return g.name
+}
+
+func (g *collectionGroup) Items(q store.Query, o store.Order, l store.Limit, fields ...string) ([]store.CollectionItem, error) {
+	items, _, err := g.items(q, o, l)
+	if err != nil {
+		return nil, err
+	}
+	return store.ProjectItems(items, fields), nil
+}
+
+func (g *collectionGroup) Explain(q store.Query, o store.Order, l store.Limit) (store.Explanation, error) {
+	_, explanation, err := g.items(q, o, l)
+	return explanation, err
+}
+
+func (g *collectionGroup) Aggregate(q store.Query, groupBy []string, aggregations []store.Aggregation) ([]store.AggregateGroup, error) {
+	return store.Aggregate(g.Items, q, groupBy, aggregations)
+}
+
+// items walks all directories of the store for the documents of the group.
+func (g *collectionGroup) items(q store.Query, o store.Order, l store.Limit) ([]store.CollectionItem, store.Explanation, error) {
+	if err := q.Validate(); err != nil {
+		return nil, store.Explanation{}, err
+	}
+	if err := l.Validate(o); err != nil {
+		return nil, store.Explanation{}, err
+	}
+	g.store.mutex.Lock()
+	defer g.store.mutex.Unlock()
+
+	var items []store.CollectionItem
+	err := filepath.Walk(g.store.path, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		base := filepath.Base(name)
+		if info.IsDir() && name != g.store.path && strings.HasPrefix(base, ".") {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || strings.HasPrefix(base, ".") || !strings.HasSuffix(base, documentExt) {
+			return nil
+		}
+		rel, err := filepath.Rel(g.store.path, strings.TrimSuffix(name, documentExt))
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !validKey(key) || !store.InCollectionGroup(key, g.name) {
+			return nil
+		}
+		value, _, err := g.store.get(key)
+		if store.IsNotFound(err) {
+			// Expired.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		items = append(items, store.CollectionItem{Key: key, Value: value})
+		return nil
+	})
+	if err != nil {
+		return nil, store.Explanation{}, err
+	}
+	items, explanation := store.GroupItems(items, q, o, l)
+	return items, explanation, nil
+}
@@ -0,0 +1,88 @@
+package fs_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/imba3r/thunder/store"
+	"github.com/imba3r/thunder/store/fs"
+	"github.com/imba3r/thunder/store/storetest"
+)
+
+func TestConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thunder-fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	n := 0
+	storetest.RunConformance(t, func() store.Store {
+		n++
+		return fs.New(filepath.Join(dir, fmt.Sprint(n)))
+	})
+}
+
+func TestHandEditedDocument(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thunder-fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := fs.New(dir)
+	if err := s.Open(store.Json); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	doc, err := s.Document("users/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := doc.SetWithTTL([]byte(`{"name":"old"}`), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// Editing the document leaves its metadata file stale.
+	edited := []byte(`{"name":"edited"}`)
+	if err := ioutil.WriteFile(filepath.Join(dir, "users", "1.json"), edited, 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, meta, err := doc.GetWithMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(edited) {
+		t.Errorf("expected %s, got %s", edited, data)
+	}
+	if meta != (store.Metadata{}) {
+		t.Errorf("expected the stale metadata to be ignored, got %+v", meta)
+	}
+
+	c, err := s.Collection("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := c.Items(store.Query{}, store.Order{}, store.Limit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Key != "users/1" || string(items[0].Value) != string(edited) {
+		t.Errorf("expected the edited users/1, got %v", items)
+	}
+
+	// Writing the document again replaces the stale metadata.
+	if err := doc.Set([]byte(`{"name":"new"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, meta, err = doc.GetWithMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	if meta.Version != 1 || !meta.ExpireTime.IsZero() {
+		t.Errorf("expected version 1 without expiry, got %+v", meta)
+	}
+}
@@ -0,0 +1,29 @@
+package store
+
+import "sort"
+
+// GroupItems applies the query, order and limit to the documents of a
+// collection group, which stores may read in any order, and explains the
+// full scan that read them.
+func GroupItems(items []CollectionItem, q Query, o Order, l Limit) ([]CollectionItem, Explanation) {
+	explanation := Explanation{Scan: FullScan, Examined: len(items)}
+	if !q.IsEmpty() {
+		var matching []CollectionItem
+		for _, item := range items {
+			if MatchesJSON(item.Value, q) {
+				matching = append(matching, item)
+			}
+		}
+		items = matching
+	}
+	if o.IsEmpty() {
+		sort.Slice(items, func(i, j int) bool {
+			return items[i].Key < items[j].Key
+		})
+	} else {
+		OrderJSON(items, o)
+	}
+	items = LimitItems(items, o, l)
+	explanation.Returned = len(items)
+	return items, explanation
+}
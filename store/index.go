@@ -0,0 +1,149 @@
+package store
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+)
+
+// Index declares an index on one or more fields of the documents of a
+// collection. Stores that support indexes use them to serve queries
+// comparing the fields and orders by the fields without reading the whole
+// collection, see PlanQuery.
+type Index struct {
+	Collection string   `json:"collection"`
+	Fields     []string `json:"fields"`
+}
+
+// ID returns an encoding of the collection and fields of the index that is
+// never a prefix of the ID of another index. They are encoded as an array,
+// whose terminator tells e.g. the index of a from the index of a and b.
+func (i Index) ID() []byte {
+	values := []interface{}{i.Collection}
+	for _, field := range i.Fields {
+		values = append(values, field)
+	}
+	return appendIndexValue(nil, values)
+}
+
+// Encode returns the encoded values of the indexed fields of the JSON
+// document, see EncodeIndexValue. Missing fields and documents that can't
+// be parsed are indexed like null.
+func (i Index) Encode(data []byte) []byte {
+	var fields []Order
+	for _, field := range i.Fields {
+		fields = append(fields, Order{OrderBy: field})
+	}
+	var encoded []byte
+	for _, value := range orderValues(data, fields) {
+		encoded = appendIndexValue(encoded, value)
+	}
+	return encoded
+}
+
+// EncodeIndexValue encodes a decoded JSON value such that the encodings of
+// two values compare bytewise like CompareJSON compares the values. The
+// encoding of a value is never a prefix of the encoding of another value,
+// so encodings may be followed by other data, e.g. document keys.
+func EncodeIndexValue(v interface{}) []byte {
+	return appendIndexValue(nil, v)
+}
+
+// Encodings start with the type rank of the value plus one, which leaves
+// zero to terminate arrays and objects.
+func appendIndexValue(b []byte, v interface{}) []byte {
+	b = append(b, byte(typeRank(v)+1))
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return append(b, 1)
+		}
+		return append(b, 0)
+	case float64:
+		// Flip the sign bit of positive numbers and all bits of negative
+		// ones, so that their IEEE 754 representations sort naturally.
+		if v == 0 {
+			v = 0 // Negative zero equals zero.
+		}
+		bits := math.Float64bits(v)
+		if v < 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+		var n [8]byte
+		binary.BigEndian.PutUint64(n[:], bits)
+		return append(b, n[:]...)
+	case string:
+		return appendIndexString(b, v)
+	case []interface{}:
+		for _, element := range v {
+			b = appendIndexValue(b, element)
+		}
+		return append(b, 0)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			b = appendIndexValue(b, key)
+			b = appendIndexValue(b, v[key])
+		}
+		return append(b, 0)
+	}
+	return b
+}
+
+// appendIndexString escapes zero bytes as 0x00 0xff and terminates the
+// string with 0x00 0x01, which sorts before any escaped zero byte.
+func appendIndexString(b []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		if s[i] == 0 {
+			b = append(b, 0, 0xff)
+		} else {
+			b = append(b, s[i])
+		}
+	}
+	return append(b, 0, 1)
+}
+
+// IndexValuesPrefix returns the encodings of the first n values of the
+// concatenated encodings.
+func IndexValuesPrefix(encoded []byte, n int) []byte {
+	length := 0
+	for i := 0; i < n && length < len(encoded); i++ {
+		length += indexValueLength(encoded[length:])
+	}
+	return encoded[:length]
+}
+
+// indexValueLength returns the length of the encoding the data starts with.
+func indexValueLength(b []byte) int {
+	switch b[0] - 1 {
+	case 0:
+		return 1
+	case 1:
+		return 2
+	case 2:
+		return 9
+	case 3:
+		for i := 1; i+1 < len(b); i++ {
+			if b[i] == 0 {
+				if b[i+1] == 1 {
+					return i + 2
+				}
+				i++
+			}
+		}
+	case 4, 5:
+		// Arrays hold values, objects keys and values, up to a zero.
+		length := 1
+		for length < len(b) && b[length] != 0 {
+			length += indexValueLength(b[length:])
+		}
+		return length + 1
+	}
+	return len(b)
+}
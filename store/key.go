@@ -22,3 +22,43 @@ func CollectionKey(documentKey string) string {
 	}
 	return strings.TrimSuffix(documentKey, fmt.Sprintf("/%s", split[len(split)-1]))
 }
+
+// IsDescendantKey reports whether the key lies below the given document or
+// collection key, e.g. "users/1/posts/2" lies below "users" and "users/1".
+func IsDescendantKey(key string, parentKey string) bool {
+	return strings.HasPrefix(key, parentKey+"/")
+}
+
+// ChildCollectionKey returns the key of the collection directly below the
+// given document key, or at the root if it is empty, that holds the
+// document with the given key, e.g. "users/1/posts" for the document
+// "users/1/posts/2/comments/3" below "users/1".
+func ChildCollectionKey(documentKey string, parentKey string) string {
+	prefix := ""
+	if parentKey != "" {
+		prefix = parentKey + "/"
+	}
+	rest := strings.TrimPrefix(documentKey, prefix)
+	if i := strings.Index(rest, "/"); i >= 0 {
+		rest = rest[:i]
+	}
+	return prefix + rest
+}
+
+// CollectionName returns the last segment of the given collection key, e.g.
+// "comments" for "users/1/posts/2/comments".
+func CollectionName(collectionKey string) string {
+	return collectionKey[strings.LastIndex(collectionKey, "/")+1:]
+}
+
+// IsCollectionGroupName reports whether the name may name a collection
+// group, i.e. whether it is a single key segment.
+func IsCollectionGroupName(name string) bool {
+	return name != "" && !strings.Contains(name, "/")
+}
+
+// InCollectionGroup reports whether the key is the key of a document of a
+// collection with the given name.
+func InCollectionGroup(key string, name string) bool {
+	return IsDocumentKey(key) && CollectionName(CollectionKey(key)) == name
+}
@@ -1,6 +1,104 @@
 package store
 
+import "sort"
+
+// Limit restricts the items of a collection to those between the start and
+// end cursors, of which it skips the first Offset items and returns at most
+// Limit items. StartAt and EndAt include the items at the cursor while
+// StartAfter and EndBefore exclude them; at most one start and one end
+// cursor should be set.
 type Limit struct {
 	Limit  int `json:"limit"`
 	Offset int `json:"offset"`
+
+	StartAt    *Cursor `json:"startAt,omitempty"`
+	StartAfter *Cursor `json:"startAfter,omitempty"`
+	EndAt      *Cursor `json:"endAt,omitempty"`
+	EndBefore  *Cursor `json:"endBefore,omitempty"`
+}
+
+// Validate returns an error if the cursors of the limit can't be used with
+// items sorted by the given order.
+func (l Limit) Validate(o Order) error {
+	fields := o.Fields()
+	for _, c := range []*Cursor{l.StartAt, l.StartAfter, l.EndAt, l.EndBefore} {
+		if err := c.validate(fields); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartKey returns the key of the start cursor, if any. Stores iterating
+// the items of a collection in key order may seek to it, provided that the
+// items aren't ordered by fields.
+func (l Limit) StartKey() string {
+	if l.StartAt != nil {
+		return l.StartAt.Key
+	}
+	if l.StartAfter != nil {
+		return l.StartAfter.Key
+	}
+	return ""
+}
+
+// Position returns -1 if the item lies before the start cursor of the
+// limit, 1 if it lies after the end cursor and 0 otherwise, given that the
+// items are sorted by the order.
+func (l Limit) Position(item CollectionItem, o Order) int {
+	fields := o.Fields()
+	return l.normalize().position(fields, orderValues(item.Value, fields), item.Key)
+}
+
+// normalize returns a copy of the limit with normalized cursors.
+func (l Limit) normalize() Limit {
+	l.StartAt, l.StartAfter = l.StartAt.normalize(), l.StartAfter.normalize()
+	l.EndAt, l.EndBefore = l.EndAt.normalize(), l.EndBefore.normalize()
+	return l
+}
+
+func (l Limit) position(fields []Order, values []interface{}, key string) int {
+	if l.StartAt != nil && l.StartAt.compare(fields, values, key) < 0 {
+		return -1
+	}
+	if l.StartAfter != nil && l.StartAfter.compare(fields, values, key) <= 0 {
+		return -1
+	}
+	if l.EndAt != nil && l.EndAt.compare(fields, values, key) > 0 {
+		return 1
+	}
+	if l.EndBefore != nil && l.EndBefore.compare(fields, values, key) >= 0 {
+		return 1
+	}
+	return 0
+}
+
+// LimitItems applies the limit to items sorted by the order. It drops the
+// items outside of the cursors, then skips the first Offset items and caps
+// the result at Limit items. A Limit of zero (or less) leaves the number of
+// items uncapped.
+func LimitItems(items []CollectionItem, o Order, l Limit) []CollectionItem {
+	if l.StartAt != nil || l.StartAfter != nil || l.EndAt != nil || l.EndBefore != nil {
+		fields := o.Fields()
+		l = l.normalize()
+		position := func(i int) int {
+			return l.position(fields, orderValues(items[i].Value, fields), items[i].Key)
+		}
+		start := sort.Search(len(items), func(i int) bool { return position(i) >= 0 })
+		end := sort.Search(len(items), func(i int) bool { return position(i) > 0 })
+		if end < start {
+			end = start
+		}
+		items = items[start:end]
+	}
+	if l.Offset > 0 {
+		if l.Offset >= len(items) {
+			return items[:0]
+		}
+		items = items[l.Offset:]
+	}
+	if l.Limit > 0 && len(items) > l.Limit {
+		items = items[:l.Limit]
+	}
+	return items
 }
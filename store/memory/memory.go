@@ -0,0 +1,415 @@
+package memory
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/imba3r/thunder/store"
+)
+
+type memoryStore struct {
+	enc store.Encoding
+
+	mutex     sync.RWMutex
+	data      map[string]record
+	sequences map[string]uint64
+
+	sweeper  *store.Sweeper
+	searcher *store.Searcher
+}
+
+type record struct {
+	data []byte
+	meta store.Metadata
+}
+
+type document struct {
+	key   string
+	store *memoryStore
+}
+
+type collection struct {
+	key   string
+	store *memoryStore
+}
+
+type collectionGroup struct {
+	name  string
+	store *memoryStore
+}
+
+var _ store.Store = &memoryStore{}
+
+// New returns a store that keeps all documents in memory. Its contents are
+// lost once the process exits, which makes it a good fit for tests and
+// ephemeral deployments.
+func New() store.Store {
+	ms := &memoryStore{
+		data:      make(map[string]record),
+		sequences: make(map[string]uint64),
+	}
+	ms.sweeper = store.NewSweeper(ms.sweep)
+	ms.searcher = store.NewSearcher()
+	return ms
+}
+
+func (ms *memoryStore) Open(enc store.Encoding) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	ms.enc = enc
+	ms.sweeper.Start()
+	return nil
+}
+
+func (ms *memoryStore) Document(key string) (store.Document, error) {
+	if store.IsDocumentKey(key) {
+		return &document{key, ms}, nil
+	}
+	return nil, fmt.Errorf("not a document path: %s", key)
+}
+
+func (ms *memoryStore) Collection(key string) (store.Collection, error) {
+	if store.IsCollectionKey(key) {
+		return &collection{key, ms}, nil
+	}
+	return nil, fmt.Errorf("not a collection path: %s", key)
+}
+
+func (ms *memoryStore) CollectionGroup(name string) (store.CollectionGroup, error) {
+	if store.IsCollectionGroupName(name) {
+		return &collectionGroup{name, ms}, nil
+	}
+	return nil, fmt.Errorf("not a collection group name: %s", name)
+}
+
+func (ms *memoryStore) RunTransaction(f func(tx store.Tx) error) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	tx := store.NewBufferedTx(ms.get, ms.next)
+	if err := f(tx); err != nil {
+		return err
+	}
+	for _, w := range tx.Writes() {
+		if w.Data == nil {
+			delete(ms.data, w.Key)
+		} else {
+			ms.data[w.Key] = record{w.Data, w.Metadata}
+		}
+		ms.searcher.Update(w.Key, w.Data)
+	}
+	return nil
+}
+
+func (ms *memoryStore) RootCollections() ([]string, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	return ms.collections(""), nil
+}
+
+func (ms *memoryStore) OnExpire(f func(key string)) {
+	ms.sweeper.OnExpire(f)
+}
+
+func (ms *memoryStore) EnableSearch(collectionKey string, fields ...string) error {
+	c, err := ms.Collection(collectionKey)
+	if err != nil {
+		return err
+	}
+	return ms.searcher.Enable(collectionKey, fields, c.Items)
+}
+
+func (ms *memoryStore) Close() {
+	ms.sweeper.Stop()
+}
+
+// sweep removes all documents that have expired by now.
+func (ms *memoryStore) sweep(now time.Time) ([]string, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	return ms.delete(func(key string) bool {
+		return ms.data[key].meta.Expired(now)
+	}), nil
+}
+
+// delete removes the documents whose keys match and returns their keys in
+// order. The caller must hold the mutex.
+func (ms *memoryStore) delete(match func(key string) bool) []string {
+	var keys []string
+	for key := range ms.data {
+		if match(key) {
+			delete(ms.data, key)
+			ms.searcher.Remove(key)
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// collections returns the keys of the collections directly below the given
+// document key, or at the root if it is empty. The caller must hold the
+// mutex.
+func (ms *memoryStore) collections(parentKey string) []string {
+	now := time.Now()
+	exists := make(map[string]bool)
+	var keys []string
+	for key, r := range ms.data {
+		if r.meta.Expired(now) || (parentKey != "" && !store.IsDescendantKey(key, parentKey)) {
+			continue
+		}
+		collectionKey := store.ChildCollectionKey(key, parentKey)
+		if !exists[collectionKey] {
+			exists[collectionKey] = true
+			keys = append(keys, collectionKey)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// get returns a copy of the value stored under the given key. The caller
+// must hold the mutex.
+func (ms *memoryStore) get(key string) ([]byte, store.Metadata, error) {
+	r, exists := ms.data[key]
+	if !exists || r.meta.Expired(time.Now()) {
+		return nil, store.Metadata{}, &store.NotFoundError{Key: key}
+	}
+	return copyBytes(r.data), r.meta, nil
+}
+
+// next returns the next value of the sequence stored under the given key.
+// Like badger sequences, the first value handed out is zero. The caller
+// must hold the mutex.
+func (ms *memoryStore) next(key string) (uint64, error) {
+	num := ms.sequences[key]
+	ms.sequences[key] = num + 1
+	return num, nil
+}
+
+func (d *document) Key() string {
+	return d.key
+}
+
+func (d *document) Get(fields ...string) ([]byte, error) {
+	data, _, err := d.GetWithMetadata()
+	if err != nil {
+		return nil, err
+	}
+	return store.ProjectJSON(data, fields), nil
+}
+
+func (d *document) GetWithMetadata() ([]byte, store.Metadata, error) {
+	d.store.mutex.RLock()
+	defer d.store.mutex.RUnlock()
+
+	return d.store.get(d.key)
+}
+
+func (d *document) Set(data []byte, preconditions ...store.Precondition) error {
+	return d.store.RunTransaction(func(tx store.Tx) error {
+		return tx.Set(d.key, data, preconditions...)
+	})
+}
+
+func (d *document) SetWithTTL(data []byte, ttl time.Duration, preconditions ...store.Precondition) error {
+	return d.store.RunTransaction(func(tx store.Tx) error {
+		return tx.SetWithTTL(d.key, data, ttl, preconditions...)
+	})
+}
+
+func (d *document) Update(data []byte, preconditions ...store.Precondition) error {
+	return d.store.RunTransaction(func(tx store.Tx) error {
+		return tx.Update(d.key, data, preconditions...)
+	})
+}
+
+func (d *document) Delete(preconditions ...store.Precondition) error {
+	return d.store.RunTransaction(func(tx store.Tx) error {
+		return tx.Delete(d.key, preconditions...)
+	})
+}
+
+func (d *document) DeleteRecursive(preconditions ...store.Precondition) ([]string, error) {
+	d.store.mutex.Lock()
+	defer d.store.mutex.Unlock()
+
+	var current *store.Metadata
+	if _, meta, err := d.store.get(d.key); err == nil {
+		current = &meta
+	}
+	if err := store.CheckPreconditions(d.key, current, preconditions); err != nil {
+		return nil, err
+	}
+	return d.store.delete(func(key string) bool {
+		return key == d.key || store.IsDescendantKey(key, d.key)
+	}), nil
+}
+
+func (d *document) Collections() ([]string, error) {
+	d.store.mutex.RLock()
+	defer d.store.mutex.RUnlock()
+
+	return d.store.collections(d.key), nil
+}
+
+func (c *collection) Key() string {
+	return c.key
+}
+
+func (c *collection) Add(data []byte) (store.Document, error) {
+	return c.AddWithTTL(data, 0)
+}
+
+func (c *collection) AddWithTTL(data []byte, ttl time.Duration) (store.Document, error) {
+	var key string
+	err := c.store.RunTransaction(func(tx store.Tx) error {
+		var err error
+		key, err = tx.AddWithTTL(c.key, data, ttl)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.store.Document(key)
+}
+
+func (c *collection) Delete(recursive bool) ([]string, error) {
+	c.store.mutex.Lock()
+	defer c.store.mutex.Unlock()
+
+	return c.store.delete(func(key string) bool {
+		if recursive {
+			return store.IsDescendantKey(key, c.key)
+		}
+		return store.CollectionKey(key) == c.key
+	}), nil
+}
+
+func (c *collection) Items(q store.Query, o store.Order, l store.Limit, fields ...string) ([]store.CollectionItem, error) {
+	items, _, err := c.items(q, o, l)
+	if err != nil {
+		return nil, err
+	}
+	return store.ProjectItems(items, fields), nil
+}
+
+func (c *collection) Explain(q store.Query, o store.Order, l store.Limit) (store.Explanation, error) {
+	_, explanation, err := c.items(q, o, l)
+	return explanation, err
+}
+
+func (c *collection) Aggregate(q store.Query, groupBy []string, aggregations []store.Aggregation) ([]store.AggregateGroup, error) {
+	return store.Aggregate(c.Items, q, groupBy, aggregations)
+}
+
+func (c *collection) Search(text string, limit int) ([]store.SearchResult, error) {
+	return c.store.searcher.Search(c.key, text, limit, func(key string) ([]byte, error) {
+		return (&document{key, c.store}).Get()
+	})
+}
+
+func (c *collection) items(q store.Query, o store.Order, l store.Limit) ([]store.CollectionItem, store.Explanation, error) {
+	if err := q.Validate(); err != nil {
+		return nil, store.Explanation{}, err
+	}
+	if err := l.Validate(o); err != nil {
+		return nil, store.Explanation{}, err
+	}
+	queryItems := !q.IsEmpty()
+	orderItems := !o.IsEmpty()
+
+	c.store.mutex.RLock()
+	defer c.store.mutex.RUnlock()
+
+	// Collect the keys of all direct children of the collection in
+	// lexicographic order, the same order badger iterates them in.
+	prefix := c.key + "/"
+	var keys []string
+	for key := range c.store.data {
+		if strings.HasPrefix(key, prefix) && !strings.Contains(key[len(prefix):], "/") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	now := time.Now()
+	explanation := store.Explanation{Scan: store.FullScan}
+	var items []store.CollectionItem
+	for _, key := range keys {
+		r := c.store.data[key]
+		if r.meta.Expired(now) {
+			continue
+		}
+		explanation.Examined++
+		value := r.data
+		if queryItems && !store.MatchesJSON(value, q) {
+			continue
+		}
+		items = append(items, store.CollectionItem{Key: key, Value: copyBytes(value)})
+	}
+	if orderItems {
+		store.OrderJSON(items, o)
+	}
+	items = store.LimitItems(items, o, l)
+	explanation.Returned = len(items)
+	return items, explanation, nil
+}
+
+func (g *collectionGroup) Name() string {
+	return g.name
+}
+
+func (g *collectionGroup) Items(q store.Query, o store.Order, l store.Limit, fields ...string) ([]store.CollectionItem, error) {
+	items, _, err := g.items(q, o, l)
+	if err != nil {
+		return nil, err
+	}
+	return store.ProjectItems(items, fields), nil
+}
+
+func (g *collectionGroup) Explain(q store.Query, o store.Order, l store.Limit) (store.Explanation, error) {
+	_, explanation, err := g.items(q, o, l)
+	return explanation, err
+}
+
+func (g *collectionGroup) Aggregate(q store.Query, groupBy []string, aggregations []store.Aggregation) ([]store.AggregateGroup, error) {
+	return store.Aggregate(g.Items, q, groupBy, aggregations)
+}
+
+func (g *collectionGroup) items(q store.Query, o store.Order, l store.Limit) ([]store.CollectionItem, store.Explanation, error) {
+	if err := q.Validate(); err != nil {
+		return nil, store.Explanation{}, err
+	}
+	if err := l.Validate(o); err != nil {
+		return nil, store.Explanation{}, err
+	}
+
+	g.store.mutex.RLock()
+	defer g.store.mutex.RUnlock()
+
+	now := time.Now()
+	var items []store.CollectionItem
+	for key, r := range g.store.data {
+		if store.InCollectionGroup(key, g.name) && !r.meta.Expired(now) {
+			items = append(items, store.CollectionItem{Key: key, Value: copyBytes(r.data)})
+		}
+	}
+	items, explanation := store.GroupItems(items, q, o, l)
+	return items, explanation, nil
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
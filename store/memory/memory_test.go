@@ -0,0 +1,15 @@
+package memory_test
+
+import (
+	"testing"
+
+	"github.com/imba3r/thunder/store"
+	"github.com/imba3r/thunder/store/memory"
+	"github.com/imba3r/thunder/store/storetest"
+)
+
+func TestConformance(t *testing.T) {
+	storetest.RunConformance(t, func() store.Store {
+		return memory.New()
+	})
+}
@@ -0,0 +1,77 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// MergeJSON applies the JSON merge patch (RFC 7386) to the target document
+// and returns the result. In addition to the RFC, keys of the patch that
+// contain dots are treated as field paths, i.e. {"a.b": 1} is merged like
+// {"a": {"b": 1}} without replacing the other fields of "a".
+func MergeJSON(target []byte, patch []byte) ([]byte, error) {
+	var p interface{}
+	if err := unmarshalJSON(patch, &p); err != nil {
+		return nil, err
+	}
+	var t interface{}
+	if len(bytes.TrimSpace(target)) > 0 {
+		if err := unmarshalJSON(target, &t); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(mergePatch(t, p))
+}
+
+// unmarshalJSON decodes numbers as json.Number so that they survive a
+// merge without losing precision.
+func unmarshalJSON(data []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	// Apply keys in order so that {"a": {...}, "a.b": 1} merges "a"
+	// before "a.b" regardless of map iteration order.
+	keys := make([]string, 0, len(p))
+	for key := range p {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		mergePath(t, strings.Split(key, "."), p[key])
+	}
+	return t
+}
+
+func mergePath(target map[string]interface{}, path []string, value interface{}) {
+	name := path[0]
+	if len(path) > 1 {
+		child, ok := target[name].(map[string]interface{})
+		if !ok {
+			if value == nil {
+				return
+			}
+			child = make(map[string]interface{})
+			target[name] = child
+		}
+		mergePath(child, path[1:], value)
+		return
+	}
+	if value == nil {
+		delete(target, name)
+		return
+	}
+	target[name] = mergePatch(target[name], value)
+}
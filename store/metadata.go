@@ -0,0 +1,94 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Metadata is kept by the backends next to the data of every document.
+type Metadata struct {
+	// Version is one when the document is created and incremented by
+	// every write. Documents written without metadata have version zero.
+	Version uint64 `json:"version"`
+	// CreateTime is the time the document was created and UpdateTime the
+	// time of its last write. Both are zero for documents written without
+	// metadata.
+	CreateTime time.Time `json:"createTime"`
+	UpdateTime time.Time `json:"updateTime"`
+	// ExpireTime is the time the document expires at, it is zero for
+	// documents that never expire.
+	ExpireTime time.Time `json:"expireTime"`
+}
+
+// Expired reports whether the document has expired at the given time.
+// Backends treat expired documents as absent until they are removed.
+func (m Metadata) Expired(now time.Time) bool {
+	return !m.ExpireTime.IsZero() && !now.Before(m.ExpireTime)
+}
+
+// NextMetadata returns the metadata of a document that is being written,
+// given its current metadata or nil if the document does not exist. The
+// expiration time of the document is kept.
+func NextMetadata(current *Metadata) Metadata {
+	now := time.Now().UTC()
+	if current == nil {
+		return Metadata{Version: 1, CreateTime: now, UpdateTime: now}
+	}
+	next := *current
+	next.Version++
+	next.UpdateTime = now
+	return next
+}
+
+// NextMetadataWithTTL is like NextMetadata, but the document expires once
+// the time-to-live has elapsed, or never if it is zero.
+func NextMetadataWithTTL(current *Metadata, ttl time.Duration) Metadata {
+	next := NextMetadata(current)
+	next.ExpireTime = time.Time{}
+	if ttl > 0 {
+		next.ExpireTime = next.UpdateTime.Add(ttl)
+	}
+	return next
+}
+
+// recordMarker starts every encoded record. JSON documents never start
+// with a zero byte, which tells records apart from plain JSON values
+// written before metadata was introduced.
+const recordMarker = 0
+
+// EncodeRecord encodes the document's metadata and data into a single
+// value for backends that store both under the same key.
+func EncodeRecord(meta Metadata, data []byte) ([]byte, error) {
+	header, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1+binary.MaxVarintLen64, 1+binary.MaxVarintLen64+len(header)+len(data))
+	buf[0] = recordMarker
+	n := binary.PutUvarint(buf[1:], uint64(len(header)))
+	buf = buf[:1+n]
+	buf = append(buf, header...)
+	return append(buf, data...), nil
+}
+
+// DecodeRecord decodes a value encoded by EncodeRecord. Plain values are
+// returned as they are along with empty metadata. The returned data
+// shares memory with the record.
+func DecodeRecord(record []byte) (Metadata, []byte, error) {
+	var meta Metadata
+	if len(record) == 0 || record[0] != recordMarker {
+		return meta, record, nil
+	}
+	length, n := binary.Uvarint(record[1:])
+	if n <= 0 || uint64(len(record)-1-n) < length {
+		return meta, nil, fmt.Errorf("invalid record header")
+	}
+	start := 1 + n
+	end := start + int(length)
+	if err := json.Unmarshal(record[start:end], &meta); err != nil {
+		return meta, nil, err
+	}
+	return meta, record[end:], nil
+}
@@ -2,48 +2,76 @@ package store
 
 import (
 	"sort"
-	"github.com/Jeffail/gabs"
 )
 
+// Order sorts the items of a collection by a field and items that are equal
+// by that field by the orders of Then, in turn. Missing fields sort like
+// null, values of different types sort as CompareJSON orders them. Items
+// that are equal by all fields are sorted by their keys in ascending order,
+// which makes every order total.
 type Order struct {
-	OrderBy   string `json:"orderBy"`
-	Ascending bool   `json:"ascending"`
+	OrderBy   string  `json:"orderBy"`
+	Ascending bool    `json:"ascending"`
+	Then      []Order `json:"then,omitempty"`
+}
+
+// Fields returns the orders of the individual fields in the order they are
+// applied in, leaving out those that don't name a field.
+func (o Order) Fields() []Order {
+	var fields []Order
+	if o.OrderBy != "" {
+		fields = append(fields, Order{OrderBy: o.OrderBy, Ascending: o.Ascending})
+	}
+	for _, then := range o.Then {
+		fields = append(fields, then.Fields()...)
+	}
+	return fields
+}
+
+// IsEmpty reports whether the order doesn't name any field, in which case
+// items are sorted by their keys only.
+func (o Order) IsEmpty() bool {
+	return len(o.Fields()) == 0
 }
 
 func OrderJSON(items []CollectionItem, order Order) {
-	sort.Slice(items, func(i, j int) bool {
-		if !order.Ascending {
-			i, j = j, i
-		}
-		a, err := gabs.ParseJSON(items[i].Value)
-		if err != nil {
-			return true
-		}
-		b, err := gabs.ParseJSON(items[j].Value)
-		if err != nil {
-			return false
-		}
-		valueA := a.Path(order.OrderBy).Data()
-		valueB := b.Path(order.OrderBy).Data()
-		if valueA == nil && valueB != nil {
-			return true
+	fields := order.Fields()
+	values := make([][]interface{}, len(items))
+	for i, item := range items {
+		values[i] = orderValues(item.Value, fields)
+	}
+	sort.Sort(&itemSorter{items, values, fields})
+}
+
+// itemSorter sorts items along with the values of their order fields.
+type itemSorter struct {
+	items  []CollectionItem
+	values [][]interface{}
+	fields []Order
+}
+
+func (s *itemSorter) Len() int {
+	return len(s.items)
+}
+
+func (s *itemSorter) Less(i, j int) bool {
+	for f, field := range s.fields {
+		c := CompareJSON(s.values[i][f], s.values[j][f])
+		if !field.Ascending {
+			c = -c
 		}
-		if valueB == nil {
-			return false
+		if c != 0 {
+			return c < 0
 		}
-		return Less(valueA, valueB)
-	})
+	}
+	return s.items[i].Key < s.items[j].Key
+}
+
+func (s *itemSorter) Swap(i, j int) {
+	s.items[i], s.items[j] = s.items[j], s.items[i]
+	s.values[i], s.values[j] = s.values[j], s.values[i]
 }
 
 func Less(a interface{}, b interface{}) bool {
-	switch a.(type) {
-	case float64:
-		b, ok := b.(float64)
-		return ok && a.(float64) < b
-	case string:
-		b, ok := b.(string)
-		return ok && a.(string) < b
-	default:
-		return false
-	}
+	return CompareJSON(a, b) < 0
 }
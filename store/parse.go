@@ -0,0 +1,659 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// SyntaxError reports an error in a textual query at the given byte offset.
+type SyntaxError struct {
+	Offset int
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at offset %d: %s", e.Offset, e.Msg)
+}
+
+// ParseQuery parses a query in the textual query language into the query,
+// order and limit it describes, e.g.
+//
+//	age >= 21 AND city in ["Berlin", "Paris"] ORDER BY age DESC LIMIT 10 OFFSET 20
+//
+// Filters compare fields to JSON values with the operators of Query, where
+// "=" is short for "==" and "NOT IN" for "not-in", and "field EXISTS" and
+// "field NOT EXISTS" test for fields. Filters are combined by NOT, AND and
+// OR, in order of precedence, and parentheses. Fields are names separated
+// by dots or any text enclosed in backquotes, with doubled backquotes
+// standing for one. ORDER BY sorts ascending unless DESC is given. Keywords
+// are case-insensitive and all clauses are optional, but their order is
+// fixed. Errors are *SyntaxErrors.
+func ParseQuery(s string) (Query, Order, Limit, error) {
+	p := &parser{input: s}
+	if err := p.next(); err != nil {
+		return Query{}, Order{}, Limit{}, err
+	}
+	return p.parse()
+}
+
+// FormatQuery formats the query, order and limit in the textual query
+// language, such that ParseQuery parses them back into an equivalent query,
+// order and limit. Empty subqueries and cursors aren't represented.
+func FormatQuery(q Query, o Order, l Limit) string {
+	var clauses []string
+	if filter, _ := formatFilter(q); filter != "" {
+		clauses = append(clauses, filter)
+	}
+	if fields := o.Fields(); len(fields) > 0 {
+		terms := make([]string, len(fields))
+		for i, field := range fields {
+			terms[i] = formatField(field.OrderBy) + " ASC"
+			if !field.Ascending {
+				terms[i] = formatField(field.OrderBy) + " DESC"
+			}
+		}
+		clauses = append(clauses, "ORDER BY "+strings.Join(terms, ", "))
+	}
+	if l.Limit > 0 {
+		clauses = append(clauses, "LIMIT "+strconv.Itoa(l.Limit))
+	}
+	if l.Offset > 0 {
+		clauses = append(clauses, "OFFSET "+strconv.Itoa(l.Offset))
+	}
+	return strings.Join(clauses, " ")
+}
+
+// Precedences of formatted filters.
+const (
+	precedenceOr = iota
+	precedenceAnd
+	precedenceUnary
+)
+
+// formatFilter returns the formatted query along with the precedence of
+// its outermost operator.
+func formatFilter(q Query) (string, int) {
+	type term struct {
+		s          string
+		precedence int
+	}
+	var terms []term
+	if q.isComparison() {
+		terms = append(terms, term{formatComparison(q), precedenceUnary})
+	}
+	for _, and := range q.And {
+		if s, precedence := formatFilter(and); s != "" {
+			terms = append(terms, term{s, precedence})
+		}
+	}
+	var ors []term
+	for _, or := range q.Or {
+		if s, precedence := formatFilter(or); s != "" {
+			ors = append(ors, term{s, precedence})
+		}
+	}
+	if len(ors) == 1 {
+		terms = append(terms, ors[0])
+	} else if len(ors) > 1 {
+		alternatives := make([]string, len(ors))
+		for i, or := range ors {
+			alternatives[i] = or.s
+		}
+		terms = append(terms, term{strings.Join(alternatives, " OR "), precedenceOr})
+	}
+	if q.Not != nil {
+		if s, precedence := formatFilter(*q.Not); s != "" {
+			if precedence < precedenceUnary {
+				s = "(" + s + ")"
+			}
+			terms = append(terms, term{"NOT " + s, precedenceUnary})
+		}
+	}
+	switch len(terms) {
+	case 0:
+		return "", precedenceUnary
+	case 1:
+		return terms[0].s, terms[0].precedence
+	}
+	conjuncts := make([]string, len(terms))
+	for i, t := range terms {
+		conjuncts[i] = t.s
+		if t.precedence < precedenceAnd {
+			conjuncts[i] = "(" + t.s + ")"
+		}
+	}
+	return strings.Join(conjuncts, " AND "), precedenceAnd
+}
+
+func formatComparison(q Query) string {
+	field := formatField(q.Field)
+	if q.Operator == FieldExists {
+		if q.Value == false {
+			return field + " NOT EXISTS"
+		}
+		return field + " EXISTS"
+	}
+	value := "null"
+	if normalized, err := NormalizeJSON(q.Value); err == nil {
+		if data, err := json.Marshal(normalized); err == nil {
+			value = string(data)
+		}
+	}
+	return field + " " + string(q.Operator) + " " + value
+}
+
+// formatField returns the field as is if the parser reads it as a field,
+// and enclosed in backquotes otherwise.
+func formatField(field string) string {
+	if isFieldWord(field) {
+		return field
+	}
+	return "`" + strings.Replace(field, "`", "``", -1) + "`"
+}
+
+// keywords can't be used as unquoted fields.
+var keywords = map[string]bool{
+	"and": true, "or": true, "not": true, "order": true, "by": true, "asc": true, "desc": true,
+	"limit": true, "offset": true, "true": true, "false": true, "null": true, "exists": true,
+	string(In): true, string(NotIn): true, string(ArrayContains): true,
+	string(ArrayContainsAny): true, string(Prefix): true,
+}
+
+func isWordStart(r rune) bool {
+	return unicode.IsLetter(r) || r == '_' || r == '$'
+}
+
+func isWordPart(r rune) bool {
+	return isWordStart(r) || unicode.IsDigit(r) || r == '-' || r == '.'
+}
+
+// isFieldWord reports whether the string is a word, but no keyword, made of
+// non-empty names separated by dots.
+func isFieldWord(s string) bool {
+	if s == "" || keywords[strings.ToLower(s)] {
+		return false
+	}
+	for i, r := range s {
+		if r == utf8.RuneError || (i == 0 && !isWordStart(r)) || !isWordPart(r) {
+			return false
+		}
+	}
+	for _, name := range strings.Split(s, ".") {
+		if name == "" {
+			return false
+		}
+	}
+	return true
+}
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	// Words are keywords, word operators and fields.
+	tokenWord
+	tokenQuotedField
+	tokenString
+	tokenNumber
+	// Symbols are symbolic operators and punctuation.
+	tokenSymbol
+)
+
+type token struct {
+	kind   tokenKind
+	text   string
+	offset int
+	// value holds the values of strings, numbers and quoted fields.
+	value interface{}
+}
+
+func (t token) String() string {
+	if t.kind == tokenEnd {
+		return "end of query"
+	}
+	return strconv.Quote(t.text)
+}
+
+// maxParseDepth limits the nesting of parentheses, arrays and objects.
+const maxParseDepth = 100
+
+type parser struct {
+	input string
+	pos   int
+	token token
+	depth int
+}
+
+func (p *parser) errorf(offset int, format string, args ...interface{}) error {
+	return &SyntaxError{Offset: offset, Msg: fmt.Sprintf(format, args...)}
+}
+
+// next reads the next token of the input.
+func (p *parser) next() error {
+	for p.pos < len(p.input) {
+		r, size := utf8.DecodeRuneInString(p.input[p.pos:])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		p.pos += size
+	}
+	start := p.pos
+	if start == len(p.input) {
+		p.token = token{kind: tokenEnd, offset: start}
+		return nil
+	}
+	r, size := utf8.DecodeRuneInString(p.input[start:])
+	switch {
+	case isWordStart(r):
+		p.pos += size
+		for p.pos < len(p.input) {
+			r, size := utf8.DecodeRuneInString(p.input[p.pos:])
+			if !isWordPart(r) {
+				break
+			}
+			p.pos += size
+		}
+		p.token = token{kind: tokenWord, text: p.input[start:p.pos], offset: start}
+	case r == '`':
+		var field strings.Builder
+		for p.pos++; ; p.pos++ {
+			if p.pos == len(p.input) {
+				return p.errorf(start, "unterminated quoted field")
+			}
+			if p.input[p.pos] == '`' {
+				if p.pos+1 == len(p.input) || p.input[p.pos+1] != '`' {
+					break
+				}
+				p.pos++
+			}
+			field.WriteByte(p.input[p.pos])
+		}
+		p.pos++
+		p.token = token{kind: tokenQuotedField, text: p.input[start:p.pos], offset: start, value: field.String()}
+	case r == '"':
+		for p.pos++; ; p.pos++ {
+			if p.pos >= len(p.input) {
+				return p.errorf(start, "unterminated string")
+			}
+			if p.input[p.pos] == '\\' {
+				p.pos++
+				continue
+			}
+			if p.input[p.pos] == '"' {
+				break
+			}
+		}
+		p.pos++
+		text := p.input[start:p.pos]
+		var value string
+		if err := json.Unmarshal([]byte(text), &value); err != nil {
+			return p.errorf(start, "invalid string %s", text)
+		}
+		p.token = token{kind: tokenString, text: text, offset: start, value: value}
+	case r == '-' || (r >= '0' && r <= '9'):
+		for p.pos++; p.pos < len(p.input) && strings.IndexByte("0123456789.eE+-", p.input[p.pos]) >= 0; p.pos++ {
+		}
+		text := p.input[start:p.pos]
+		var value float64
+		if err := json.Unmarshal([]byte(text), &value); err != nil {
+			return p.errorf(start, "invalid number %q", text)
+		}
+		p.token = token{kind: tokenNumber, text: text, offset: start, value: value}
+	default:
+		for _, symbol := range []string{"==", "!=", "<=", ">=", "=", "<", ">", "(", ")", "[", "]", "{", "}", ",", ":"} {
+			if strings.HasPrefix(p.input[start:], symbol) {
+				p.pos += len(symbol)
+				p.token = token{kind: tokenSymbol, text: symbol, offset: start}
+				return nil
+			}
+		}
+		return p.errorf(start, "unexpected character %q", r)
+	}
+	return nil
+}
+
+// isKeyword reports whether the current token is the given keyword.
+func (p *parser) isKeyword(keyword string) bool {
+	return p.token.kind == tokenWord && strings.EqualFold(p.token.text, keyword)
+}
+
+func (p *parser) isSymbol(symbol string) bool {
+	return p.token.kind == tokenSymbol && p.token.text == symbol
+}
+
+// expect reads the current token if it is the given keyword or symbol.
+// Errors name keywords in upper case and quote symbols.
+func (p *parser) expect(text string) error {
+	if !p.isKeyword(text) && !p.isSymbol(text) {
+		expected := strconv.Quote(text)
+		if unicode.IsLetter(rune(text[0])) {
+			expected = strings.ToUpper(text)
+		}
+		return p.errorf(p.token.offset, "expected %s, found %s", expected, p.token)
+	}
+	return p.next()
+}
+
+// expectSeparator reads the comma separating the elements of an array or
+// the members of an object, unless the closing symbol ends it instead.
+func (p *parser) expectSeparator(closing string) error {
+	if !p.isSymbol(",") {
+		return p.errorf(p.token.offset, `expected "," or %q, found %s`, closing, p.token)
+	}
+	return p.next()
+}
+
+func (p *parser) enter() error {
+	p.depth++
+	if p.depth > maxParseDepth {
+		return p.errorf(p.token.offset, "query nested too deeply")
+	}
+	return nil
+}
+
+func (p *parser) parse() (Query, Order, Limit, error) {
+	var q Query
+	var o Order
+	var l Limit
+	var err error
+	if p.token.kind != tokenEnd && !p.isKeyword("order") && !p.isKeyword("limit") && !p.isKeyword("offset") {
+		if q, err = p.parseOr(); err != nil {
+			return Query{}, Order{}, Limit{}, err
+		}
+	}
+	if p.isKeyword("order") {
+		if o, err = p.parseOrder(); err != nil {
+			return Query{}, Order{}, Limit{}, err
+		}
+	}
+	if p.isKeyword("limit") {
+		if l.Limit, err = p.parseCount(); err != nil {
+			return Query{}, Order{}, Limit{}, err
+		}
+	}
+	if p.isKeyword("offset") {
+		if l.Offset, err = p.parseCount(); err != nil {
+			return Query{}, Order{}, Limit{}, err
+		}
+	}
+	if p.token.kind != tokenEnd {
+		return Query{}, Order{}, Limit{}, p.errorf(p.token.offset, "unexpected %s", p.token)
+	}
+	return q, o, l, nil
+}
+
+func (p *parser) parseOr() (Query, error) {
+	var queries []Query
+	for {
+		q, err := p.parseAnd()
+		if err != nil {
+			return Query{}, err
+		}
+		queries = append(queries, q)
+		if !p.isKeyword("or") {
+			break
+		}
+		if err := p.next(); err != nil {
+			return Query{}, err
+		}
+	}
+	if len(queries) == 1 {
+		return queries[0], nil
+	}
+	return Or(queries...), nil
+}
+
+func (p *parser) parseAnd() (Query, error) {
+	var queries []Query
+	for {
+		q, err := p.parseUnary()
+		if err != nil {
+			return Query{}, err
+		}
+		queries = append(queries, q)
+		if !p.isKeyword("and") {
+			break
+		}
+		if err := p.next(); err != nil {
+			return Query{}, err
+		}
+	}
+	if len(queries) == 1 {
+		return queries[0], nil
+	}
+	return And(queries...), nil
+}
+
+func (p *parser) parseUnary() (Query, error) {
+	if err := p.enter(); err != nil {
+		return Query{}, err
+	}
+	defer func() { p.depth-- }()
+
+	if p.isKeyword("not") {
+		if err := p.next(); err != nil {
+			return Query{}, err
+		}
+		q, err := p.parseUnary()
+		if err != nil {
+			return Query{}, err
+		}
+		return Not(q), nil
+	}
+	if p.isSymbol("(") {
+		if err := p.next(); err != nil {
+			return Query{}, err
+		}
+		q, err := p.parseOr()
+		if err != nil {
+			return Query{}, err
+		}
+		return q, p.expect(")")
+	}
+	return p.parseComparison()
+}
+
+var symbolOperators = map[string]Operator{
+	"==": Eq, "=": Eq, "!=": Ne, "<": Lt, "<=": Le, ">": Gt, ">=": Ge,
+}
+
+var wordOperators = map[string]Operator{
+	string(In): In, string(NotIn): NotIn, string(ArrayContains): ArrayContains,
+	string(ArrayContainsAny): ArrayContainsAny, string(Prefix): Prefix,
+}
+
+func (p *parser) parseComparison() (Query, error) {
+	field, err := p.parseField()
+	if err != nil {
+		return Query{}, err
+	}
+	q := Query{Field: field}
+	operator := p.token
+	switch {
+	case operator.kind == tokenSymbol && symbolOperators[operator.text] != "":
+		q.Operator = symbolOperators[operator.text]
+	case operator.kind == tokenWord && wordOperators[strings.ToLower(operator.text)] != "":
+		q.Operator = wordOperators[strings.ToLower(operator.text)]
+	case p.isKeyword("exists"):
+		q.Operator, q.Value = FieldExists, true
+		return q, p.next()
+	case p.isKeyword("not"):
+		if err := p.next(); err != nil {
+			return Query{}, err
+		}
+		if p.isKeyword("exists") {
+			q.Operator, q.Value = FieldExists, false
+			return q, p.next()
+		}
+		if !p.isKeyword("in") {
+			return Query{}, p.errorf(p.token.offset, "expected IN or EXISTS after NOT, found %s", p.token)
+		}
+		q.Operator = NotIn
+	default:
+		return Query{}, p.errorf(operator.offset, "expected operator after field %s, found %s", formatField(field), operator)
+	}
+	if err := p.next(); err != nil {
+		return Query{}, err
+	}
+	valueOffset := p.token.offset
+	if q.Value, err = p.parseValue(); err != nil {
+		return Query{}, err
+	}
+	switch q.Operator {
+	case In, NotIn, ArrayContainsAny:
+		if _, isArray := q.Value.([]interface{}); !isArray {
+			return Query{}, p.errorf(valueOffset, "value of operator %s is no array", q.Operator)
+		}
+	case Prefix:
+		if _, isString := q.Value.(string); !isString {
+			return Query{}, p.errorf(valueOffset, "value of operator %s is no string", q.Operator)
+		}
+	}
+	return q, nil
+}
+
+func (p *parser) parseField() (string, error) {
+	t := p.token
+	switch t.kind {
+	case tokenWord:
+		if keywords[strings.ToLower(t.text)] {
+			return "", p.errorf(t.offset, "expected field, found keyword %s", t)
+		}
+		if !isFieldWord(t.text) {
+			return "", p.errorf(t.offset, "invalid field %s", t)
+		}
+	case tokenQuotedField:
+		if t.value == "" {
+			return "", p.errorf(t.offset, "empty field")
+		}
+	default:
+		return "", p.errorf(t.offset, "expected field, found %s", t)
+	}
+	field := t.text
+	if t.kind == tokenQuotedField {
+		field = t.value.(string)
+	}
+	return field, p.next()
+}
+
+// parseValue parses a JSON value, returning it as encoding/json decodes it.
+func (p *parser) parseValue() (interface{}, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { p.depth-- }()
+
+	t := p.token
+	switch {
+	case t.kind == tokenString || t.kind == tokenNumber:
+		return t.value, p.next()
+	case p.isKeyword("true"):
+		return true, p.next()
+	case p.isKeyword("false"):
+		return false, p.next()
+	case p.isKeyword("null"):
+		return nil, p.next()
+	case p.isSymbol("["):
+		values := []interface{}{}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		for !p.isSymbol("]") {
+			if len(values) > 0 {
+				if err := p.expectSeparator("]"); err != nil {
+					return nil, err
+				}
+			}
+			value, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, p.next()
+	case p.isSymbol("{"):
+		object := map[string]interface{}{}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		for !p.isSymbol("}") {
+			if len(object) > 0 {
+				if err := p.expectSeparator("}"); err != nil {
+					return nil, err
+				}
+			}
+			if p.token.kind != tokenString {
+				return nil, p.errorf(p.token.offset, "expected string key, found %s", p.token)
+			}
+			key := p.token.value.(string)
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			value, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			object[key] = value
+		}
+		return object, p.next()
+	}
+	return nil, p.errorf(t.offset, "expected value, found %s", t)
+}
+
+func (p *parser) parseOrder() (Order, error) {
+	if err := p.next(); err != nil {
+		return Order{}, err
+	}
+	if err := p.expect("by"); err != nil {
+		return Order{}, err
+	}
+	var fields []Order
+	for {
+		field, err := p.parseField()
+		if err != nil {
+			return Order{}, err
+		}
+		order := Order{OrderBy: field, Ascending: true}
+		if p.isKeyword("asc") || p.isKeyword("desc") {
+			order.Ascending = p.isKeyword("asc")
+			if err := p.next(); err != nil {
+				return Order{}, err
+			}
+		}
+		fields = append(fields, order)
+		if !p.isSymbol(",") {
+			break
+		}
+		if err := p.next(); err != nil {
+			return Order{}, err
+		}
+	}
+	o := fields[0]
+	o.Then = fields[1:]
+	if len(o.Then) == 0 {
+		o.Then = nil
+	}
+	return o, nil
+}
+
+// parseCount parses the number following LIMIT or OFFSET.
+func (p *parser) parseCount() (int, error) {
+	keyword := strings.ToUpper(p.token.text)
+	if err := p.next(); err != nil {
+		return 0, err
+	}
+	t := p.token
+	n, isNumber := t.value.(float64)
+	if t.kind != tokenNumber || !isNumber || n < 0 || n != math.Trunc(n) || n > math.MaxInt32 {
+		return 0, p.errorf(t.offset, "expected non-negative integer after %s, found %s", keyword, t)
+	}
+	return int(n), p.next()
+}
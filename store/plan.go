@@ -0,0 +1,187 @@
+package store
+
+import "bytes"
+
+type ScanType string
+
+const (
+	IndexScan ScanType = "INDEX_SCAN"
+	FullScan  ScanType = "FULL_SCAN"
+)
+
+// Explanation reports how a store read the items of a collection for a
+// query: the type of scan, the index scanned if any, the number of
+// documents examined and the number of items returned.
+type Explanation struct {
+	Scan     ScanType  `json:"scan"`
+	Index    *Index    `json:"index,omitempty"`
+	Examined int       `json:"examined"`
+	Returned int       `json:"returned"`
+	Pushdown *Pushdown `json:"pushdown,omitempty"`
+}
+
+// Pushdown reports which parts of a query a store translated for its
+// database engine to evaluate, rather than evaluating them on the documents
+// read, along with the statement run.
+type Pushdown struct {
+	Query     bool   `json:"query"`
+	Order     bool   `json:"order"`
+	Limit     bool   `json:"limit"`
+	Statement string `json:"statement"`
+}
+
+// Plan describes how a store reads the items of a collection for a query:
+// by scanning the entries of an index whose encoded values lie between
+// From and To, or by reading the whole collection if Index is nil.
+type Plan struct {
+	Index *Index
+	// To is exclusive and nil if the scan reaches the end of the index.
+	From, To []byte
+	Reverse  bool
+	// Ordered is set if the scan reads items in the order of the query
+	// once items with equal values of the first Sorted fields of the index
+	// have been sorted by key.
+	Ordered bool
+	Sorted  int
+}
+
+// PlanQuery picks the index of the collection that serves the query and
+// order best. An index serves equality comparisons of its leading fields,
+// range comparisons of the field following those and orders by the fields
+// following those if they share a direction. Equality comparisons weigh
+// more than ranges, which weigh more than orders. Only comparisons that all
+// matching documents satisfy, i.e. that aren't part of Or or Not queries,
+// are served; the query has to be applied to the documents read anyway.
+func PlanQuery(indexes []Index, collectionKey string, q Query, o Order) Plan {
+	var best Plan
+	bestScore := 0
+	for _, index := range indexes {
+		if index.Collection != collectionKey || len(index.Fields) == 0 {
+			continue
+		}
+		plan, score := planIndex(index, q, o)
+		if score > bestScore {
+			best, bestScore = plan, score
+		}
+	}
+	return best
+}
+
+func planIndex(index Index, q Query, o Order) (Plan, int) {
+	plan := Plan{Index: &index}
+	score := 0
+
+	var prefix []byte
+	equal := make(map[string]bool)
+	n := 0
+	for ; n < len(index.Fields); n++ {
+		value, ok := equalValue(q, index.Fields[n])
+		if !ok {
+			break
+		}
+		prefix = appendIndexValue(prefix, value)
+		equal[index.Fields[n]] = true
+		score += 4
+	}
+	plan.From, plan.To = prefix, pastBytes(prefix)
+	if n < len(index.Fields) {
+		if from, to, ok := valueRange(q, index.Fields[n]); ok {
+			plan.From = append(append([]byte{}, prefix...), from...)
+			plan.To = append(append([]byte{}, prefix...), to...)
+			score += 2
+		}
+	}
+
+	// Fields compared for equality don't affect the order.
+	var fields []Order
+	for _, field := range o.Fields() {
+		if !equal[field.OrderBy] {
+			fields = append(fields, field)
+		}
+	}
+	if len(fields) == 0 || n+len(fields) > len(index.Fields) {
+		return plan, score
+	}
+	for i, field := range fields {
+		if field.OrderBy != index.Fields[n+i] || field.Ascending != fields[0].Ascending {
+			return plan, score
+		}
+	}
+	plan.Ordered, plan.Reverse, plan.Sorted = true, !fields[0].Ascending, n+len(fields)
+	return plan, score + 1
+}
+
+// comparisons returns the comparisons of the field that all documents
+// matching the query satisfy.
+func comparisons(q Query, field string) []Query {
+	var queries []Query
+	if q.Field == field {
+		queries = append(queries, q)
+	}
+	for _, and := range q.And {
+		queries = append(queries, comparisons(and, field)...)
+	}
+	return queries
+}
+
+// equalValue returns the normalized value the field is compared for
+// equality to by the query, if any.
+func equalValue(q Query, field string) (interface{}, bool) {
+	for _, cmp := range comparisons(q, field) {
+		if cmp.Operator == Eq {
+			value, err := NormalizeJSON(cmp.Value)
+			return value, err == nil
+		}
+	}
+	return nil, false
+}
+
+// valueRange returns the range of encoded values of the field satisfying
+// the range comparisons of the query, if any. Range operators only match
+// values of the same type, whose encodings share the first byte.
+func valueRange(q Query, field string) ([]byte, []byte, bool) {
+	var from, to []byte
+	found := false
+	for _, cmp := range comparisons(q, field) {
+		value, err := NormalizeJSON(cmp.Value)
+		if err != nil {
+			continue
+		}
+		encoded := EncodeIndexValue(value)
+		typeStart, typeEnd := encoded[:1], []byte{encoded[0] + 1}
+		var cmpFrom, cmpTo []byte
+		switch cmp.Operator {
+		case Lt:
+			cmpFrom, cmpTo = typeStart, encoded
+		case Le:
+			cmpFrom, cmpTo = typeStart, pastBytes(encoded)
+		case Gt:
+			cmpFrom, cmpTo = pastBytes(encoded), typeEnd
+		case Ge:
+			cmpFrom, cmpTo = encoded, typeEnd
+		default:
+			continue
+		}
+		if !found || bytes.Compare(cmpFrom, from) > 0 {
+			from = cmpFrom
+		}
+		if !found || bytes.Compare(cmpTo, to) < 0 {
+			to = cmpTo
+		}
+		found = true
+	}
+	return from, to, found
+}
+
+// pastBytes returns the first key following all keys with the given prefix,
+// or nil if there is none.
+func pastBytes(prefix []byte) []byte {
+	past := append([]byte{}, prefix...)
+	for i := len(past) - 1; i >= 0; i-- {
+		if past[i] < 0xff {
+			past[i]++
+			return past[:i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package store
+
+import "fmt"
+
+type PreconditionType string
+
+const (
+	// MustExist requires the document to exist.
+	MustExist PreconditionType = "EXISTS"
+	// MustNotExist requires the document not to exist.
+	MustNotExist PreconditionType = "NOT_EXISTS"
+	// MustHaveVersion requires the document to exist with the given version.
+	MustHaveVersion PreconditionType = "VERSION"
+)
+
+// Precondition is a condition on the current state of a document that has
+// to hold for a write to be applied, e.g. to implement compare-and-swap.
+type Precondition struct {
+	Type    PreconditionType `json:"type"`
+	Version uint64           `json:"version,omitempty"`
+}
+
+func Exists() Precondition {
+	return Precondition{Type: MustExist}
+}
+
+func NotExists() Precondition {
+	return Precondition{Type: MustNotExist}
+}
+
+func HasVersion(version uint64) Precondition {
+	return Precondition{Type: MustHaveVersion, Version: version}
+}
+
+// CheckPreconditions checks the preconditions against the current metadata
+// of the document, which is nil if the document does not exist. It returns
+// a *ConflictError for the first precondition that does not hold.
+func CheckPreconditions(key string, current *Metadata, preconditions []Precondition) error {
+	for _, p := range preconditions {
+		switch p.Type {
+		case MustExist:
+			if current == nil {
+				return &ConflictError{Key: key, Reason: "document does not exist"}
+			}
+		case MustNotExist:
+			if current != nil {
+				return &ConflictError{Key: key, Reason: "document already exists"}
+			}
+		case MustHaveVersion:
+			if current == nil {
+				return &ConflictError{Key: key, Reason: "document does not exist"}
+			}
+			if current.Version != p.Version {
+				return &ConflictError{
+					Key:    key,
+					Reason: fmt.Sprintf("expected version %d, found version %d", p.Version, current.Version),
+				}
+			}
+		default:
+			return fmt.Errorf("illegal precondition: %s", p.Type)
+		}
+	}
+	return nil
+}
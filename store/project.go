@@ -0,0 +1,35 @@
+package store
+
+import "github.com/Jeffail/gabs"
+
+// ProjectJSON returns a JSON object holding only the given fields of the
+// JSON document, at the same paths. Missing fields are left out, fields
+// holding null are kept. Without fields, the document is returned as is.
+func ProjectJSON(data []byte, fields []string) []byte {
+	if len(fields) == 0 {
+		return data
+	}
+	projected := gabs.New()
+	j, err := gabs.ParseJSON(data)
+	if err != nil {
+		return projected.Bytes()
+	}
+	for _, field := range fields {
+		if value := j.Path(field); value != nil {
+			// Paths through values other than objects collide with
+			// fields that have been projected already and are
+			// left out.
+			projected.SetP(value.Data(), field)
+		}
+	}
+	return projected.Bytes()
+}
+
+// ProjectItems projects the values of the items to the given fields, see
+// ProjectJSON.
+func ProjectItems(items []CollectionItem, fields []string) []CollectionItem {
+	for i := range items {
+		items[i].Value = ProjectJSON(items[i].Value, fields)
+	}
+	return items
+}
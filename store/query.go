@@ -1,7 +1,8 @@
 package store
 
 import (
-	"strconv"
+	"fmt"
+	"strings"
 
 	"github.com/Jeffail/gabs"
 )
@@ -10,67 +11,218 @@ type Operator string
 
 const (
 	Eq Operator = "=="
+	Ne Operator = "!="
 	Lt Operator = "<"
 	Le Operator = "<="
 	Gt Operator = ">"
 	Ge Operator = ">="
+	// In and NotIn match fields equal to any or none of the values of an
+	// array value.
+	In    Operator = "in"
+	NotIn Operator = "not-in"
+	// ArrayContains matches array fields with an element equal to the
+	// value, ArrayContainsAny those with an element equal to any of the
+	// values of an array value.
+	ArrayContains    Operator = "array-contains"
+	ArrayContainsAny Operator = "array-contains-any"
+	// Prefix matches string fields starting with the string value.
+	Prefix Operator = "prefix"
+	// FieldExists matches fields that are present and not null, or those
+	// that are missing or null if the value is false.
+	FieldExists Operator = "exists"
 )
 
+// Query filters the documents of a collection. A query compares a field to
+// a value and/or combines other queries: all queries of And and at least
+// one query of Or have to match while Not must not match. Everything that
+// is set has to hold, the empty query matches all documents.
+//
+// Values are JSON values, i.e. nil, booleans, numbers, strings, arrays and
+// objects, or Go values that are converted to JSON values. Fields equal
+// values that CompareJSON considers equal, missing fields equal null. Range
+// operators only match fields of the same type as the value, ordered as
+// CompareJSON orders them.
 type Query struct {
-	Field    string   `json:"field"`
-	Operator Operator `json:"operator"`
-	Value    string   `json:"value"`
+	Field    string      `json:"field,omitempty"`
+	Operator Operator    `json:"operator,omitempty"`
+	Value    interface{} `json:"value,omitempty"`
+
+	And []Query `json:"and,omitempty"`
+	Or  []Query `json:"or,omitempty"`
+	Not *Query  `json:"not,omitempty"`
+}
+
+func And(queries ...Query) Query {
+	return Query{And: queries}
+}
+
+func Or(queries ...Query) Query {
+	return Query{Or: queries}
+}
+
+func Not(query Query) Query {
+	return Query{Not: &query}
+}
+
+// Validate returns an error if the query can't be evaluated, e.g. because
+// of an unknown operator.
+func (q Query) Validate() error {
+	if q.isComparison() {
+		if q.Field == "" {
+			return fmt.Errorf("missing query field")
+		}
+		value, err := NormalizeJSON(q.Value)
+		if err != nil {
+			return err
+		}
+		switch q.Operator {
+		case Eq, Ne, Lt, Le, Gt, Ge, ArrayContains:
+		case In, NotIn, ArrayContainsAny:
+			if _, isArray := value.([]interface{}); !isArray {
+				return fmt.Errorf("value of operator %s is no array: %v", q.Operator, q.Value)
+			}
+		case Prefix:
+			if _, isString := value.(string); !isString {
+				return fmt.Errorf("value of operator %s is no string: %v", q.Operator, q.Value)
+			}
+		case FieldExists:
+			if _, isBool := value.(bool); value != nil && !isBool {
+				return fmt.Errorf("value of operator %s is no boolean: %v", q.Operator, q.Value)
+			}
+		default:
+			return fmt.Errorf("illegal operator: %s", q.Operator)
+		}
+	}
+	for _, and := range q.And {
+		if err := and.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, or := range q.Or {
+		if err := or.Validate(); err != nil {
+			return err
+		}
+	}
+	if q.Not != nil {
+		return q.Not.Validate()
+	}
+	return nil
+}
+
+// isComparison reports whether the query compares a field to a value.
+func (q Query) isComparison() bool {
+	return q.Field != "" || q.Operator != "" || q.Value != nil
 }
 
+// IsEmpty reports whether the query matches all documents, as it neither
+// compares a field nor combines other queries.
+func (q Query) IsEmpty() bool {
+	return !q.isComparison() && len(q.And) == 0 && len(q.Or) == 0 && q.Not == nil
+}
+
+// MatchesJSON reports whether the JSON document matches the query. Invalid
+// queries match no documents.
 func MatchesJSON(data []byte, query Query) bool {
 	j, err := gabs.ParseJSON(data)
 	if err != nil {
 		return false
 	}
+	return matches(j, query)
+}
+
+func matches(j *gabs.Container, query Query) bool {
+	if query.isComparison() {
+		if !matchesField(j, query) {
+			return false
+		}
+	}
+	for _, q := range query.And {
+		if !matches(j, q) {
+			return false
+		}
+	}
+	if len(query.Or) > 0 {
+		matched := false
+		for _, q := range query.Or {
+			if matches(j, q) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return query.Not == nil || !matches(j, *query.Not)
+}
+
+func matchesField(j *gabs.Container, query Query) bool {
+	value, err := NormalizeJSON(query.Value)
+	if err != nil {
+		return false
+	}
 	field := j.Path(query.Field).Data()
-	switch field.(type) {
-	case nil:
-		return query.Operator == Eq && query.Value == ""
-	case string:
-		return compareString(field.(string), query.Operator, query.Value)
-	case float64:
-		floatValue, err := strconv.ParseFloat(query.Value, 64)
-		if err != nil {
+	switch query.Operator {
+	case Ne:
+		return CompareJSON(field, value) != 0
+	case In, NotIn:
+		values, isArray := value.([]interface{})
+		return isArray && equalsAny(field, values) == (query.Operator == In)
+	case ArrayContains, ArrayContainsAny:
+		values := []interface{}{value}
+		if query.Operator == ArrayContainsAny {
+			var isArray bool
+			if values, isArray = value.([]interface{}); !isArray {
+				return false
+			}
+		}
+		elements, isArray := field.([]interface{})
+		if !isArray {
 			return false
 		}
-		return compareFloat(field.(float64), query.Operator, floatValue)
+		for _, element := range elements {
+			if equalsAny(element, values) {
+				return true
+			}
+		}
+		return false
+	case Prefix:
+		s, isString := field.(string)
+		prefix, isStringValue := value.(string)
+		return isString && isStringValue && strings.HasPrefix(s, prefix)
+	case FieldExists:
+		return (field != nil) == (value != false)
 	}
-	return false
+	return compare(field, query.Operator, value)
 }
 
-func compareString(a string, operator Operator, b string) bool {
-	switch operator {
-	case Eq:
-		return a == b
-	case Ge:
-		return a >= b
-	case Gt:
-		return a > b
-	case Le:
-		return a <= b
-	case Lt:
-		return a < b
+func equalsAny(field interface{}, values []interface{}) bool {
+	for _, value := range values {
+		if CompareJSON(field, value) == 0 {
+			return true
+		}
 	}
-	panic("illegal operator")
+	return false
 }
 
-func compareFloat(a float64, operator Operator, b float64) bool {
+// compare compares the field to the value. Apart from equality, fields
+// only compare to values of the same type.
+func compare(field interface{}, operator Operator, value interface{}) bool {
+	if operator != Eq && typeRank(field) != typeRank(value) {
+		return false
+	}
+	c := CompareJSON(field, value)
 	switch operator {
 	case Eq:
-		return a == b
+		return c == 0
 	case Ge:
-		return a >= b
+		return c >= 0
 	case Gt:
-		return a > b
+		return c > 0
 	case Le:
-		return a <= b
+		return c <= 0
 	case Lt:
-		return a < b
+		return c < 0
 	}
-	panic("illegal operator")
+	return false
 }
@@ -0,0 +1,417 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/Jeffail/gabs"
+)
+
+// BM25 parameters, k1 saturates the term frequency and b normalizes it by
+// the length of the document.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// SearchResult is a document found by a search along with its relevance,
+// higher scores rank first.
+type SearchResult struct {
+	Key   string
+	Value []byte
+	Score float64
+}
+
+func (r SearchResult) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Key   string          `json:"key"`
+		Value json.RawMessage `json:"value"`
+		Score float64         `json:"score"`
+	}{
+		Key:   r.Key,
+		Value: r.Value,
+		Score: r.Score,
+	})
+}
+
+// Tokenize splits the text into lowercase words of letters and digits and
+// reduces them to their stems, so that e.g. "Running" and "runs" both
+// yield "run".
+func Tokenize(text string) []string {
+	var terms []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		terms = append(terms, stem(word))
+	}
+	return terms
+}
+
+// stem strips common English inflections off the word. It is no match for
+// a real stemmer, but conflates plurals and most -ing and -ed forms.
+func stem(word string) string {
+	n := len(word)
+	switch {
+	case n > 4 && strings.HasSuffix(word, "ies"):
+		return word[:n-3] + "y"
+	case n > 5 && strings.HasSuffix(word, "ing"):
+		return undouble(word[:n-3])
+	case n > 4 && strings.HasSuffix(word, "ed"):
+		return undouble(word[:n-2])
+	case n > 3 && (strings.HasSuffix(word, "sses") || strings.HasSuffix(word, "xes") ||
+		strings.HasSuffix(word, "ches") || strings.HasSuffix(word, "shes")):
+		return word[:n-2]
+	case n > 3 && strings.HasSuffix(word, "s") && !strings.HasSuffix(word, "ss") &&
+		!strings.HasSuffix(word, "us"):
+		return word[:n-1]
+	}
+	return word
+}
+
+// undouble drops the last letter of stems ending with a doubled consonant,
+// as in "runn" of "running", unless it is one that English keeps doubled.
+func undouble(word string) string {
+	n := len(word)
+	if n >= 4 && word[n-1] == word[n-2] && !strings.ContainsRune("aeiouylsz", rune(word[n-1])) {
+		return word[:n-1]
+	}
+	return word
+}
+
+// Searcher keeps inverted indexes of the text of document fields in memory
+// to serve full-text searches of collections, see Collection.Search. Stores
+// enable the indexes per collection and tell the searcher about every
+// document they write or delete once the write has been committed.
+type Searcher struct {
+	mutex   sync.RWMutex
+	indexes map[string]*textIndex
+}
+
+// textIndex is the inverted index of the documents of a collection.
+type textIndex struct {
+	fields []string
+	// postings holds the frequency of each term per document ID.
+	postings map[string]map[string]int
+	// terms holds the terms of each document for removing it.
+	terms       map[string]map[string]int
+	lengths     map[string]int
+	totalLength int
+	// written holds the IDs of the documents written while the index is
+	// being built, whose data is newer than the data read to build it.
+	written map[string]bool
+}
+
+func NewSearcher() *Searcher {
+	return &Searcher{indexes: make(map[string]*textIndex)}
+}
+
+// Enable indexes the text of the given fields of the documents of the
+// collection, which the items function reads. Fields may hold strings or
+// arrays of strings, other values are not indexed. Enabling an enabled
+// collection again replaces its fields.
+func (s *Searcher) Enable(collectionKey string, fields []string, items func(Query, Order, Limit, ...string) ([]CollectionItem, error)) error {
+	if !IsCollectionKey(collectionKey) {
+		return fmt.Errorf("not a collection path: %s", collectionKey)
+	}
+	if len(fields) == 0 {
+		return fmt.Errorf("no fields to search")
+	}
+	for _, field := range fields {
+		if field == "" {
+			return fmt.Errorf("empty search field")
+		}
+	}
+	index := &textIndex{
+		fields:   fields,
+		postings: make(map[string]map[string]int),
+		terms:    make(map[string]map[string]int),
+		lengths:  make(map[string]int),
+		written:  make(map[string]bool),
+	}
+	// The index is installed before reading the documents so that no
+	// write is missed while it is being built.
+	s.mutex.Lock()
+	s.indexes[collectionKey] = index
+	s.mutex.Unlock()
+
+	current, err := items(Query{}, Order{}, Limit{}, fields...)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.indexes[collectionKey] != index {
+		return nil
+	}
+	if err != nil {
+		delete(s.indexes, collectionKey)
+		return err
+	}
+	for _, item := range current {
+		id := item.Key[len(collectionKey)+1:]
+		if !index.written[id] {
+			index.add(id, item.Value)
+		}
+	}
+	index.written = nil
+	return nil
+}
+
+// Indexed reports whether the document with the given key is indexed, i.e.
+// whether the searcher needs to be told about writes to it.
+func (s *Searcher) Indexed(key string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	_, indexed := s.indexes[CollectionKey(key)]
+	return indexed
+}
+
+// Update indexes the document with the given key for its data, or removes
+// it from the index if data is nil. Documents of collections which aren't
+// indexed are ignored.
+func (s *Searcher) Update(key string, data []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	collectionKey := CollectionKey(key)
+	index, indexed := s.indexes[collectionKey]
+	if !indexed {
+		return
+	}
+	id := key[len(collectionKey)+1:]
+	index.remove(id)
+	if data != nil {
+		index.add(id, data)
+	}
+	if index.written != nil {
+		index.written[id] = true
+	}
+}
+
+// Remove removes the documents with the given key from the index, e.g.
+// once they have expired.
+func (s *Searcher) Remove(key string) {
+	s.Update(key, nil)
+}
+
+// Search returns at most limit documents of the collection matching any
+// term of the text, or all of them if limit is zero, ranked by BM25 and by
+// key for equal scores. It reads the documents using get, which returns a
+// *NotFoundError for documents that are gone, e.g. because they expired.
+func (s *Searcher) Search(collectionKey string, text string, limit int, get func(key string) ([]byte, error)) ([]SearchResult, error) {
+	if limit < 0 {
+		return nil, fmt.Errorf("negative search limit: %d", limit)
+	}
+	results, err := s.rank(collectionKey, text)
+	if err != nil {
+		return nil, err
+	}
+	found := results[:0]
+	for _, r := range results {
+		if limit > 0 && len(found) == limit {
+			break
+		}
+		data, err := get(r.Key)
+		if _, notFound := err.(*NotFoundError); notFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		r.Value = data
+		found = append(found, r)
+	}
+	return found, nil
+}
+
+// rank scores the documents of the collection matching any term of the
+// text and sorts them by descending score.
+func (s *Searcher) rank(collectionKey string, text string) ([]SearchResult, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	index, indexed := s.indexes[collectionKey]
+	if !indexed {
+		return nil, fmt.Errorf("search is not enabled for collection: %s", collectionKey)
+	}
+	if len(index.lengths) == 0 {
+		return nil, nil
+	}
+	n := float64(len(index.lengths))
+	avgLength := float64(index.totalLength) / n
+	scores := make(map[string]float64)
+	seen := make(map[string]bool)
+	for _, term := range Tokenize(text) {
+		if seen[term] {
+			continue
+		}
+		seen[term] = true
+		postings := index.postings[term]
+		df := float64(len(postings))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		for id, tf := range postings {
+			norm := 1 - bm25B + bm25B*float64(index.lengths[id])/avgLength
+			scores[id] += idf * float64(tf) * (bm25K1 + 1) / (float64(tf) + bm25K1*norm)
+		}
+	}
+	results := make([]SearchResult, 0, len(scores))
+	for id, score := range scores {
+		results = append(results, SearchResult{Key: collectionKey + "/" + id, Score: score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Key < results[j].Key
+	})
+	return results, nil
+}
+
+func (index *textIndex) add(id string, data []byte) {
+	j, err := gabs.ParseJSON(data)
+	if err != nil {
+		return
+	}
+	terms := make(map[string]int)
+	length := 0
+	for _, field := range index.fields {
+		for _, text := range fieldTexts(j.Path(field).Data()) {
+			for _, term := range Tokenize(text) {
+				terms[term]++
+				length++
+			}
+		}
+	}
+	for term, tf := range terms {
+		postings, exists := index.postings[term]
+		if !exists {
+			postings = make(map[string]int)
+			index.postings[term] = postings
+		}
+		postings[id] = tf
+	}
+	index.terms[id] = terms
+	index.lengths[id] = length
+	index.totalLength += length
+}
+
+func (index *textIndex) remove(id string) {
+	terms, exists := index.terms[id]
+	if !exists {
+		return
+	}
+	for term := range terms {
+		delete(index.postings[term], id)
+		if len(index.postings[term]) == 0 {
+			delete(index.postings, term)
+		}
+	}
+	index.totalLength -= index.lengths[id]
+	delete(index.terms, id)
+	delete(index.lengths, id)
+}
+
+// fieldTexts returns the strings of a field's value, which is a string or
+// an array of strings.
+func fieldTexts(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var texts []string
+		for _, element := range v {
+			if s, isString := element.(string); isString {
+				texts = append(texts, s)
+			}
+		}
+		return texts
+	}
+	return nil
+}
+
+// SearchTx records the documents written within a transaction so that the
+// searcher can index them once the transaction has been committed. It is
+// meant for backends whose transactions write to the database directly.
+type SearchTx struct {
+	Tx
+	searcher *Searcher
+	keys     []string
+	changes  map[string][]byte
+}
+
+// Tx returns a transaction which records the writes of the given one, see
+// SearchTx.Commit.
+func (s *Searcher) Tx(tx Tx) *SearchTx {
+	return &SearchTx{Tx: tx, searcher: s, changes: make(map[string][]byte)}
+}
+
+// Commit indexes the recorded documents. It must only be called once the
+// transaction has been committed.
+func (t *SearchTx) Commit() {
+	for _, key := range t.keys {
+		t.searcher.Update(key, t.changes[key])
+	}
+}
+
+func (t *SearchTx) Set(key string, data []byte, preconditions ...Precondition) error {
+	return t.SetWithTTL(key, data, 0, preconditions...)
+}
+
+func (t *SearchTx) SetWithTTL(key string, data []byte, ttl time.Duration, preconditions ...Precondition) error {
+	err := t.Tx.SetWithTTL(key, data, ttl, preconditions...)
+	if err == nil {
+		t.record(key, data)
+	}
+	return err
+}
+
+func (t *SearchTx) Update(key string, data []byte, preconditions ...Precondition) error {
+	if err := t.Tx.Update(key, data, preconditions...); err != nil {
+		return err
+	}
+	if !t.searcher.Indexed(key) {
+		return nil
+	}
+	// Record the merged document rather than the patch.
+	merged, err := t.Tx.Get(key)
+	if err != nil {
+		return err
+	}
+	t.record(key, merged)
+	return nil
+}
+
+func (t *SearchTx) Delete(key string, preconditions ...Precondition) error {
+	err := t.Tx.Delete(key, preconditions...)
+	if err == nil {
+		t.record(key, nil)
+	}
+	return err
+}
+
+func (t *SearchTx) Add(collectionKey string, data []byte) (string, error) {
+	return t.AddWithTTL(collectionKey, data, 0)
+}
+
+func (t *SearchTx) AddWithTTL(collectionKey string, data []byte, ttl time.Duration) (string, error) {
+	key, err := t.Tx.AddWithTTL(collectionKey, data, ttl)
+	if err == nil {
+		t.record(key, data)
+	}
+	return key, err
+}
+
+func (t *SearchTx) record(key string, data []byte) {
+	if !t.searcher.Indexed(key) {
+		return
+	}
+	if _, exists := t.changes[key]; !exists {
+		t.keys = append(t.keys, key)
+	}
+	t.changes[key] = data
+}
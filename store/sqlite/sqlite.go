@@ -0,0 +1,1039 @@
+package sqlite
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"github.com/imba3r/thunder/store"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS documents (
+	key         TEXT PRIMARY KEY,
+	collection  TEXT NOT NULL,
+	value       TEXT NOT NULL,
+	version     INTEGER NOT NULL DEFAULT 0,
+	create_time INTEGER NOT NULL DEFAULT 0,
+	update_time INTEGER NOT NULL DEFAULT 0,
+	expire_time INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS documents_collection ON documents (collection, key);
+CREATE INDEX IF NOT EXISTS documents_expire_time ON documents (expire_time) WHERE expire_time > 0;
+CREATE TABLE IF NOT EXISTS sequences (
+	collection TEXT PRIMARY KEY,
+	next       INTEGER NOT NULL
+);`
+
+// Documents are stored as JSON text in a single table next to the key of
+// their collection. Queries, ordering and limits of collection items are
+// translated into json_extract based SQL so they can be served by SQLite.
+type sqliteStore struct {
+	path string
+	enc  store.Encoding
+
+	db       *sql.DB
+	sweeper  *store.Sweeper
+	searcher *store.Searcher
+}
+
+type document struct {
+	key   string
+	store *sqliteStore
+}
+
+type collection struct {
+	key   string
+	store *sqliteStore
+}
+
+type collectionGroup struct {
+	name  string
+	store *sqliteStore
+}
+
+type tx struct {
+	tx *sql.Tx
+}
+
+var _ store.Store = &sqliteStore{}
+var _ store.Tx = &tx{}
+
+func New(path string) store.Store {
+	ss := &sqliteStore{path: path}
+	ss.sweeper = store.NewSweeper(ss.sweep)
+	ss.searcher = store.NewSearcher()
+	ss.sweeper.OnExpire(ss.searcher.Remove)
+	return ss
+}
+
+func (ss *sqliteStore) Open(enc store.Encoding) error {
+	db, err := sql.Open("sqlite", ss.path)
+	if err != nil {
+		return err
+	}
+	// SQLite allows a single writer only, serialize access to avoid
+	// SQLITE_BUSY errors between pooled connections.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return err
+	}
+
+	ss.enc = enc
+	ss.db = db
+	ss.sweeper.Start()
+	return nil
+}
+
+func (ss *sqliteStore) Document(key string) (store.Document, error) {
+	if store.IsDocumentKey(key) {
+		return &document{key, ss}, nil
+	}
+	return nil, fmt.Errorf("not a document path: %s", key)
+}
+
+func (ss *sqliteStore) Collection(key string) (store.Collection, error) {
+	if store.IsCollectionKey(key) {
+		return &collection{key, ss}, nil
+	}
+	return nil, fmt.Errorf("not a collection path: %s", key)
+}
+
+func (ss *sqliteStore) CollectionGroup(name string) (store.CollectionGroup, error) {
+	if store.IsCollectionGroupName(name) {
+		return &collectionGroup{name, ss}, nil
+	}
+	return nil, fmt.Errorf("not a collection group name: %s", name)
+}
+
+func (ss *sqliteStore) RunTransaction(f func(tx store.Tx) error) error {
+	sqlTx, err := ss.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer sqlTx.Rollback()
+
+	t := ss.searcher.Tx(&tx{sqlTx})
+	if err := f(t); err != nil {
+		return err
+	}
+	if err := sqlTx.Commit(); err != nil {
+		return err
+	}
+	t.Commit()
+	return nil
+}
+
+func (ss *sqliteStore) RootCollections() ([]string, error) {
+	return ss.collections("")
+}
+
+// collections returns the keys of the collections directly below the given
+// document key, or at the root if it is empty. It looks up the first key of
+// every collection in turn, skipping the remaining keys of the collection.
+func (ss *sqliteStore) collections(parentKey string) ([]string, error) {
+	stmt := `SELECT key FROM documents WHERE key >= ? ORDER BY key LIMIT 1`
+	var from, to string
+	if parentKey != "" {
+		stmt = `SELECT key FROM documents WHERE key >= ? AND key < ? ORDER BY key LIMIT 1`
+		from, to = descendantRange(parentKey)
+	}
+	var keys []string
+	for {
+		args := []interface{}{from}
+		if parentKey != "" {
+			args = append(args, to)
+		}
+		var key string
+		err := ss.db.QueryRow(stmt, args...).Scan(&key)
+		if err == sql.ErrNoRows {
+			return keys, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		collectionKey := store.ChildCollectionKey(key, parentKey)
+		keys = append(keys, collectionKey)
+		_, from = descendantRange(collectionKey)
+	}
+}
+
+func (ss *sqliteStore) OnExpire(f func(key string)) {
+	ss.sweeper.OnExpire(f)
+}
+
+func (ss *sqliteStore) EnableSearch(collectionKey string, fields ...string) error {
+	c, err := ss.Collection(collectionKey)
+	if err != nil {
+		return err
+	}
+	return ss.searcher.Enable(collectionKey, fields, c.Items)
+}
+
+func (ss *sqliteStore) Close() {
+	ss.sweeper.Stop()
+	ss.db.Close()
+}
+
+// sweep removes the documents that have expired by now.
+func (ss *sqliteStore) sweep(now time.Time) ([]string, error) {
+	return deleteKeys(ss.db,
+		`DELETE FROM documents WHERE expire_time > 0 AND expire_time <= ? RETURNING key`, now.UnixNano())
+}
+
+func (d *document) Key() string {
+	return d.key
+}
+
+func (d *document) Get(fields ...string) ([]byte, error) {
+	data, _, err := d.GetWithMetadata()
+	if err != nil {
+		return nil, err
+	}
+	return store.ProjectJSON(data, fields), nil
+}
+
+func (d *document) GetWithMetadata() ([]byte, store.Metadata, error) {
+	data, meta, err := get(d.store.db, d.key)
+	if err != nil {
+		return nil, store.Metadata{}, err
+	}
+	if meta == nil {
+		return nil, store.Metadata{}, &store.NotFoundError{Key: d.key}
+	}
+	return data, *meta, nil
+}
+
+func (d *document) Set(data []byte, preconditions ...store.Precondition) error {
+	return d.store.RunTransaction(func(tx store.Tx) error {
+		return tx.Set(d.key, data, preconditions...)
+	})
+}
+
+func (d *document) SetWithTTL(data []byte, ttl time.Duration, preconditions ...store.Precondition) error {
+	return d.store.RunTransaction(func(tx store.Tx) error {
+		return tx.SetWithTTL(d.key, data, ttl, preconditions...)
+	})
+}
+
+func (d *document) Update(data []byte, preconditions ...store.Precondition) error {
+	return d.store.RunTransaction(func(tx store.Tx) error {
+		return tx.Update(d.key, data, preconditions...)
+	})
+}
+
+func (d *document) Delete(preconditions ...store.Precondition) error {
+	return d.store.RunTransaction(func(tx store.Tx) error {
+		return tx.Delete(d.key, preconditions...)
+	})
+}
+
+func (d *document) DeleteRecursive(preconditions ...store.Precondition) ([]string, error) {
+	sqlTx, err := d.store.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer sqlTx.Rollback()
+
+	_, meta, err := (&tx{sqlTx}).get(d.key)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.CheckPreconditions(d.key, meta, preconditions); err != nil {
+		return nil, err
+	}
+	from, to := descendantRange(d.key)
+	keys, err := deleteKeys(sqlTx,
+		`DELETE FROM documents WHERE key = ? OR (key >= ? AND key < ?) RETURNING key`, d.key, from, to)
+	if err != nil {
+		return nil, err
+	}
+	if err := sqlTx.Commit(); err != nil {
+		return keys, err
+	}
+	for _, key := range keys {
+		d.store.searcher.Remove(key)
+	}
+	return keys, nil
+}
+
+func (d *document) Collections() ([]string, error) {
+	return d.store.collections(d.key)
+}
+
+// execer is implemented by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// deleteKeys runs a DELETE statement returning the keys of the deleted
+// documents and returns them.
+func deleteKeys(db execer, stmt string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// descendantRange returns the range of keys lying below the given key. As
+// keys are compared bytewise, the keys starting with "<key>/" sort before
+// "<key>0", '0' being the character following '/'.
+func descendantRange(key string) (string, string) {
+	return key + "/", key + "0"
+}
+
+// get returns the data and metadata of the document or nil metadata if it
+// does not exist or has expired.
+func get(db execer, key string) ([]byte, *store.Metadata, error) {
+	var value []byte
+	var meta store.Metadata
+	var createTime, updateTime, expireTime int64
+	err := db.QueryRow(`SELECT value, version, create_time, update_time, expire_time FROM documents WHERE key = ?`, key).
+		Scan(&value, &meta.Version, &createTime, &updateTime, &expireTime)
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	meta.CreateTime = fromUnixNano(createTime)
+	meta.UpdateTime = fromUnixNano(updateTime)
+	meta.ExpireTime = fromUnixNano(expireTime)
+	if meta.Expired(time.Now()) {
+		return nil, nil, nil
+	}
+	return value, &meta, nil
+}
+
+func put(db execer, key string, data []byte, meta store.Metadata) error {
+	_, err := db.Exec(
+		`INSERT INTO documents (key, collection, value, version, create_time, update_time, expire_time) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value, version = excluded.version,
+			create_time = excluded.create_time, update_time = excluded.update_time, expire_time = excluded.expire_time`,
+		key, store.CollectionKey(key), string(data), meta.Version,
+		toUnixNano(meta.CreateTime), toUnixNano(meta.UpdateTime), toUnixNano(meta.ExpireTime))
+	return err
+}
+
+// Timestamps are stored as nanoseconds since the epoch, zero stands for
+// the zero time of documents written without metadata.
+func toUnixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n).UTC()
+}
+
+func (t *tx) Get(key string) ([]byte, error) {
+	data, _, err := t.GetWithMetadata(key)
+	return data, err
+}
+
+func (t *tx) GetWithMetadata(key string) ([]byte, store.Metadata, error) {
+	data, meta, err := t.get(key)
+	if err != nil {
+		return nil, store.Metadata{}, err
+	}
+	if meta == nil {
+		return nil, store.Metadata{}, &store.NotFoundError{Key: key}
+	}
+	return data, *meta, nil
+}
+
+func (t *tx) get(key string) ([]byte, *store.Metadata, error) {
+	if !store.IsDocumentKey(key) {
+		return nil, nil, fmt.Errorf("not a document path: %s", key)
+	}
+	return get(t.tx, key)
+}
+
+func (t *tx) Set(key string, data []byte, preconditions ...store.Precondition) error {
+	return t.SetWithTTL(key, data, 0, preconditions...)
+}
+
+func (t *tx) SetWithTTL(key string, data []byte, ttl time.Duration, preconditions ...store.Precondition) error {
+	_, meta, err := t.get(key)
+	if err != nil {
+		return err
+	}
+	if err := store.CheckPreconditions(key, meta, preconditions); err != nil {
+		return err
+	}
+	return put(t.tx, key, data, store.NextMetadataWithTTL(meta, ttl))
+}
+
+func (t *tx) Update(key string, data []byte, preconditions ...store.Precondition) error {
+	value, meta, err := t.get(key)
+	if err != nil {
+		return err
+	}
+	if err := store.CheckPreconditions(key, meta, preconditions); err != nil {
+		return err
+	}
+	if meta == nil {
+		return &store.NotFoundError{Key: key}
+	}
+	merged, err := store.MergeJSON(value, data)
+	if err != nil {
+		return err
+	}
+	return put(t.tx, key, merged, store.NextMetadata(meta))
+}
+
+func (t *tx) Delete(key string, preconditions ...store.Precondition) error {
+	_, meta, err := t.get(key)
+	if err != nil {
+		return err
+	}
+	if err := store.CheckPreconditions(key, meta, preconditions); err != nil {
+		return err
+	}
+	_, err = t.tx.Exec(`DELETE FROM documents WHERE key = ?`, key)
+	return err
+}
+
+func (t *tx) Add(collectionKey string, data []byte) (string, error) {
+	return t.AddWithTTL(collectionKey, data, 0)
+}
+
+func (t *tx) AddWithTTL(collectionKey string, data []byte, ttl time.Duration) (string, error) {
+	if !store.IsCollectionKey(collectionKey) {
+		return "", fmt.Errorf("not a collection path: %s", collectionKey)
+	}
+	// Like badger sequences, the first value handed out is zero. Skip the
+	// IDs of documents that have been set explicitly.
+	for {
+		var num uint64
+		err := t.tx.QueryRow(
+			`INSERT INTO sequences (collection, next) VALUES (?, 1)
+			ON CONFLICT (collection) DO UPDATE SET next = next + 1
+			RETURNING next - 1`, collectionKey).Scan(&num)
+		if err != nil {
+			return "", err
+		}
+		key := fmt.Sprintf("%s/%d", collectionKey, num)
+		_, meta, err := t.get(key)
+		if err != nil {
+			return "", err
+		}
+		if meta == nil {
+			return key, put(t.tx, key, data, store.NextMetadataWithTTL(nil, ttl))
+		}
+	}
+}
+
+func (c *collection) Key() string {
+	return c.key
+}
+
+func (c *collection) Add(data []byte) (store.Document, error) {
+	return c.AddWithTTL(data, 0)
+}
+
+func (c *collection) AddWithTTL(data []byte, ttl time.Duration) (store.Document, error) {
+	var key string
+	err := c.store.RunTransaction(func(tx store.Tx) error {
+		var err error
+		key, err = tx.AddWithTTL(c.key, data, ttl)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.store.Document(key)
+}
+
+func (c *collection) Delete(recursive bool) ([]string, error) {
+	var keys []string
+	var err error
+	if recursive {
+		from, to := descendantRange(c.key)
+		keys, err = deleteKeys(c.store.db, `DELETE FROM documents WHERE key >= ? AND key < ? RETURNING key`, from, to)
+	} else {
+		keys, err = deleteKeys(c.store.db, `DELETE FROM documents WHERE collection = ? RETURNING key`, c.key)
+	}
+	for _, key := range keys {
+		c.store.searcher.Remove(key)
+	}
+	return keys, err
+}
+
+func (c *collection) Items(q store.Query, o store.Order, l store.Limit, fields ...string) ([]store.CollectionItem, error) {
+	items, _, err := selectItems(c.store.db, collectionScope(c.key), q, o, l, fields)
+	return items, err
+}
+
+// scope restricts statements to the documents of a collection or group.
+type scope struct {
+	where string
+	args  []interface{}
+}
+
+func collectionScope(collectionKey string) scope {
+	return scope{"collection = ?", []interface{}{collectionKey}}
+}
+
+// groupScope matches the collections named name, at the root or below a
+// document. SQLite's LIKE ignores case, so suffixes are compared instead.
+func groupScope(name string) scope {
+	suffix := "/" + name
+	return scope{"(collection = ? OR substr(collection, -length(?)) = ?)", []interface{}{name, suffix, suffix}}
+}
+
+// selectItems returns the items of the scope, projected to the fields, and
+// reports which parts of the query were translated into SQL.
+func selectItems(db *sql.DB, sc scope, q store.Query, o store.Order, l store.Limit, fields []string) ([]store.CollectionItem, store.Pushdown, error) {
+	var pushdown store.Pushdown
+	if err := q.Validate(); err != nil {
+		return nil, pushdown, err
+	}
+	if err := l.Validate(o); err != nil {
+		return nil, pushdown, err
+	}
+	sqlTx, err := db.Begin()
+	if err != nil {
+		return nil, pushdown, err
+	}
+	defer sqlTx.Rollback()
+
+	stmt := `SELECT key, value FROM documents WHERE ` + sc.where + ` AND (expire_time = 0 OR expire_time > ?)`
+	args := append(append([]interface{}{}, sc.args...), time.Now().UnixNano())
+
+	// Queries that can't be translated into SQL are evaluated once the
+	// documents have been read, along with the limit.
+	filter := false
+	if !q.IsEmpty() {
+		where, whereArgs, err := queryClause(q)
+		if err == nil {
+			var ok bool
+			ok, err = pushable(sqlTx, sc, queryFields(q))
+			if err == nil && !ok {
+				err = errNoPushdown
+			}
+		}
+		if err == errNoPushdown {
+			filter = true
+		} else if err != nil {
+			return nil, pushdown, err
+		} else {
+			stmt += " AND " + where
+			args = append(args, whereArgs...)
+		}
+	}
+	// So are orders by fields whose paths SQLite can't evaluate, see
+	// pushable, or holding arrays or objects, which SQLite compares as JSON
+	// text.
+	sortItems := false
+	if !o.IsEmpty() {
+		var fields []string
+		for _, field := range o.Fields() {
+			fields = append(fields, field.OrderBy)
+		}
+		ok, err := pushable(sqlTx, sc, fields)
+		if err != nil {
+			return nil, pushdown, err
+		}
+		sortItems = !ok
+		if ok {
+			sortItems, err = holdsContainers(sqlTx, sc, o)
+			if err != nil {
+				return nil, pushdown, err
+			}
+		}
+	}
+	// So are cursors holding arrays or objects, and the cursors of orders
+	// evaluated once the documents have been read.
+	limitItems := filter || sortItems
+	if !sortItems && (l.StartAt != nil || l.StartAfter != nil || l.EndAt != nil || l.EndBefore != nil) {
+		where, whereArgs, err := cursorClause(o, l)
+		if err == errNoPushdown {
+			limitItems = true
+		} else if err != nil {
+			return nil, pushdown, err
+		} else {
+			stmt += " AND " + where
+			args = append(args, whereArgs...)
+		}
+	}
+	if !o.IsEmpty() && !sortItems {
+		order, orderArgs := orderClause(o)
+		stmt += " ORDER BY " + order
+		args = append(args, orderArgs...)
+	} else {
+		stmt += " ORDER BY key"
+	}
+	if l != (store.Limit{}) && !limitItems {
+		// A negative limit lifts the limit in SQLite.
+		limit := l.Limit
+		if limit <= 0 {
+			limit = -1
+		}
+		stmt += " LIMIT ? OFFSET ?"
+		args = append(args, limit, l.Offset)
+	}
+
+	pushdown.Query = !q.IsEmpty() && !filter
+	pushdown.Order = !o.IsEmpty() && !sortItems
+	pushdown.Limit = l != (store.Limit{}) && !limitItems
+	pushdown.Statement = stmt
+	rows, err := sqlTx.Query(stmt, args...)
+	if err != nil {
+		return nil, pushdown, err
+	}
+	defer rows.Close()
+
+	var items []store.CollectionItem
+	for rows.Next() {
+		var item store.CollectionItem
+		if err := rows.Scan(&item.Key, &item.Value); err != nil {
+			return nil, pushdown, err
+		}
+		if filter && !store.MatchesJSON(item.Value, q) {
+			continue
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, pushdown, err
+	}
+	if sortItems {
+		store.OrderJSON(items, o)
+	}
+	if limitItems {
+		items = store.LimitItems(items, o, l)
+	}
+	return store.ProjectItems(items, fields), pushdown, nil
+}
+
+// Explain reports full scans, as SQLite evaluates queries against every
+// document of the collection in the absence of indexes on their fields,
+// along with the parts of the query that SQLite evaluates.
+func (c *collection) Explain(q store.Query, o store.Order, l store.Limit) (store.Explanation, error) {
+	return explain(c.store.db, collectionScope(c.key), q, o, l)
+}
+
+func (c *collection) Aggregate(q store.Query, groupBy []string, aggregations []store.Aggregation) ([]store.AggregateGroup, error) {
+	return store.Aggregate(c.Items, q, groupBy, aggregations)
+}
+
+func (c *collection) Search(text string, limit int) ([]store.SearchResult, error) {
+	return c.store.searcher.Search(c.key, text, limit, func(key string) ([]byte, error) {
+		return (&document{key, c.store}).Get()
+	})
+}
+
+func explain(db *sql.DB, sc scope, q store.Query, o store.Order, l store.Limit) (store.Explanation, error) {
+	items, pushdown, err := selectItems(db, sc, q, o, l, nil)
+	if err != nil {
+		return store.Explanation{}, err
+	}
+	explanation := store.Explanation{Scan: store.FullScan, Returned: len(items), Pushdown: &pushdown}
+	args := append(append([]interface{}{}, sc.args...), time.Now().UnixNano())
+	err = db.QueryRow(`SELECT COUNT(*) FROM documents WHERE `+sc.where+` AND (expire_time = 0 OR expire_time > ?)`,
+		args...).Scan(&explanation.Examined)
+	return explanation, err
+}
+
+func (g *collectionGroup) Name() string {
+	return g.name
+}
+
+func (g *collectionGroup) Items(q store.Query, o store.Order, l store.Limit, fields ...string) ([]store.CollectionItem, error) {
+	items, _, err := selectItems(g.store.db, groupScope(g.name), q, o, l, fields)
+	return items, err
+}
+
+func (g *collectionGroup) Explain(q store.Query, o store.Order, l store.Limit) (store.Explanation, error) {
+	return explain(g.store.db, groupScope(g.name), q, o, l)
+}
+
+func (g *collectionGroup) Aggregate(q store.Query, groupBy []string, aggregations []store.Aggregation) ([]store.AggregateGroup, error) {
+	return store.Aggregate(g.Items, q, groupBy, aggregations)
+}
+
+// typeRank mirrors the order of JSON types of store.CompareJSON. Missing
+// fields rank like null.
+const typeRank = `CASE json_type(value, ?)
+	WHEN 'true' THEN 1 WHEN 'false' THEN 1
+	WHEN 'integer' THEN 2 WHEN 'real' THEN 2
+	WHEN 'text' THEN 3 WHEN 'array' THEN 4 WHEN 'object' THEN 5
+	ELSE 0 END`
+
+// orderClause translates the order into an ORDER BY clause that sorts the
+// same way store.OrderJSON does, unless the fields hold arrays or objects.
+// Fields are sorted by the rank of their type first and then by their
+// value, booleans are extracted as 0 and 1.
+func orderClause(o store.Order) (string, []interface{}) {
+	var terms []string
+	var args []interface{}
+	for _, field := range o.Fields() {
+		direction := "ASC"
+		if !field.Ascending {
+			direction = "DESC"
+		}
+		terms = append(terms,
+			fmt.Sprintf("%s %s", typeRank, direction),
+			fmt.Sprintf("json_extract(value, ?) %s", direction))
+		path := jsonPath(field.OrderBy)
+		args = append(args, path, path)
+	}
+	return strings.Join(append(terms, "key"), ", "), args
+}
+
+// cursorClause translates the cursors of the limit into a clause matching
+// the items between them the way store.LimitItems does.
+func cursorClause(o store.Order, l store.Limit) (string, []interface{}, error) {
+	fields := o.Fields()
+	var clauses []string
+	var args []interface{}
+	for _, cursor := range []struct {
+		cursor           *store.Cursor
+		after, inclusive bool
+	}{
+		{l.StartAt, true, true},
+		{l.StartAfter, true, false},
+		{l.EndAt, false, true},
+		{l.EndBefore, false, false},
+	} {
+		if cursor.cursor == nil {
+			continue
+		}
+		clause, clauseArgs, err := beyondCursorClause(fields, cursor.cursor, cursor.after, cursor.inclusive)
+		if err != nil {
+			return "", nil, err
+		}
+		clauses = append(clauses, clause)
+		args = append(args, clauseArgs...)
+	}
+	return strings.Join(clauses, " AND "), args, nil
+}
+
+// beyondCursorClause returns a clause matching the items sorting after the
+// cursor, or before it unless after is set, and those at the cursor if
+// inclusive is set. Like orderClause it compares the rank of the type of
+// fields first and their values second.
+func beyondCursorClause(fields []store.Order, c *store.Cursor, after, inclusive bool) (string, []interface{}, error) {
+	var terms, equal []string
+	var args, equalArgs []interface{}
+	for f, v := range c.Values {
+		value, err := store.NormalizeJSON(v)
+		if err != nil {
+			return "", nil, err
+		}
+		rank, err := valueRank(value)
+		if err != nil {
+			return "", nil, err
+		}
+		pathArgs := []interface{}{jsonPath(fields[f].OrderBy)}
+		operator := store.Gt
+		if after != fields[f].Ascending {
+			operator = store.Lt
+		}
+		beyond, beyondArgs, err := compareClause("json_type(value, ?)", "json_extract(value, ?)", pathArgs, operator, value)
+		if err != nil {
+			return "", nil, err
+		}
+		term := fmt.Sprintf("(%s %s %d OR %s)", typeRank, operator, rank, beyond)
+		terms = append(terms, "("+strings.Join(append(equal, term), " AND ")+")")
+		args = append(append(append(args, equalArgs...), pathArgs...), beyondArgs...)
+
+		eq, eqArgs, err := compareClause("json_type(value, ?)", "json_extract(value, ?)", pathArgs, store.Eq, value)
+		if err != nil {
+			return "", nil, err
+		}
+		equal = append(equal, eq)
+		equalArgs = append(equalArgs, eqArgs...)
+	}
+	// Keys only break ties between items equal by all fields.
+	if c.Key != "" && len(c.Values) == len(fields) {
+		operator := ">"
+		if !after {
+			operator = "<"
+		}
+		if inclusive {
+			operator += "="
+		}
+		terms = append(terms, "("+strings.Join(append(equal, "key "+operator+" ?"), " AND ")+")")
+		args = append(append(args, equalArgs...), c.Key)
+	} else if inclusive && len(equal) > 0 {
+		terms = append(terms, "("+strings.Join(equal, " AND ")+")")
+		args = append(args, equalArgs...)
+	} else if inclusive {
+		terms = append(terms, "1")
+	}
+	if len(terms) == 0 {
+		return "0", nil, nil
+	}
+	return "(" + strings.Join(terms, " OR ") + ")", args, nil
+}
+
+// valueRank returns the rank of the type of the value within typeRank.
+func valueRank(value interface{}) (int, error) {
+	switch value.(type) {
+	case nil:
+		return 0, nil
+	case bool:
+		return 1, nil
+	case float64:
+		return 2, nil
+	case string:
+		return 3, nil
+	}
+	return 0, errNoPushdown
+}
+
+// holdsContainers reports whether any document of the scope holds an
+// array or object in one of the fields of the order.
+func holdsContainers(db execer, sc scope, o store.Order) (bool, error) {
+	var clauses []string
+	args := append([]interface{}{}, sc.args...)
+	for _, field := range o.Fields() {
+		clauses = append(clauses, "json_type(value, ?) IN ('array', 'object')")
+		args = append(args, jsonPath(field.OrderBy))
+	}
+	stmt := fmt.Sprintf(`SELECT EXISTS (SELECT 1 FROM documents WHERE %s AND (%s))`,
+		sc.where, strings.Join(clauses, " OR "))
+	var exists bool
+	err := db.QueryRow(stmt, args...).Scan(&exists)
+	return exists, err
+}
+
+// jsonPath translates a dotted field path into an SQLite JSON path. Its
+// labels are quoted but not escaped, see pushable.
+func jsonPath(field string) string {
+	segments := strings.Split(field, ".")
+	for i, segment := range segments {
+		segments[i] = `"` + segment + `"`
+	}
+	return "$." + strings.Join(segments, ".")
+}
+
+// pushable reports whether SQLite's JSON functions evaluate the paths of
+// the fields the way the gabs paths behind store.MatchesJSON and
+// store.OrderJSON do. Labels of SQLite JSON paths can't be escaped, and
+// gabs maps paths crossing arrays over their elements, where SQLite yields
+// NULL, so no document of the scope may hold an array along a path.
+func pushable(db execer, sc scope, fields []string) (bool, error) {
+	var clauses []string
+	args := append([]interface{}{}, sc.args...)
+	for _, field := range fields {
+		segments := strings.Split(field, ".")
+		for _, segment := range segments {
+			if segment == "" || strconv.Quote(segment) != `"`+segment+`"` {
+				return false, nil
+			}
+		}
+		for i := 1; i < len(segments); i++ {
+			clauses = append(clauses, "json_type(value, ?) = 'array'")
+			args = append(args, jsonPath(strings.Join(segments[:i], ".")))
+		}
+	}
+	if len(clauses) == 0 {
+		return true, nil
+	}
+	stmt := fmt.Sprintf(`SELECT EXISTS (SELECT 1 FROM documents WHERE %s AND (%s))`,
+		sc.where, strings.Join(clauses, " OR "))
+	var crosses bool
+	err := db.QueryRow(stmt, args...).Scan(&crosses)
+	return !crosses, err
+}
+
+// queryFields returns the fields compared by the query.
+func queryFields(q store.Query) []string {
+	var fields []string
+	if q.Field != "" {
+		fields = append(fields, q.Field)
+	}
+	for _, and := range q.And {
+		fields = append(fields, queryFields(and)...)
+	}
+	for _, or := range q.Or {
+		fields = append(fields, queryFields(or)...)
+	}
+	if q.Not != nil {
+		fields = append(fields, queryFields(*q.Not)...)
+	}
+	return fields
+}
+
+// queryClause translates the query into a WHERE clause that matches the
+// same documents store.MatchesJSON does.
+func queryClause(q store.Query) (string, []interface{}, error) {
+	var clauses []string
+	var args []interface{}
+	add := func(clause string, clauseArgs []interface{}) {
+		clauses = append(clauses, clause)
+		args = append(args, clauseArgs...)
+	}
+	if q.Field != "" || q.Operator != "" || q.Value != nil {
+		clause, clauseArgs, err := fieldClause(q)
+		if err != nil {
+			return "", nil, err
+		}
+		add(clause, clauseArgs)
+	}
+	for _, and := range q.And {
+		clause, clauseArgs, err := queryClause(and)
+		if err != nil {
+			return "", nil, err
+		}
+		add(clause, clauseArgs)
+	}
+	if len(q.Or) > 0 {
+		var or []string
+		var orArgs []interface{}
+		for _, q := range q.Or {
+			clause, clauseArgs, err := queryClause(q)
+			if err != nil {
+				return "", nil, err
+			}
+			or = append(or, clause)
+			orArgs = append(orArgs, clauseArgs...)
+		}
+		add("("+strings.Join(or, " OR ")+")", orArgs)
+	}
+	if q.Not != nil {
+		clause, clauseArgs, err := queryClause(*q.Not)
+		if err != nil {
+			return "", nil, err
+		}
+		add("NOT "+clause, clauseArgs)
+	}
+	if len(clauses) == 0 {
+		return "1", nil, nil
+	}
+	return "(" + strings.Join(clauses, " AND ") + ")", args, nil
+}
+
+// errNoPushdown is returned for queries that can't be translated into SQL,
+// which are evaluated by store.MatchesJSON instead.
+var errNoPushdown = errors.New("query can't be translated into SQL")
+
+// fieldClause translates the comparison of the query into a clause that
+// is never NULL.
+func fieldClause(q store.Query) (string, []interface{}, error) {
+	value, err := store.NormalizeJSON(q.Value)
+	if err != nil {
+		return "", nil, err
+	}
+	pathArgs := []interface{}{jsonPath(q.Field)}
+	switch q.Operator {
+	case store.Eq, store.Lt, store.Le, store.Gt, store.Ge:
+		return compareClause("json_type(value, ?)", "json_extract(value, ?)", pathArgs, q.Operator, value)
+	case store.Ne:
+		clause, args, err := compareClause("json_type(value, ?)", "json_extract(value, ?)", pathArgs, store.Eq, value)
+		return "NOT " + clause, args, err
+	case store.In, store.NotIn:
+		clause, args, err := equalsAnyClause("json_type(value, ?)", "json_extract(value, ?)", pathArgs, value.([]interface{}))
+		if q.Operator == store.NotIn {
+			clause = "NOT " + clause
+		}
+		return clause, args, err
+	case store.ArrayContains, store.ArrayContainsAny:
+		values := []interface{}{value}
+		if q.Operator == store.ArrayContainsAny {
+			values = value.([]interface{})
+		}
+		// The elements of the array are compared like fields.
+		elementClause, elementArgs, err := equalsAnyClause("element.type", "element.atom", nil, values)
+		if err != nil {
+			return "", nil, err
+		}
+		clause := "COALESCE(json_type(value, ?) = 'array' AND EXISTS (SELECT 1 FROM json_each(documents.value, ?) AS element WHERE " + elementClause + "), 0)"
+		return clause, append(append(pathArgs, pathArgs...), elementArgs...), nil
+	case store.Prefix:
+		clause := "COALESCE(json_type(value, ?) = 'text' AND substr(json_extract(value, ?), 1, length(?)) = ?, 0)"
+		return clause, []interface{}{pathArgs[0], pathArgs[0], value, value}, nil
+	case store.FieldExists:
+		clause := "COALESCE(json_type(value, ?) IS NOT NULL AND json_type(value, ?) != 'null', 0)"
+		if value == false {
+			clause = "NOT " + clause
+		}
+		return clause, append(pathArgs, pathArgs...), nil
+	}
+	return "", nil, fmt.Errorf("illegal operator: %s", q.Operator)
+}
+
+// equalsAnyClause returns a clause matching values equal to any of the
+// given ones, see compareClause.
+func equalsAnyClause(typeExpr, valueExpr string, exprArgs []interface{}, values []interface{}) (string, []interface{}, error) {
+	if len(values) == 0 {
+		return "0", nil, nil
+	}
+	var clauses []string
+	var args []interface{}
+	for _, value := range values {
+		clause, clauseArgs, err := compareClause(typeExpr, valueExpr, exprArgs, store.Eq, value)
+		if err != nil {
+			return "", nil, err
+		}
+		clauses = append(clauses, clause)
+		args = append(args, clauseArgs...)
+	}
+	return "(" + strings.Join(clauses, " OR ") + ")", args, nil
+}
+
+// compareClause returns a clause comparing the JSON type and value given
+// by the expressions to the query value the way store.MatchesJSON does.
+// exprArgs are the arguments of each of the expressions. The clause is
+// never NULL. Arrays and objects can't be compared in SQL.
+func compareClause(typeExpr, valueExpr string, exprArgs []interface{}, operator store.Operator, value interface{}) (string, []interface{}, error) {
+	sqlOperator := string(operator)
+	if operator == store.Eq {
+		sqlOperator = "="
+	}
+	var args []interface{}
+	expr := func(expr string) string {
+		args = append(args, exprArgs...)
+		return expr
+	}
+	var clause string
+	switch value := value.(type) {
+	case nil:
+		// Missing fields equal null, null doesn't sort before or after
+		// itself.
+		if operator == store.Lt || operator == store.Gt {
+			return "0", nil, nil
+		}
+		clause = fmt.Sprintf("%s IS NULL OR %s = 'null'", expr(typeExpr), expr(typeExpr))
+	case bool:
+		// SQLite represents booleans as 0 and 1.
+		clause = fmt.Sprintf("%s IN ('true', 'false') AND %s %s ?", expr(typeExpr), expr(valueExpr), sqlOperator)
+		args = append(args, value)
+	case float64:
+		clause = fmt.Sprintf("%s IN ('integer', 'real') AND %s %s ?", expr(typeExpr), expr(valueExpr), sqlOperator)
+		args = append(args, value)
+	case string:
+		clause = fmt.Sprintf("%s = 'text' AND %s %s ?", expr(typeExpr), expr(valueExpr), sqlOperator)
+		args = append(args, value)
+	default:
+		return "", nil, errNoPushdown
+	}
+	return "COALESCE(" + clause + ", 0)", args, nil
+}
@@ -0,0 +1,102 @@
+package sqlite_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/imba3r/thunder/store"
+	"github.com/imba3r/thunder/store/sqlite"
+	"github.com/imba3r/thunder/store/storetest"
+)
+
+func TestConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thunder-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	n := 0
+	storetest.RunConformance(t, func() store.Store {
+		n++
+		return sqlite.New(filepath.Join(dir, fmt.Sprintf("%d.db", n)))
+	})
+}
+
+func TestExplainPushdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thunder-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := sqlite.New(filepath.Join(dir, "test.db"))
+	if err := s.Open(store.Json); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	b := store.NewBatch()
+	b.Set("users/1", []byte(`{"age":30,"tags":["a"],"address":{"city":"Berlin"}}`))
+	b.Set("users/2", []byte(`{"age":25,"tags":["b"],"address":{"city":"Paris"}}`))
+	b.Set("users/3", []byte(`{"age":30,"tags":["c"],"address":{"city":"Rome"}}`))
+	if _, err := b.Commit(s); err != nil {
+		t.Fatal(err)
+	}
+	c, _ := s.Collection("users")
+
+	tests := []struct {
+		query    store.Query
+		order    store.Order
+		limit    store.Limit
+		pushdown store.Pushdown
+		returned int
+	}{
+		{store.Query{Field: "age", Operator: store.Eq, Value: 30}, store.Order{OrderBy: "age", Ascending: true},
+			store.Limit{Limit: 1}, store.Pushdown{Query: true, Order: true, Limit: true}, 1},
+		// Comparisons with arrays and orders by objects are evaluated
+		// on the documents read, and so is the limit then.
+		{store.Query{Field: "tags", Operator: store.Eq, Value: []interface{}{"a"}}, store.Order{},
+			store.Limit{}, store.Pushdown{}, 1},
+		{store.Query{}, store.Order{OrderBy: "address", Ascending: false},
+			store.Limit{Limit: 2}, store.Pushdown{}, 2},
+		// So are paths through arrays and fields whose names SQLite JSON
+		// paths can't express, but not paths through objects.
+		{store.Query{Field: "address.city", Operator: store.Eq, Value: "Rome"}, store.Order{},
+			store.Limit{}, store.Pushdown{Query: true}, 1},
+		{store.Query{Field: "tags.name", Operator: store.Eq, Value: "a"}, store.Order{},
+			store.Limit{}, store.Pushdown{}, 0},
+		{store.Query{Field: `say "hi"`, Operator: store.Eq, Value: "x"}, store.Order{},
+			store.Limit{}, store.Pushdown{}, 0},
+	}
+	for i, test := range tests {
+		explanation, err := c.Explain(test.query, test.order, test.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if explanation.Scan != store.FullScan || explanation.Returned != test.returned || explanation.Pushdown == nil {
+			t.Fatalf("%d: expected full scan returning %d items with pushdown, got %+v", i, test.returned, explanation)
+		}
+		pushdown := *explanation.Pushdown
+		if !strings.HasPrefix(pushdown.Statement, "SELECT key, value FROM documents WHERE ") {
+			t.Errorf("%d: expected SELECT statement, got %q", i, pushdown.Statement)
+		}
+		pushdown.Statement = ""
+		if pushdown != test.pushdown {
+			t.Errorf("%d: expected pushdown %+v, got %+v", i, test.pushdown, pushdown)
+		}
+		if test.pushdown.Query && !strings.Contains(explanation.Pushdown.Statement, "json_extract(value, ?) = ?") {
+			t.Errorf("%d: expected query in statement, got %q", i, explanation.Pushdown.Statement)
+		}
+		if test.pushdown.Order && !strings.Contains(explanation.Pushdown.Statement, "ORDER BY CASE json_type") {
+			t.Errorf("%d: expected order in statement, got %q", i, explanation.Pushdown.Statement)
+		}
+		if test.pushdown.Limit && !strings.HasSuffix(explanation.Pushdown.Statement, "LIMIT ? OFFSET ?") {
+			t.Errorf("%d: expected limit in statement, got %q", i, explanation.Pushdown.Statement)
+		}
+	}
+}
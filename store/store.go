@@ -2,6 +2,7 @@ package store
 
 import (
 	"encoding/json"
+	"time"
 )
 
 type Encoding string
@@ -14,21 +15,88 @@ type Store interface {
 	Open(enc Encoding) error
 	Document(key string) (Document, error)
 	Collection(key string) (Collection, error)
+	// CollectionGroup returns the group of all collections whose key ends
+	// with the given name, e.g. "users/1/posts/2/comments" for "comments".
+	CollectionGroup(name string) (CollectionGroup, error)
+	// RunTransaction runs the function within a transaction, which is
+	// committed if the function returns nil and rolled back otherwise.
+	// The function may be called more than once if the transaction
+	// conflicts with another one and has to be retried.
+	RunTransaction(f func(tx Tx) error) error
+	// OnExpire registers a function to be called with the key of every
+	// document that has been removed because its time-to-live elapsed.
+	OnExpire(f func(key string))
+	// RootCollections returns the keys of the collections at the root in
+	// lexicographic order.
+	RootCollections() ([]string, error)
+	// EnableSearch indexes the text of the given fields of the documents
+	// of the collection for full-text search, see Collection.Search. The
+	// index is kept in memory, built from the documents of the collection
+	// when search is enabled and maintained on every write from then on.
+	EnableSearch(collectionKey string, fields ...string) error
 	Close()
 }
 
+// Document writes accept preconditions, which fail the write with a
+// *ConflictError unless they hold.
 type Document interface {
 	Key() string
-	Get() ([]byte, error)
-	Set(data []byte) error
-	Update(data []byte) error
-	Delete() error
+	// Get returns the document, projected to the given fields if any, see
+	// ProjectJSON.
+	Get(fields ...string) ([]byte, error)
+	GetWithMetadata() ([]byte, Metadata, error)
+	Set(data []byte, preconditions ...Precondition) error
+	// SetWithTTL sets the document like Set, but the document expires
+	// once the time-to-live has elapsed. Expired documents are treated as
+	// absent and removed shortly after.
+	SetWithTTL(data []byte, ttl time.Duration, preconditions ...Precondition) error
+	// Update merges the data into the existing document as described by
+	// MergeJSON. It returns a *NotFoundError if the document is absent.
+	// Updates keep the expiration time of the document.
+	Update(data []byte, preconditions ...Precondition) error
+	Delete(preconditions ...Precondition) error
+	// DeleteRecursive deletes the document along with all documents of its
+	// subcollections and returns the keys of the deleted documents. The
+	// preconditions apply to the document itself.
+	DeleteRecursive(preconditions ...Precondition) ([]string, error)
+	// Collections returns the keys of the subcollections of the document
+	// in lexicographic order. Collections exist as long as documents lie
+	// below them, whether the document itself exists or not.
+	Collections() ([]string, error)
 }
 
 type Collection interface {
 	Key() string
-	Items(Query, Order, Limit) ([]CollectionItem, error)
+	// Items returns the items matching the query in the given order, of
+	// which the limit selects some. Their values are projected to the
+	// given fields if any, see ProjectJSON.
+	Items(q Query, o Order, l Limit, fields ...string) ([]CollectionItem, error)
+	// Explain reads the items like Items does and reports how they were
+	// read instead of returning them.
+	Explain(Query, Order, Limit) (Explanation, error)
+	// Aggregate computes the aggregations over the documents matching the
+	// query, grouped by the values of the group-by fields.
+	Aggregate(q Query, groupBy []string, aggregations []Aggregation) ([]AggregateGroup, error)
+	// Search returns at most limit documents matching any word of the
+	// text in the fields of the collection's search index, ranked by
+	// relevance, or all of them if limit is zero. It returns an error if
+	// search hasn't been enabled for the collection, see EnableSearch.
+	Search(text string, limit int) ([]SearchResult, error)
 	Add(data []byte) (Document, error)
+	AddWithTTL(data []byte, ttl time.Duration) (Document, error)
+	// Delete deletes all documents of the collection and, if recursive,
+	// the documents of their subcollections. It returns the keys of the
+	// deleted documents. Large collections may not be deleted atomically.
+	Delete(recursive bool) ([]string, error)
+}
+
+// CollectionGroup reads the documents of all collections with the same name
+// at once. Items of different collections are told apart by their keys.
+type CollectionGroup interface {
+	Name() string
+	Items(q Query, o Order, l Limit, fields ...string) ([]CollectionItem, error)
+	Explain(Query, Order, Limit) (Explanation, error)
+	Aggregate(q Query, groupBy []string, aggregations []Aggregation) ([]AggregateGroup, error)
 }
 
 type CollectionItem struct {
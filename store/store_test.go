@@ -1,6 +1,9 @@
 package store_test
 
 import (
+	"bytes"
+	"reflect"
+	"strings"
 	"testing"
 	"encoding/json"
 	"github.com/imba3r/thunder/store"
@@ -11,7 +14,7 @@ func TestMatchesJSON_Float(t *testing.T) {
 	data, _ := json.Marshal(test)
 
 	matches := store.MatchesJSON(data, store.Query{
-		Value:    "1234",
+		Value:    1234,
 		Operator: store.Eq,
 		Field:    "Test",
 	})
@@ -41,7 +44,7 @@ func TestMatchesJSON_Nil(t *testing.T) {
 	data, _ := json.Marshal(test)
 
 	matches := store.MatchesJSON(data, store.Query{
-		Value:    "",
+		Value:    nil,
 		Operator: store.Eq,
 		Field:    "Test",
 	})
@@ -50,3 +53,453 @@ func TestMatchesJSON_Nil(t *testing.T) {
 		t.Errorf("Expected test data to match...")
 	}
 }
+
+func TestMatchesJSON_Typed(t *testing.T) {
+	data := []byte(`{"b":true,"n":null,"a":[1,{"x":"y"}],"o":{"x":[1]}}`)
+	tests := []struct {
+		query   store.Query
+		matches bool
+	}{
+		{store.Query{Field: "b", Operator: store.Eq, Value: true}, true},
+		{store.Query{Field: "b", Operator: store.Eq, Value: "true"}, false},
+		{store.Query{Field: "n", Operator: store.Eq, Value: nil}, true},
+		{store.Query{Field: "n", Operator: store.Eq, Value: 0}, false},
+		{store.Query{Field: "a", Operator: store.Eq, Value: json.RawMessage(`[1,{"x":"y"}]`)}, true},
+		{store.Query{Field: "a", Operator: store.Eq, Value: json.RawMessage(`[{"x":"y"},1]`)}, false},
+		{store.Query{Field: "o", Operator: store.Eq, Value: map[string][]int{"x": {1}}}, true},
+		{store.Query{Field: "o", Operator: store.Gt, Value: 1}, false},
+		{store.Query{Field: "b", Operator: store.Lt, Value: 1}, false},
+	}
+	for _, test := range tests {
+		if store.MatchesJSON(data, test.query) != test.matches {
+			t.Errorf("Expected %+v to match %v", test.query, test.matches)
+		}
+	}
+}
+
+func TestCompareJSON(t *testing.T) {
+	// Values in ascending order.
+	values := []string{
+		`null`, `false`, `true`, `-1`, `0`, `1.5`, `""`, `"a"`, `"b"`,
+		`[]`, `[1]`, `[1,2]`, `[2]`, `{}`, `{"a":1}`, `{"a":2}`, `{"b":0}`,
+	}
+	decoded := make([]interface{}, len(values))
+	for i, value := range values {
+		if err := json.Unmarshal([]byte(value), &decoded[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range decoded {
+		for j := range decoded {
+			expected := 0
+			if i < j {
+				expected = -1
+			} else if i > j {
+				expected = 1
+			}
+			if actual := store.CompareJSON(decoded[i], decoded[j]); actual != expected {
+				t.Errorf("CompareJSON(%s, %s): expected %d, got %d", values[i], values[j], expected, actual)
+			}
+		}
+	}
+}
+
+func TestMergeJSON(t *testing.T) {
+	tests := []struct {
+		target, patch, expected string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+		{`{"a":{"b":1,"c":2}}`, `{"a.b":3}`, `{"a":{"b":3,"c":2}}`},
+		{`{"a":{"b":1,"c":2}}`, `{"a.b":null}`, `{"a":{"c":2}}`},
+		{`{"a":1}`, `{"a.b.c":2}`, `{"a":{"b":{"c":2}}}`},
+		{`{"a":12345678901234567890}`, `{"b":1}`, `{"a":12345678901234567890,"b":1}`},
+	}
+	for _, test := range tests {
+		merged, err := store.MergeJSON([]byte(test.target), []byte(test.patch))
+		if err != nil {
+			t.Errorf("MergeJSON(%s, %s): %v", test.target, test.patch, err)
+			continue
+		}
+		if string(merged) != test.expected {
+			t.Errorf("MergeJSON(%s, %s): expected %s, got %s", test.target, test.patch, test.expected, merged)
+		}
+	}
+}
+
+func TestEncodeRecord(t *testing.T) {
+	meta := store.Metadata{Version: 42}
+	record, err := store.EncodeRecord(meta, []byte(`{"a":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodedMeta, data, err := store.DecodeRecord(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decodedMeta != meta || string(data) != `{"a":1}` {
+		t.Errorf("Expected record to round trip, got %v %s", decodedMeta, data)
+	}
+
+	// Values written without metadata are returned as they are.
+	decodedMeta, data, err = store.DecodeRecord([]byte(`{"a":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decodedMeta != (store.Metadata{}) || string(data) != `{"a":1}` {
+		t.Errorf("Expected plain value, got %v %s", decodedMeta, data)
+	}
+}
+
+func TestChildCollectionKey(t *testing.T) {
+	tests := []struct {
+		documentKey string
+		parentKey   string
+		expected    string
+	}{
+		{"users/1", "", "users"},
+		{"users/1/posts/2", "", "users"},
+		{"users/1/posts/2", "users/1", "users/1/posts"},
+		{"users/1/posts/2/comments/3", "users/1", "users/1/posts"},
+	}
+	for _, test := range tests {
+		actual := store.ChildCollectionKey(test.documentKey, test.parentKey)
+		if actual != test.expected {
+			t.Errorf("Expected %q below %q to be in %q, got %q", test.documentKey, test.parentKey, test.expected, actual)
+		}
+	}
+}
+
+func TestCursorJSON(t *testing.T) {
+	cursor := store.Cursor{Values: []interface{}{1.0, "a"}, Key: "items/1"}
+	token, err := json.Marshal(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromToken store.Cursor
+	if err := json.Unmarshal(token, &fromToken); err != nil {
+		t.Fatal(err)
+	}
+	// Cursors unmarshal from their values and key, too.
+	var fromObject store.Cursor
+	if err := json.Unmarshal([]byte(`{"values":[1,"a"],"key":"items/1"}`), &fromObject); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []store.Cursor{fromToken, fromObject} {
+		if c.Key != cursor.Key || len(c.Values) != 2 || c.Values[0] != 1.0 || c.Values[1] != "a" {
+			t.Errorf("Expected cursor %+v, got %+v", cursor, c)
+		}
+	}
+	if err := json.Unmarshal([]byte(`"not a token"`), &fromToken); err == nil {
+		t.Errorf("Expected error for invalid token")
+	}
+}
+
+func TestEncodeIndexValue(t *testing.T) {
+	// Values in ascending order.
+	values := []string{
+		`null`, `false`, `true`, `-1e10`, `-1`, `-0.5`, `0`, `1e-10`, `1.5`, `1e10`,
+		`""`, `"\u0000"`, `"\u0000a"`, `"a"`, `"a\u0000"`, `"ab"`, `"b"`,
+		`[]`, `[null]`, `[1]`, `[1,2]`, `[2]`, `["a"]`,
+		`{}`, `{"":1}`, `{"a":1}`, `{"a":1,"b":0}`, `{"a":2}`, `{"b":0}`,
+	}
+	encoded := make([][]byte, len(values))
+	for i, value := range values {
+		var decoded interface{}
+		if err := json.Unmarshal([]byte(value), &decoded); err != nil {
+			t.Fatal(err)
+		}
+		encoded[i] = store.EncodeIndexValue(decoded)
+	}
+	for i := range encoded {
+		for j := range encoded {
+			expected := 0
+			if i < j {
+				expected = -1
+			} else if i > j {
+				expected = 1
+			}
+			if actual := bytes.Compare(encoded[i], encoded[j]); actual != expected {
+				t.Errorf("Encodings of %s and %s: expected %d, got %d", values[i], values[j], expected, actual)
+			}
+			if i != j && bytes.HasPrefix(encoded[i], encoded[j]) {
+				t.Errorf("Encoding of %s is prefixed by %s", values[i], values[j])
+			}
+		}
+	}
+}
+
+func TestPlanQuery(t *testing.T) {
+	age := store.Index{Collection: "users", Fields: []string{"age"}}
+	cityAge := store.Index{Collection: "users", Fields: []string{"city", "age"}}
+	nameAge := store.Index{Collection: "users", Fields: []string{"name", "age"}}
+	other := store.Index{Collection: "posts", Fields: []string{"age"}}
+	indexes := []store.Index{other, age, cityAge, nameAge}
+
+	city := store.Query{Field: "city", Operator: store.Eq, Value: "Berlin"}
+	adult := store.Query{Field: "age", Operator: store.Ge, Value: 18}
+	tests := []struct {
+		query   store.Query
+		order   store.Order
+		index   *store.Index
+		ordered bool
+		reverse bool
+	}{
+		{store.Query{}, store.Order{}, nil, false, false},
+		{store.Query{Field: "email", Operator: store.Eq, Value: "a"}, store.Order{}, nil, false, false},
+		{adult, store.Order{}, &age, false, false},
+		{store.And(city, adult), store.Order{}, &cityAge, false, false},
+		{store.And(city, adult), store.Order{OrderBy: "age", Ascending: false}, &cityAge, true, true},
+		{city, store.Order{OrderBy: "age", Ascending: true}, &cityAge, true, false},
+		{city, store.Order{OrderBy: "city", Ascending: true, Then: []store.Order{{OrderBy: "age", Ascending: true}}}, &cityAge, true, false},
+		// Items of the same name are sorted by key.
+		{store.Query{}, store.Order{OrderBy: "name", Ascending: true}, &nameAge, true, false},
+		{store.Query{}, store.Order{OrderBy: "name", Ascending: true, Then: []store.Order{{OrderBy: "age", Ascending: true}}}, &nameAge, true, false},
+		{store.Query{}, store.Order{OrderBy: "name", Ascending: true, Then: []store.Order{{OrderBy: "age", Ascending: false}}}, nil, false, false},
+		// Comparisons within Or and Not queries can't be served.
+		{store.Or(city, adult), store.Order{}, nil, false, false},
+		{store.Not(adult), store.Order{}, nil, false, false},
+	}
+	for i, test := range tests {
+		plan := store.PlanQuery(indexes, "users", test.query, test.order)
+		if test.index == nil {
+			if plan.Index != nil {
+				t.Errorf("%d: expected full scan, got index %v", i, plan.Index)
+			}
+			continue
+		}
+		if plan.Index == nil || strings.Join(plan.Index.Fields, ",") != strings.Join(test.index.Fields, ",") {
+			t.Errorf("%d: expected index %v, got %v", i, test.index, plan.Index)
+			continue
+		}
+		if plan.Ordered != test.ordered || plan.Reverse != test.reverse {
+			t.Errorf("%d: expected ordered %v and reverse %v, got %v and %v", i, test.ordered, test.reverse, plan.Ordered, plan.Reverse)
+		}
+	}
+}
+
+func TestIndexID(t *testing.T) {
+	a := store.Index{Collection: "users", Fields: []string{"a"}}.ID()
+	ab := store.Index{Collection: "users", Fields: []string{"a", "b"}}.ID()
+	if bytes.HasPrefix(ab, a) || bytes.HasPrefix(a, ab) {
+		t.Errorf("Expected IDs of indexes on a and on a and b not to be prefixes of each other: %q, %q", a, ab)
+	}
+}
+
+func TestIndexValuesPrefix(t *testing.T) {
+	index := store.Index{Fields: []string{"a", "b", "c"}}
+	encoded := index.Encode([]byte(`{"a":"x\u0000y","b":[1,{"k":null}],"c":true}`))
+	prefix := store.IndexValuesPrefix(encoded, 2)
+	expected := append(store.EncodeIndexValue("x\x00y"), store.EncodeIndexValue([]interface{}{1.0, map[string]interface{}{"k": nil}})...)
+	if !bytes.Equal(prefix, expected) {
+		t.Errorf("Expected prefix %v, got %v", expected, prefix)
+	}
+	if !bytes.Equal(store.IndexValuesPrefix(encoded, 3), encoded) {
+		t.Errorf("Expected prefix of all values to equal the encoding")
+	}
+}
+
+func TestProjectJSON(t *testing.T) {
+	data := []byte(`{"name":"alice","age":30,"address":{"city":"Berlin","zip":"10115"},"tags":["a"],"note":null}`)
+	tests := []struct {
+		fields   []string
+		expected string
+	}{
+		{nil, string(data)},
+		{[]string{"name"}, `{"name":"alice"}`},
+		{[]string{"name", "missing", "note"}, `{"name":"alice","note":null}`},
+		{[]string{"address.city", "tags"}, `{"address":{"city":"Berlin"},"tags":["a"]}`},
+		{[]string{"address.city", "address"}, `{"address":{"city":"Berlin","zip":"10115"}}`},
+		{[]string{"name.first"}, `{}`},
+	}
+	for _, test := range tests {
+		if projected := store.ProjectJSON(data, test.fields); string(projected) != test.expected {
+			t.Errorf("Expected %s projected to %v to be %s, got %s", data, test.fields, test.expected, projected)
+		}
+	}
+	if projected := store.ProjectJSON([]byte(`[1]`), []string{"name"}); string(projected) != `{}` {
+		t.Errorf("Expected empty object for projected array, got %s", projected)
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected []string
+	}{
+		{"", nil},
+		{"Hello, World!", []string{"hello", "world"}},
+		{"notes running ran runs", []string{"note", "run", "ran", "run"}},
+		{"stories boxes classes status", []string{"story", "box", "class", "status"}},
+		{"stopped called thing bus", []string{"stop", "call", "thing", "bus"}},
+		{"Grüße 42km", []string{"grüße", "42km"}},
+	}
+	for _, test := range tests {
+		if terms := store.Tokenize(test.text); !reflect.DeepEqual(terms, test.expected) {
+			t.Errorf("Expected %q to be tokenized to %q, got %q", test.text, test.expected, terms)
+		}
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		s string
+		q store.Query
+		o store.Order
+		l store.Limit
+	}{
+		{"", store.Query{}, store.Order{}, store.Limit{}},
+		{`age >= 21 AND city in ["Berlin","Paris"] ORDER BY age DESC LIMIT 10 OFFSET 20`,
+			store.And(
+				store.Query{Field: "age", Operator: store.Ge, Value: 21.0},
+				store.Query{Field: "city", Operator: store.In, Value: []interface{}{"Berlin", "Paris"}}),
+			store.Order{OrderBy: "age"},
+			store.Limit{Limit: 10, Offset: 20}},
+		{`a = 1 or b != "x" and not (c < -2.5e1 or d.e prefix "p")`,
+			store.Or(
+				store.Query{Field: "a", Operator: store.Eq, Value: 1.0},
+				store.And(
+					store.Query{Field: "b", Operator: store.Ne, Value: "x"},
+					store.Not(store.Or(
+						store.Query{Field: "c", Operator: store.Lt, Value: -25.0},
+						store.Query{Field: "d.e", Operator: store.Prefix, Value: "p"})))),
+			store.Order{}, store.Limit{}},
+		{"tags array-contains-any [1, null, {\"k\": [true]}] AND `first name` NOT IN [] AND x NOT EXISTS AND y exists",
+			store.And(
+				store.Query{Field: "tags", Operator: store.ArrayContainsAny, Value: []interface{}{1.0, nil, map[string]interface{}{"k": []interface{}{true}}}},
+				store.Query{Field: "first name", Operator: store.NotIn, Value: []interface{}{}},
+				store.Query{Field: "x", Operator: store.FieldExists, Value: false},
+				store.Query{Field: "y", Operator: store.FieldExists, Value: true}),
+			store.Order{}, store.Limit{}},
+		{"order by a, `b``c` asc, c desc offset 5",
+			store.Query{},
+			store.Order{OrderBy: "a", Ascending: true, Then: []store.Order{{OrderBy: "b`c", Ascending: true}, {OrderBy: "c"}}},
+			store.Limit{Offset: 5}},
+	}
+	for _, test := range tests {
+		q, o, l, err := store.ParseQuery(test.s)
+		if err != nil {
+			t.Errorf("Expected %q to parse, got %v", test.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(q, test.q) || !reflect.DeepEqual(o, test.o) || !reflect.DeepEqual(l, test.l) {
+			t.Errorf("Expected %q to parse to %+v %+v %+v, got %+v %+v %+v", test.s, test.q, test.o, test.l, q, o, l)
+		}
+	}
+}
+
+func TestParseQuery_Errors(t *testing.T) {
+	tests := []struct {
+		s      string
+		offset int
+		msg    string
+	}{
+		{"age >=", 6, "expected value, found end of query"},
+		{"age => 1", 5, `expected value, found ">"`},
+		{"age ~ 1", 4, `unexpected character '~'`},
+		{"age 1", 4, `expected operator after field age, found "1"`},
+		{"age >= 1 ORDER age", 15, `expected BY, found "age"`},
+		{"limit == 1", 6, `expected non-negative integer after LIMIT, found "=="`},
+		{"a == 1 LIMIT 1.5", 13, `expected non-negative integer after LIMIT, found "1.5"`},
+		{"a == 1 b == 2", 7, `unexpected "b"`},
+		{`a == "open`, 5, "unterminated string"},
+		{`a == "open\`, 5, "unterminated string"},
+		{"a in 1", 5, "value of operator in is no array"},
+		{"a prefix 1", 9, "value of operator prefix is no string"},
+		{"(a == 1", 7, `expected ")", found end of query`},
+		{"order == 1", 6, `expected BY, found "=="`},
+		{"and == 1", 0, `expected field, found keyword "and"`},
+		{"a. == 1", 0, `invalid field "a."`},
+		{"a NOT LIKE 1", 6, `expected IN or EXISTS after NOT, found "LIKE"`},
+		{"a == #", 5, `unexpected character '#'`},
+		{"a == [1 2]", 8, `expected "," or "]", found "2"`},
+		{"a == [1, 2", 10, `expected "," or "]", found end of query`},
+		{`a == {"x": 1 "y": 2}`, 13, `expected "," or "}", found "\"y\""`},
+		{`a == {"x" 1}`, 10, `expected ":", found "1"`},
+		{"a == 01", 5, `invalid number "01"`},
+		{strings.Repeat("(", 200) + "a == 1", 100, "query nested too deeply"},
+	}
+	for _, test := range tests {
+		_, _, _, err := store.ParseQuery(test.s)
+		syntaxErr, ok := err.(*store.SyntaxError)
+		if !ok {
+			t.Errorf("Expected syntax error for %q, got %v", test.s, err)
+			continue
+		}
+		if syntaxErr.Offset != test.offset || syntaxErr.Msg != test.msg {
+			t.Errorf("Expected error %q at offset %d for %q, got %q at offset %d", test.msg, test.offset, test.s, syntaxErr.Msg, syntaxErr.Offset)
+		}
+	}
+}
+
+func TestFormatQuery(t *testing.T) {
+	tests := []struct {
+		q        store.Query
+		o        store.Order
+		l        store.Limit
+		expected string
+	}{
+		{store.Query{}, store.Order{}, store.Limit{}, ""},
+		{store.Query{Field: "a", Operator: store.Eq, Value: 1}, store.Order{OrderBy: "b", Ascending: true}, store.Limit{Limit: 3},
+			"a == 1 ORDER BY b ASC LIMIT 3"},
+		{store.And(store.Or(store.Query{Field: "a", Operator: store.Lt, Value: 1}, store.Query{Field: "b", Operator: store.FieldExists, Value: true}),
+			store.Not(store.And(store.Query{Field: "order", Operator: store.In, Value: []string{"x"}}, store.Query{}))),
+			store.Order{}, store.Limit{Offset: 2},
+			"(a < 1 OR b EXISTS) AND NOT `order` in [\"x\"] OFFSET 2"},
+		{store.Query{Field: "a b", Operator: store.Ne, Value: nil, And: []store.Query{{Field: "c", Operator: store.Gt, Value: "d"}}},
+			store.Order{OrderBy: "x", Then: []store.Order{{OrderBy: "y.z", Ascending: true}}}, store.Limit{},
+			"`a b` != null AND c > \"d\" ORDER BY x DESC, y.z ASC"},
+	}
+	for _, test := range tests {
+		if s := store.FormatQuery(test.q, test.o, test.l); s != test.expected {
+			t.Errorf("Expected %q, got %q", test.expected, s)
+		}
+	}
+}
+
+func FuzzParseQuery(f *testing.F) {
+	for _, s := range []string{
+		"",
+		`age >= 21 AND city in ["Berlin","Paris"] ORDER BY age DESC LIMIT 10 OFFSET 20`,
+		`a = 1 or b != "x" and not (c < -2.5e1 or d.e prefix "p")`,
+		"tags array-contains-any [1, null, {\"k\": [true]}] AND `first name` NOT IN [] AND x NOT EXISTS",
+		"order by a, `b``c` asc, c desc offset 5",
+	} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		q, o, l, err := store.ParseQuery(s)
+		if err != nil {
+			if _, ok := err.(*store.SyntaxError); !ok {
+				t.Fatalf("Expected syntax error for %q, got %v", s, err)
+			}
+			return
+		}
+		if err := q.Validate(); err != nil {
+			t.Fatalf("Expected valid query for %q, got %v", s, err)
+		}
+		// Formatted queries parse back into queries formatted alike.
+		formatted := store.FormatQuery(q, o, l)
+		q2, o2, l2, err := store.ParseQuery(formatted)
+		if err != nil {
+			t.Fatalf("Expected %q formatted from %q to parse, got %v", formatted, s, err)
+		}
+		if again := store.FormatQuery(q2, o2, l2); again != formatted {
+			t.Fatalf("Expected %q to format as %q, got %q", s, formatted, again)
+		}
+		if !reflect.DeepEqual(o, o2) || !reflect.DeepEqual(l, l2) {
+			t.Fatalf("Expected order and limit of %q to survive formatting as %q", s, formatted)
+		}
+	})
+}
@@ -0,0 +1,1449 @@
+// Package storetest provides a conformance test suite for store.Store
+// implementations. Backends call RunConformance from their own tests to
+// prove they behave like the reference badger implementation.
+package storetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/imba3r/thunder/store"
+)
+
+// Factory returns a new, empty and unopened store. It is called once per
+// test case; the suite opens the store and closes it again afterwards.
+type Factory func() store.Store
+
+// RunConformance runs the conformance suite against the stores returned
+// by the given factory.
+func RunConformance(t *testing.T, newStore Factory) {
+	tests := []struct {
+		name string
+		f    func(t *testing.T, s store.Store)
+	}{
+		{"Keys", testKeys},
+		{"DocumentSetGet", testDocumentSetGet},
+		{"DocumentGetMissing", testDocumentGetMissing},
+		{"DocumentUpdate", testDocumentUpdate},
+		{"DocumentUpdateMissing", testDocumentUpdateMissing},
+		{"DocumentDelete", testDocumentDelete},
+		{"CollectionAdd", testCollectionAdd},
+		{"CollectionAddKeys", testCollectionAddKeys},
+		{"CollectionItems", testCollectionItems},
+		{"CollectionItemsEmpty", testCollectionItemsEmpty},
+		{"Subcollections", testSubcollections},
+		{"DeleteRecursive", testDeleteRecursive},
+		{"CollectionDelete", testCollectionDelete},
+		{"Collections", testCollections},
+		{"QueryOperators", testQueryOperators},
+		{"CompoundQueries", testCompoundQueries},
+		{"MoreQueryOperators", testMoreQueryOperators},
+		{"InvalidQueries", testInvalidQueries},
+		{"TypedQueryValues", testTypedQueryValues},
+		{"QueryPaths", testQueryPaths},
+		{"Order", testOrder},
+		{"OrderMixedTypes", testOrderMixedTypes},
+		{"OrderMultipleFields", testOrderMultipleFields},
+		{"Limit", testLimit},
+		{"QueryOrderLimit", testQueryOrderLimit},
+		{"Cursors", testCursors},
+		{"CursorPaging", testCursorPaging},
+		{"Explain", testExplain},
+		{"CollectionGroup", testCollectionGroup},
+		{"Aggregate", testAggregate},
+		{"Projection", testProjection},
+		{"Search", testSearch},
+		{"TransactionCommit", testTransactionCommit},
+		{"TransactionRollback", testTransactionRollback},
+		{"TransactionKeys", testTransactionKeys},
+		{"TransactionAdd", testTransactionAdd},
+		{"Batch", testBatch},
+		{"BatchRollback", testBatchRollback},
+		{"Versions", testVersions},
+		{"Timestamps", testTimestamps},
+		{"Expiry", testExpiry},
+		{"ExpiryUpdate", testExpiryUpdate},
+		{"Preconditions", testPreconditions},
+		{"TransactionPreconditions", testTransactionPreconditions},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			s := newStore()
+			if err := s.Open(store.Json); err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			defer s.Close()
+			test.f(t, s)
+		})
+	}
+}
+
+func testKeys(t *testing.T, s store.Store) {
+	if _, err := s.Document("users"); err == nil {
+		t.Errorf("Expected error when opening collection key %q as document", "users")
+	}
+	if _, err := s.Document("users/1/posts"); err == nil {
+		t.Errorf("Expected error when opening collection key %q as document", "users/1/posts")
+	}
+	if _, err := s.Collection("users/1"); err == nil {
+		t.Errorf("Expected error when opening document key %q as collection", "users/1")
+	}
+	d := mustDocument(t, s, "users/1/posts/2")
+	if d.Key() != "users/1/posts/2" {
+		t.Errorf("Expected document key %q, got %q", "users/1/posts/2", d.Key())
+	}
+	c := mustCollection(t, s, "users/1/posts")
+	if c.Key() != "users/1/posts" {
+		t.Errorf("Expected collection key %q, got %q", "users/1/posts", c.Key())
+	}
+}
+
+func testDocumentSetGet(t *testing.T, s store.Store) {
+	d := mustDocument(t, s, "users/1")
+	mustSet(t, d, `{"name":"alice"}`)
+	expectDocument(t, s, "users/1", `{"name":"alice"}`)
+
+	mustSet(t, d, `{"name":"bob"}`)
+	expectDocument(t, s, "users/1", `{"name":"bob"}`)
+}
+
+func testDocumentGetMissing(t *testing.T, s store.Store) {
+	d := mustDocument(t, s, "users/1")
+	if data, err := d.Get(); !store.IsNotFound(err) {
+		t.Errorf("Expected not found error when getting missing document, got %s (%v)", data, err)
+	}
+}
+
+func testDocumentUpdate(t *testing.T, s store.Store) {
+	d := mustDocument(t, s, "users/1")
+	mustSet(t, d, `{"name":"alice","age":30,"address":{"city":"Berlin","zip":"10115"},"tags":["a"]}`)
+	if err := d.Update([]byte(`{"name":"bob","age":null,"address.city":"Paris","tags":["b"]}`)); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	expectDocument(t, s, "users/1", `{"address":{"city":"Paris","zip":"10115"},"name":"bob","tags":["b"]}`)
+}
+
+func testDocumentUpdateMissing(t *testing.T, s store.Store) {
+	d := mustDocument(t, s, "users/1")
+	if err := d.Update([]byte(`{"name":"bob"}`)); !store.IsNotFound(err) {
+		t.Errorf("Expected not found error when updating missing document, got %v", err)
+	}
+	if _, err := d.Get(); !store.IsNotFound(err) {
+		t.Errorf("Expected update not to create missing document, got %v", err)
+	}
+}
+
+func testDocumentDelete(t *testing.T, s store.Store) {
+	d := mustDocument(t, s, "users/1")
+	mustSet(t, d, `{"name":"alice"}`)
+	mustSet(t, mustDocument(t, s, "users/2"), `{"name":"bob"}`)
+	if err := d.Delete(); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := d.Get(); err == nil {
+		t.Errorf("Expected error when getting deleted document")
+	}
+	expectDocument(t, s, "users/2", `{"name":"bob"}`)
+
+	// Deleting a missing document is not an error.
+	if err := d.Delete(); err != nil {
+		t.Errorf("Expected no error when deleting missing document, got %v", err)
+	}
+}
+
+func testCollectionAdd(t *testing.T, s store.Store) {
+	c := mustCollection(t, s, "users")
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		data := fmt.Sprintf(`{"n":%d}`, i)
+		d, err := c.Add([]byte(data))
+		if err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+		if store.CollectionKey(d.Key()) != "users" {
+			t.Errorf("Expected added document below %q, got %q", "users", d.Key())
+		}
+		if seen[d.Key()] {
+			t.Errorf("Expected unique key for added document, got %q twice", d.Key())
+		}
+		seen[d.Key()] = true
+		expectDocument(t, s, d.Key(), data)
+	}
+}
+
+func testCollectionAddKeys(t *testing.T, s store.Store) {
+	// Generated IDs start at zero and skip the IDs of documents that have
+	// been set explicitly.
+	c := mustCollection(t, s, "users")
+	d, err := c.Add([]byte(`{"n":0}`))
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if d.Key() != "users/0" {
+		t.Errorf("Expected first added document %q, got %q", "users/0", d.Key())
+	}
+	mustSet(t, mustDocument(t, s, "users/1"), `{"name":"alice"}`)
+	mustSet(t, mustDocument(t, s, "users/2"), `{"name":"bob"}`)
+	d, err = c.Add([]byte(`{"n":3}`))
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if d.Key() != "users/3" {
+		t.Errorf("Expected added document %q, got %q", "users/3", d.Key())
+	}
+	expectDocument(t, s, "users/1", `{"name":"alice"}`)
+	expectDocument(t, s, "users/2", `{"name":"bob"}`)
+}
+
+func testCollectionItems(t *testing.T, s store.Store) {
+	mustSet(t, mustDocument(t, s, "users/b"), `{"name":"bob"}`)
+	mustSet(t, mustDocument(t, s, "users/a"), `{"name":"alice"}`)
+	mustSet(t, mustDocument(t, s, "usersx/a"), `{"name":"other"}`)
+
+	items := mustItems(t, s, "users", store.Query{}, store.Order{}, store.Limit{})
+	expectKeys(t, items, "users/a", "users/b")
+	for _, item := range items {
+		expectDocument(t, s, item.Key, string(item.Value))
+	}
+}
+
+func testCollectionItemsEmpty(t *testing.T, s store.Store) {
+	items := mustItems(t, s, "users", store.Query{}, store.Order{}, store.Limit{})
+	expectKeys(t, items)
+}
+
+func testSubcollections(t *testing.T, s store.Store) {
+	mustSet(t, mustDocument(t, s, "users/1"), `{"name":"alice"}`)
+	mustSet(t, mustDocument(t, s, "users/1/posts/1"), `{"title":"first"}`)
+	mustSet(t, mustDocument(t, s, "users/1/posts/2"), `{"title":"second"}`)
+	mustSet(t, mustDocument(t, s, "users/1/posts/2/comments/1"), `{"text":"nice"}`)
+	mustSet(t, mustDocument(t, s, "users/2/posts/1"), `{"title":"other"}`)
+
+	expectKeys(t, mustItems(t, s, "users", store.Query{}, store.Order{}, store.Limit{}), "users/1")
+	expectKeys(t, mustItems(t, s, "users/1/posts", store.Query{}, store.Order{}, store.Limit{}), "users/1/posts/1", "users/1/posts/2")
+	expectKeys(t, mustItems(t, s, "users/1/posts/2/comments", store.Query{}, store.Order{}, store.Limit{}), "users/1/posts/2/comments/1")
+
+	d, err := mustCollection(t, s, "users/1/posts").Add([]byte(`{"title":"third"}`))
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if store.CollectionKey(d.Key()) != "users/1/posts" {
+		t.Errorf("Expected added document below %q, got %q", "users/1/posts", d.Key())
+	}
+	expectKeys(t, mustItems(t, s, "users", store.Query{}, store.Order{}, store.Limit{}), "users/1")
+}
+
+func setupTree(t *testing.T, s store.Store) {
+	for _, key := range []string{
+		"users/1", "users/1/posts/1", "users/1/posts/2", "users/1/posts/2/comments/1",
+		"users/10", "users/10/posts/1", "users/2/posts/1",
+	} {
+		mustSet(t, mustDocument(t, s, key), `{}`)
+	}
+}
+
+func testDeleteRecursive(t *testing.T, s store.Store) {
+	setupTree(t, s)
+
+	d := mustDocument(t, s, "users/1")
+	if _, err := d.DeleteRecursive(store.HasVersion(2)); !store.IsConflict(err) {
+		t.Errorf("Expected conflict error, got %v", err)
+	}
+	keys, err := d.DeleteRecursive(store.Exists())
+	if err != nil {
+		t.Fatalf("DeleteRecursive: %v", err)
+	}
+	expectDeleted(t, keys, "users/1", "users/1/posts/1", "users/1/posts/2", "users/1/posts/2/comments/1")
+	expectKeys(t, mustItems(t, s, "users", store.Query{}, store.Order{}, store.Limit{}), "users/10")
+	expectKeys(t, mustItems(t, s, "users/1/posts", store.Query{}, store.Order{}, store.Limit{}))
+	expectKeys(t, mustItems(t, s, "users/1/posts/2/comments", store.Query{}, store.Order{}, store.Limit{}))
+	expectKeys(t, mustItems(t, s, "users/10/posts", store.Query{}, store.Order{}, store.Limit{}), "users/10/posts/1")
+
+	// Orphaned subcollections of missing documents are deleted, too.
+	keys, err = mustDocument(t, s, "users/2").DeleteRecursive()
+	if err != nil {
+		t.Fatalf("DeleteRecursive: %v", err)
+	}
+	expectDeleted(t, keys, "users/2/posts/1")
+
+	// Keys of deleted documents aren't handed out again.
+	added, err := mustCollection(t, s, "users/10/drafts").Add([]byte(`{}`))
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	keys, err = mustDocument(t, s, "users/10").DeleteRecursive()
+	if err != nil {
+		t.Fatalf("DeleteRecursive: %v", err)
+	}
+	expectDeleted(t, keys, "users/10", added.Key(), "users/10/posts/1")
+	readded, err := mustCollection(t, s, "users/10/drafts").Add([]byte(`{}`))
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if readded.Key() == added.Key() {
+		t.Errorf("Expected a new key, got %q again", added.Key())
+	}
+}
+
+func testCollectionDelete(t *testing.T, s store.Store) {
+	setupTree(t, s)
+
+	keys, err := mustCollection(t, s, "users/1/posts").Delete(false)
+	if err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	expectDeleted(t, keys, "users/1/posts/1", "users/1/posts/2")
+	expectKeys(t, mustItems(t, s, "users/1/posts/2/comments", store.Query{}, store.Order{}, store.Limit{}), "users/1/posts/2/comments/1")
+
+	keys, err = mustCollection(t, s, "users").Delete(true)
+	if err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	expectDeleted(t, keys, "users/1", "users/1/posts/2/comments/1", "users/10", "users/10/posts/1", "users/2/posts/1")
+	expectKeys(t, mustItems(t, s, "users", store.Query{}, store.Order{}, store.Limit{}))
+
+	keys, err = mustCollection(t, s, "missing").Delete(true)
+	if err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	expectDeleted(t, keys)
+}
+
+func testCollections(t *testing.T, s store.Store) {
+	setupTree(t, s)
+	mustSet(t, mustDocument(t, s, "users/1/drafts/1"), `{}`)
+	mustSet(t, mustDocument(t, s, "groups/1"), `{}`)
+	if _, err := mustCollection(t, s, "groups/1/members").Add([]byte(`{}`)); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	expectCollections(t, s.RootCollections, "groups", "users")
+	expectCollections(t, mustDocument(t, s, "users/1").Collections, "users/1/drafts", "users/1/posts")
+	expectCollections(t, mustDocument(t, s, "users/1/posts/2").Collections, "users/1/posts/2/comments")
+	expectCollections(t, mustDocument(t, s, "users/1/posts/1").Collections)
+	// Documents don't have to exist to have subcollections.
+	expectCollections(t, mustDocument(t, s, "users/2").Collections, "users/2/posts")
+	expectCollections(t, mustDocument(t, s, "users/3").Collections)
+
+	// Collections are gone along with their documents.
+	if _, err := mustCollection(t, s, "users/1/drafts").Delete(true); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	expectCollections(t, mustDocument(t, s, "users/1").Collections, "users/1/posts")
+	if _, err := mustCollection(t, s, "groups").Delete(true); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	expectCollections(t, s.RootCollections, "users")
+}
+
+func expectCollections(t *testing.T, collections func() ([]string, error), keys ...string) {
+	t.Helper()
+	actual, err := collections()
+	if err != nil {
+		t.Fatalf("Collections: %v", err)
+	}
+	if strings.Join(actual, ",") != strings.Join(keys, ",") {
+		t.Errorf("Expected collections %v, got %v", keys, actual)
+	}
+}
+
+func testQueryOperators(t *testing.T, s store.Store) {
+	mustSet(t, mustDocument(t, s, "items/1"), `{"n":1,"s":"a"}`)
+	mustSet(t, mustDocument(t, s, "items/2"), `{"n":2,"s":"b"}`)
+	mustSet(t, mustDocument(t, s, "items/3"), `{"n":3,"s":"c"}`)
+	mustSet(t, mustDocument(t, s, "items/4"), `{"other":true}`)
+
+	tests := []struct {
+		query store.Query
+		keys  []string
+	}{
+		{store.Query{Field: "n", Operator: store.Eq, Value: 2}, []string{"items/2"}},
+		{store.Query{Field: "n", Operator: store.Lt, Value: 2}, []string{"items/1"}},
+		{store.Query{Field: "n", Operator: store.Le, Value: 2.0}, []string{"items/1", "items/2"}},
+		{store.Query{Field: "n", Operator: store.Gt, Value: 2}, []string{"items/3"}},
+		{store.Query{Field: "n", Operator: store.Ge, Value: 2}, []string{"items/2", "items/3"}},
+		{store.Query{Field: "s", Operator: store.Eq, Value: "b"}, []string{"items/2"}},
+		{store.Query{Field: "s", Operator: store.Gt, Value: "a"}, []string{"items/2", "items/3"}},
+		{store.Query{Field: "n", Operator: store.Eq, Value: nil}, []string{"items/4"}},
+		{store.Query{Field: "n", Operator: store.Eq, Value: "x"}, nil},
+		{store.Query{Field: "n", Operator: store.Eq, Value: "2"}, nil},
+	}
+	for _, test := range tests {
+		items := mustItems(t, s, "items", test.query, store.Order{}, store.Limit{})
+		expectKeys(t, items, test.keys...)
+	}
+}
+
+func testMoreQueryOperators(t *testing.T, s store.Store) {
+	mustSet(t, mustDocument(t, s, "items/1"), `{"n":1,"s":"apple","tags":["red","fruit"]}`)
+	mustSet(t, mustDocument(t, s, "items/2"), `{"n":2,"s":"apricot","tags":["orange"],"nums":[1,2]}`)
+	mustSet(t, mustDocument(t, s, "items/3"), `{"n":3,"s":"banana","tags":"yellow","nullable":null}`)
+	mustSet(t, mustDocument(t, s, "items/4"), `{"other":true}`)
+
+	tests := []struct {
+		query store.Query
+		keys  []string
+	}{
+		{store.Query{Field: "n", Operator: store.Ne, Value: 2}, []string{"items/1", "items/3", "items/4"}},
+		{store.Query{Field: "s", Operator: store.Ne, Value: "apple"}, []string{"items/2", "items/3", "items/4"}},
+		{store.Query{Field: "n", Operator: store.In, Value: []interface{}{1, 3}}, []string{"items/1", "items/3"}},
+		{store.Query{Field: "s", Operator: store.In, Value: []string{"apple", "banana", "cherry"}}, []string{"items/1", "items/3"}},
+		{store.Query{Field: "n", Operator: store.In, Value: []interface{}{}}, nil},
+		{store.Query{Field: "n", Operator: store.NotIn, Value: []interface{}{1, 3}}, []string{"items/2", "items/4"}},
+		{store.Query{Field: "tags", Operator: store.ArrayContains, Value: "fruit"}, []string{"items/1"}},
+		{store.Query{Field: "tags", Operator: store.ArrayContains, Value: "yellow"}, nil},
+		{store.Query{Field: "nums", Operator: store.ArrayContains, Value: 2}, []string{"items/2"}},
+		{store.Query{Field: "tags", Operator: store.ArrayContainsAny, Value: []string{"red", "orange"}}, []string{"items/1", "items/2"}},
+		{store.Query{Field: "s", Operator: store.Prefix, Value: "ap"}, []string{"items/1", "items/2"}},
+		{store.Query{Field: "s", Operator: store.Prefix, Value: ""}, []string{"items/1", "items/2", "items/3"}},
+		{store.Query{Field: "n", Operator: store.Prefix, Value: "1"}, nil},
+		{store.Query{Field: "nums", Operator: store.FieldExists}, []string{"items/2"}},
+		{store.Query{Field: "nullable", Operator: store.FieldExists, Value: true}, nil},
+		{store.Query{Field: "n", Operator: store.FieldExists, Value: false}, []string{"items/4"}},
+	}
+	for _, test := range tests {
+		items := mustItems(t, s, "items", test.query, store.Order{}, store.Limit{})
+		expectKeys(t, items, test.keys...)
+	}
+}
+
+func testInvalidQueries(t *testing.T, s store.Store) {
+	mustSet(t, mustDocument(t, s, "items/1"), `{"n":1}`)
+	c := mustCollection(t, s, "items")
+
+	for _, q := range []store.Query{
+		{Field: "n", Operator: "~", Value: 1},
+		{Field: "n", Operator: store.In, Value: 1},
+		{Field: "n", Operator: store.Prefix, Value: 1},
+		{Field: "n", Operator: store.FieldExists, Value: "maybe"},
+		{Field: "n", Operator: store.Eq, Value: func() {}},
+		{Operator: store.Eq, Value: 1},
+		store.Not(store.Or(store.Query{Field: "n", Operator: "~"})),
+	} {
+		if _, err := c.Items(q, store.Order{}, store.Limit{}); err == nil {
+			t.Errorf("Expected error for invalid query %+v", q)
+		}
+	}
+}
+
+func testTypedQueryValues(t *testing.T, s store.Store) {
+	mustSet(t, mustDocument(t, s, "items/1"), `{"v":true,"o":{"a":1,"b":[1,2]},"a":[1,"x"]}`)
+	mustSet(t, mustDocument(t, s, "items/2"), `{"v":false,"o":{"a":1},"a":[1]}`)
+	mustSet(t, mustDocument(t, s, "items/3"), `{"v":null,"o":{"a":2},"a":[]}`)
+	mustSet(t, mustDocument(t, s, "items/4"), `{"v":0,"o":"a","a":"x"}`)
+	mustSet(t, mustDocument(t, s, "items/5"), `{"v":"true"}`)
+
+	tests := []struct {
+		query store.Query
+		keys  []string
+	}{
+		{store.Query{Field: "v", Operator: store.Eq, Value: true}, []string{"items/1"}},
+		{store.Query{Field: "v", Operator: store.Eq, Value: false}, []string{"items/2"}},
+		{store.Query{Field: "v", Operator: store.Ne, Value: false}, []string{"items/1", "items/3", "items/4", "items/5"}},
+		{store.Query{Field: "v", Operator: store.Gt, Value: false}, []string{"items/1"}},
+		{store.Query{Field: "v", Operator: store.Eq, Value: nil}, []string{"items/3"}},
+		{store.Query{Field: "v", Operator: store.Eq, Value: 0}, []string{"items/4"}},
+		{store.Query{Field: "v", Operator: store.Eq, Value: "true"}, []string{"items/5"}},
+		{store.Query{Field: "v", Operator: store.In, Value: []interface{}{nil, true}}, []string{"items/1", "items/3"}},
+		// Range operators don't match fields of other types.
+		{store.Query{Field: "v", Operator: store.Ge, Value: 0}, []string{"items/4"}},
+		{store.Query{Field: "v", Operator: store.Lt, Value: "z"}, []string{"items/5"}},
+		// Objects and arrays equal values with the same members.
+		{store.Query{Field: "o", Operator: store.Eq, Value: map[string]interface{}{"a": 1, "b": []int{1, 2}}}, []string{"items/1"}},
+		{store.Query{Field: "o", Operator: store.Eq, Value: json.RawMessage(`{"a":1}`)}, []string{"items/2"}},
+		{store.Query{Field: "o", Operator: store.Ne, Value: json.RawMessage(`{"a":1}`)}, []string{"items/1", "items/3", "items/4", "items/5"}},
+		{store.Query{Field: "o", Operator: store.Gt, Value: map[string]interface{}{"a": 1}}, []string{"items/1", "items/3"}},
+		{store.Query{Field: "a", Operator: store.Eq, Value: []interface{}{1, "x"}}, []string{"items/1"}},
+		{store.Query{Field: "a", Operator: store.Eq, Value: []interface{}{}}, []string{"items/3"}},
+		{store.Query{Field: "a", Operator: store.In, Value: []interface{}{[]int{1}, "x"}}, []string{"items/2", "items/4"}},
+		{store.Query{Field: "a", Operator: store.ArrayContains, Value: "x"}, []string{"items/1"}},
+		{store.Query{Field: "o.b", Operator: store.ArrayContains, Value: 2}, []string{"items/1"}},
+	}
+	for _, test := range tests {
+		items := mustItems(t, s, "items", test.query, store.Order{}, store.Limit{})
+		expectKeys(t, items, test.keys...)
+	}
+}
+
+func testQueryPaths(t *testing.T, s store.Store) {
+	docs := []struct{ key, data string }{
+		{"items/1", `{"say \"hi\"":"x","a\\b":1,"tags":[{"name":"a"},{"name":"b"}]}`},
+		{"items/2", `{"say \"hi\"":"y","a\\b":2,"tags":{"name":"a"}}`},
+		{"items/3", `{"say":{"\"hi\"":"x"},"tags":[{"name":"a"}]}`},
+		{"items/4", `{"tags":[]}`},
+	}
+	for _, doc := range docs {
+		mustSet(t, mustDocument(t, s, doc.key), doc.data)
+	}
+
+	// Fields needing escapes and paths through arrays match the same
+	// documents as store.MatchesJSON does.
+	for _, q := range []store.Query{
+		{Field: `say "hi"`, Operator: store.Eq, Value: "x"},
+		{Field: `say."hi"`, Operator: store.Eq, Value: "x"},
+		{Field: `a\b`, Operator: store.Ge, Value: 1},
+		{Field: "tags.name", Operator: store.Eq, Value: "a"},
+		{Field: "tags.name", Operator: store.ArrayContains, Value: "b"},
+		{Field: "tags.name", Operator: store.FieldExists},
+		store.Not(store.Query{Field: "tags.name", Operator: store.Eq, Value: nil}),
+	} {
+		var keys []string
+		for _, doc := range docs {
+			if store.MatchesJSON([]byte(doc.data), q) {
+				keys = append(keys, doc.key)
+			}
+		}
+		items := mustItems(t, s, "items", q, store.Order{}, store.Limit{})
+		expectKeys(t, items, keys...)
+	}
+
+	expectKeys(t, mustItems(t, s, "items", store.Query{}, store.Order{OrderBy: `a\b`, Ascending: false}, store.Limit{Limit: 2}),
+		"items/2", "items/1")
+}
+
+func testCompoundQueries(t *testing.T, s store.Store) {
+	mustSet(t, mustDocument(t, s, "items/1"), `{"n":1,"s":"a"}`)
+	mustSet(t, mustDocument(t, s, "items/2"), `{"n":2,"s":"b"}`)
+	mustSet(t, mustDocument(t, s, "items/3"), `{"n":3,"s":"c"}`)
+	mustSet(t, mustDocument(t, s, "items/4"), `{"other":true}`)
+
+	n := func(operator store.Operator, value interface{}) store.Query {
+		return store.Query{Field: "n", Operator: operator, Value: value}
+	}
+	str := func(operator store.Operator, value interface{}) store.Query {
+		return store.Query{Field: "s", Operator: operator, Value: value}
+	}
+	tests := []struct {
+		query store.Query
+		keys  []string
+	}{
+		{store.And(n(store.Ge, 2), str(store.Lt, "c")), []string{"items/2"}},
+		{store.And(n(store.Ge, 2), str(store.Lt, "c"), n(store.Eq, 3)), nil},
+		{store.Or(n(store.Eq, 1), str(store.Eq, "c")), []string{"items/1", "items/3"}},
+		{store.Not(n(store.Eq, 2)), []string{"items/1", "items/3", "items/4"}},
+		{store.Not(n(store.Gt, 1)), []string{"items/1", "items/4"}},
+		{store.Not(store.Or(n(store.Eq, 1), n(store.Eq, nil))), []string{"items/2", "items/3"}},
+		{store.And(store.Or(n(store.Eq, 1), n(store.Eq, 3)), store.Not(str(store.Eq, "a"))), []string{"items/3"}},
+		// Comparisons and combined queries of the same query all have to hold.
+		{store.Query{Field: "n", Operator: store.Gt, Value: 1, Or: []store.Query{str(store.Eq, "a"), str(store.Eq, "b")}}, []string{"items/2"}},
+		{store.And(), []string{"items/1", "items/2", "items/3", "items/4"}},
+	}
+	for _, test := range tests {
+		items := mustItems(t, s, "items", test.query, store.Order{}, store.Limit{})
+		expectKeys(t, items, test.keys...)
+	}
+}
+
+func testOrder(t *testing.T, s store.Store) {
+	mustSet(t, mustDocument(t, s, "items/1"), `{"n":2}`)
+	mustSet(t, mustDocument(t, s, "items/2"), `{"n":3}`)
+	mustSet(t, mustDocument(t, s, "items/3"), `{"n":1}`)
+
+	expectKeys(t, mustItems(t, s, "items", store.Query{}, store.Order{OrderBy: "n", Ascending: true}, store.Limit{}),
+		"items/3", "items/1", "items/2")
+	expectKeys(t, mustItems(t, s, "items", store.Query{}, store.Order{OrderBy: "n", Ascending: false}, store.Limit{}),
+		"items/2", "items/1", "items/3")
+}
+
+func testOrderMixedTypes(t *testing.T, s store.Store) {
+	mustSet(t, mustDocument(t, s, "items/1"), `{"v":"a"}`)
+	mustSet(t, mustDocument(t, s, "items/2"), `{"v":true}`)
+	mustSet(t, mustDocument(t, s, "items/3"), `{"v":10}`)
+	mustSet(t, mustDocument(t, s, "items/4"), `{"v":null}`)
+	mustSet(t, mustDocument(t, s, "items/5"), `{"v":false}`)
+	mustSet(t, mustDocument(t, s, "items/6"), `{"v":2.5}`)
+	mustSet(t, mustDocument(t, s, "items/7"), `{}`)
+	mustSet(t, mustDocument(t, s, "items/8"), `{"v":"B"}`)
+
+	// Ties of null and missing fields are broken by key.
+	expectKeys(t, mustItems(t, s, "items", store.Query{}, store.Order{OrderBy: "v", Ascending: true}, store.Limit{}),
+		"items/4", "items/7", "items/5", "items/2", "items/6", "items/3", "items/8", "items/1")
+	expectKeys(t, mustItems(t, s, "items", store.Query{}, store.Order{OrderBy: "v", Ascending: false}, store.Limit{Limit: 4}),
+		"items/1", "items/8", "items/3", "items/6")
+
+	// Arrays sort after strings and objects after arrays.
+	mustSet(t, mustDocument(t, s, "items/9"), `{"v":{"a":1}}`)
+	mustSet(t, mustDocument(t, s, "items/10"), `{"v":[1,2]}`)
+	mustSet(t, mustDocument(t, s, "items/11"), `{"v":[1]}`)
+	expectKeys(t, mustItems(t, s, "items", store.Query{}, store.Order{OrderBy: "v", Ascending: false}, store.Limit{Limit: 4}),
+		"items/9", "items/10", "items/11", "items/1")
+}
+
+func testOrderMultipleFields(t *testing.T, s store.Store) {
+	mustSet(t, mustDocument(t, s, "items/1"), `{"a":1,"b":"x"}`)
+	mustSet(t, mustDocument(t, s, "items/2"), `{"a":2,"b":"x"}`)
+	mustSet(t, mustDocument(t, s, "items/3"), `{"a":1,"b":"y"}`)
+	mustSet(t, mustDocument(t, s, "items/4"), `{"a":2,"b":"y"}`)
+	mustSet(t, mustDocument(t, s, "items/5"), `{"a":1,"b":"y"}`)
+
+	tests := []struct {
+		order store.Order
+		keys  []string
+	}{
+		{store.Order{OrderBy: "a", Ascending: true, Then: []store.Order{{OrderBy: "b", Ascending: false}}},
+			[]string{"items/3", "items/5", "items/1", "items/4", "items/2"}},
+		{store.Order{OrderBy: "b", Ascending: true, Then: []store.Order{{OrderBy: "a", Ascending: false}}},
+			[]string{"items/2", "items/1", "items/4", "items/3", "items/5"}},
+		// Orders may consist of Then only.
+		{store.Order{Then: []store.Order{{OrderBy: "b", Ascending: false}, {OrderBy: "a", Ascending: true}}},
+			[]string{"items/3", "items/5", "items/4", "items/1", "items/2"}},
+	}
+	for _, test := range tests {
+		expectKeys(t, mustItems(t, s, "items", store.Query{}, test.order, store.Limit{}), test.keys...)
+	}
+	expectKeys(t, mustItems(t, s, "items", store.Query{}, tests[0].order, store.Limit{Limit: 2, Offset: 1}),
+		"items/5", "items/1")
+}
+
+func testLimit(t *testing.T, s store.Store) {
+	for i := 0; i < 5; i++ {
+		mustSet(t, mustDocument(t, s, fmt.Sprintf("items/%d", i)), fmt.Sprintf(`{"n":%d}`, i))
+	}
+	tests := []struct {
+		limit store.Limit
+		keys  []string
+	}{
+		{store.Limit{Limit: 2}, []string{"items/0", "items/1"}},
+		{store.Limit{Limit: 2, Offset: 2}, []string{"items/2", "items/3"}},
+		{store.Limit{Limit: 10, Offset: 3}, []string{"items/3", "items/4"}},
+		{store.Limit{Offset: 4}, []string{"items/4"}},
+		{store.Limit{Limit: 2, Offset: 5}, nil},
+	}
+	for _, test := range tests {
+		items := mustItems(t, s, "items", store.Query{}, store.Order{}, test.limit)
+		expectKeys(t, items, test.keys...)
+	}
+}
+
+func testQueryOrderLimit(t *testing.T, s store.Store) {
+	for i := 0; i < 6; i++ {
+		mustSet(t, mustDocument(t, s, fmt.Sprintf("items/%d", i)), fmt.Sprintf(`{"n":%d}`, i))
+	}
+	items := mustItems(t, s, "items",
+		store.Query{Field: "n", Operator: store.Ge, Value: 1},
+		store.Order{OrderBy: "n", Ascending: false},
+		store.Limit{Limit: 2, Offset: 1})
+	expectKeys(t, items, "items/4", "items/3")
+}
+
+func testCursors(t *testing.T, s store.Store) {
+	mustSet(t, mustDocument(t, s, "items/1"), `{"n":2,"s":"b"}`)
+	mustSet(t, mustDocument(t, s, "items/2"), `{"n":1,"s":"b"}`)
+	mustSet(t, mustDocument(t, s, "items/3"), `{"n":2,"s":"a"}`)
+	mustSet(t, mustDocument(t, s, "items/4"), `{"n":3}`)
+	mustSet(t, mustDocument(t, s, "items/5"), `{"n":2,"s":"b"}`)
+
+	byN := store.Order{OrderBy: "n", Ascending: true}
+	byNDesc := store.Order{OrderBy: "n", Ascending: false}
+	byNThenS := store.Order{OrderBy: "n", Ascending: true, Then: []store.Order{{OrderBy: "s", Ascending: false}}}
+	tests := []struct {
+		order store.Order
+		limit store.Limit
+		keys  []string
+	}{
+		// Items ordered by key.
+		{store.Order{}, store.Limit{StartAt: &store.Cursor{Key: "items/2"}}, []string{"items/2", "items/3", "items/4", "items/5"}},
+		{store.Order{}, store.Limit{StartAfter: &store.Cursor{Key: "items/2"}, Limit: 2}, []string{"items/3", "items/4"}},
+		{store.Order{}, store.Limit{StartAfter: &store.Cursor{Key: "items/25"}, EndBefore: &store.Cursor{Key: "items/5"}}, []string{"items/3", "items/4"}},
+		{store.Order{}, store.Limit{EndAt: &store.Cursor{Key: "items/2"}}, []string{"items/1", "items/2"}},
+		{store.Order{}, store.Limit{StartAt: &store.Cursor{Key: "items/4"}, EndBefore: &store.Cursor{Key: "items/2"}}, nil},
+		// Ties are broken by key.
+		{byN, store.Limit{StartAfter: &store.Cursor{Values: []interface{}{2}, Key: "items/3"}}, []string{"items/5", "items/4"}},
+		{byN, store.Limit{StartAt: &store.Cursor{Values: []interface{}{2}, Key: "items/3"}, Limit: 1}, []string{"items/3"}},
+		{byNDesc, store.Limit{StartAfter: &store.Cursor{Values: []interface{}{2}, Key: "items/1"}}, []string{"items/3", "items/5", "items/2"}},
+		{byNDesc, store.Limit{EndBefore: &store.Cursor{Values: []interface{}{2}, Key: "items/3"}}, []string{"items/4", "items/1"}},
+		// Cursors with fewer values than fields ignore the key.
+		{byN, store.Limit{StartAt: &store.Cursor{Values: []interface{}{2}}}, []string{"items/1", "items/3", "items/5", "items/4"}},
+		{byN, store.Limit{StartAfter: &store.Cursor{Values: []interface{}{2}, Key: "items/9"}}, []string{"items/4"}},
+		{byN, store.Limit{EndAt: &store.Cursor{Values: []interface{}{1.5}}}, []string{"items/2"}},
+		{byNThenS, store.Limit{StartAfter: &store.Cursor{Values: []interface{}{2, "b"}, Key: "items/1"}}, []string{"items/5", "items/3", "items/4"}},
+		{byNThenS, store.Limit{StartAfter: &store.Cursor{Values: []interface{}{2, "b"}}, EndAt: &store.Cursor{Values: []interface{}{3, nil}}}, []string{"items/3", "items/4"}},
+		// Values of other types sort by type.
+		{byN, store.Limit{StartAt: &store.Cursor{Values: []interface{}{"2"}}}, nil},
+		{byN, store.Limit{StartAfter: &store.Cursor{Values: []interface{}{true}}}, []string{"items/2", "items/1", "items/3", "items/5", "items/4"}},
+		{byNThenS, store.Limit{StartAfter: &store.Cursor{Values: []interface{}{3, "a"}}}, []string{"items/4"}},
+	}
+	for _, test := range tests {
+		items := mustItems(t, s, "items", store.Query{}, test.order, test.limit)
+		expectKeys(t, items, test.keys...)
+	}
+
+	// Queries apply before cursors.
+	items := mustItems(t, s, "items", store.Query{Field: "s", Operator: store.Eq, Value: "b"}, byN,
+		store.Limit{StartAfter: &store.Cursor{Values: []interface{}{1}, Key: "items/2"}, Offset: 1})
+	expectKeys(t, items, "items/5")
+
+	c := mustCollection(t, s, "items")
+	for _, l := range []store.Limit{
+		{StartAt: &store.Cursor{Values: []interface{}{1, "a"}}},
+		{EndBefore: &store.Cursor{Values: []interface{}{func() {}}}},
+	} {
+		if _, err := c.Items(store.Query{}, byN, l); err == nil {
+			t.Errorf("Expected error for invalid limit %+v", l)
+		}
+	}
+}
+
+func testCursorPaging(t *testing.T, s store.Store) {
+	for i := 0; i < 10; i++ {
+		mustSet(t, mustDocument(t, s, fmt.Sprintf("items/%d", i)), fmt.Sprintf(`{"n":%d,"a":[%d]}`, i%3, i%2))
+	}
+	for _, o := range []store.Order{
+		{},
+		{OrderBy: "n", Ascending: false},
+		{OrderBy: "a", Ascending: true, Then: []store.Order{{OrderBy: "n", Ascending: true}}},
+	} {
+		expected := mustItems(t, s, "items", store.Query{}, o, store.Limit{})
+		var keys []string
+		l := store.Limit{Limit: 3}
+		for {
+			items := mustItems(t, s, "items", store.Query{}, o, l)
+			if len(items) == 0 {
+				break
+			}
+			for _, item := range items {
+				keys = append(keys, item.Key)
+			}
+			// Continue after the last item, passing the cursor as token.
+			token, err := store.NewCursor(items[len(items)-1], o).MarshalText()
+			if err != nil {
+				t.Fatal(err)
+			}
+			l.StartAfter = &store.Cursor{}
+			if err := json.Unmarshal([]byte(`"`+string(token)+`"`), l.StartAfter); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expectKeys(t, expected, keys...)
+	}
+}
+
+func testExplain(t *testing.T, s store.Store) {
+	for i := 0; i < 5; i++ {
+		mustSet(t, mustDocument(t, s, fmt.Sprintf("items/%d", i)), fmt.Sprintf(`{"n":%d}`, i))
+	}
+	c := mustCollection(t, s, "items")
+	q := store.Query{Field: "n", Operator: store.Ge, Value: 2}
+	explanation, err := c.Explain(q, store.Order{}, store.Limit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if explanation.Scan != store.FullScan && explanation.Scan != store.IndexScan {
+		t.Errorf("Expected full or index scan, got %q", explanation.Scan)
+	}
+	if explanation.Returned != 3 || explanation.Examined < 3 || explanation.Examined > 5 {
+		t.Errorf("Expected 3 items returned of at most 5 examined, got %+v", explanation)
+	}
+	if _, err := c.Explain(store.Query{Field: "n", Operator: "~"}, store.Order{}, store.Limit{}); err == nil {
+		t.Errorf("Expected error for invalid query")
+	}
+}
+
+func testCollectionGroup(t *testing.T, s store.Store) {
+	mustSet(t, mustDocument(t, s, "comments/a"), `{"n":3}`)
+	mustSet(t, mustDocument(t, s, "users/1"), `{"n":0}`)
+	mustSet(t, mustDocument(t, s, "users/1/posts/1/comments/1"), `{"n":2}`)
+	mustSet(t, mustDocument(t, s, "users/1/posts/1/comments/2"), `{"n":5}`)
+	mustSet(t, mustDocument(t, s, "users/2/posts/1/comments/1"), `{"n":1}`)
+	mustSet(t, mustDocument(t, s, "users/2/posts/1/comments/1/likes/1"), `{"n":4}`)
+	mustSet(t, mustDocument(t, s, "users/2/comments2/1"), `{"n":6}`)
+	mustSet(t, mustDocument(t, s, "users/2/Comments/1"), `{"n":7}`)
+
+	g, err := s.CollectionGroup("comments")
+	if err != nil {
+		t.Fatalf("CollectionGroup: %v", err)
+	}
+	if g.Name() != "comments" {
+		t.Errorf("Expected name %q, got %q", "comments", g.Name())
+	}
+	byNDesc := store.Order{OrderBy: "n", Ascending: false}
+	tests := []struct {
+		query store.Query
+		order store.Order
+		limit store.Limit
+		keys  []string
+	}{
+		{store.Query{}, store.Order{}, store.Limit{},
+			[]string{"comments/a", "users/1/posts/1/comments/1", "users/1/posts/1/comments/2", "users/2/posts/1/comments/1"}},
+		{store.Query{}, byNDesc, store.Limit{Limit: 2},
+			[]string{"users/1/posts/1/comments/2", "comments/a"}},
+		{store.Query{Field: "n", Operator: store.Lt, Value: 3}, byNDesc, store.Limit{},
+			[]string{"users/1/posts/1/comments/1", "users/2/posts/1/comments/1"}},
+		{store.Query{}, store.Order{}, store.Limit{StartAfter: &store.Cursor{Key: "users/1/posts/1/comments/1"}},
+			[]string{"users/1/posts/1/comments/2", "users/2/posts/1/comments/1"}},
+		{store.Query{}, byNDesc, store.Limit{StartAfter: &store.Cursor{Values: []interface{}{3}, Key: "comments/a"}},
+			[]string{"users/1/posts/1/comments/1", "users/2/posts/1/comments/1"}},
+	}
+	for _, test := range tests {
+		items, err := g.Items(test.query, test.order, test.limit)
+		if err != nil {
+			t.Fatalf("Items: %v", err)
+		}
+		expectKeys(t, items, test.keys...)
+	}
+
+	explanation, err := g.Explain(store.Query{Field: "n", Operator: store.Gt, Value: 2}, store.Order{}, store.Limit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if explanation.Returned != 2 || explanation.Examined != 4 {
+		t.Errorf("Expected 2 items returned of 4 examined, got %+v", explanation)
+	}
+	groups, err := g.Aggregate(store.Query{}, nil, []store.Aggregation{{Function: store.Count}, {Function: store.Sum, Field: "n"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || groups[0].Values["count"] != 4 || groups[0].Values["sum(n)"] != 11.0 {
+		t.Errorf("Expected count 4 and sum 11, got %+v", groups)
+	}
+	if _, err := g.Items(store.Query{Field: "n", Operator: "~"}, store.Order{}, store.Limit{}); err == nil {
+		t.Errorf("Expected error for invalid query")
+	}
+	for _, name := range []string{"", "users/1/comments"} {
+		if _, err := s.CollectionGroup(name); err == nil {
+			t.Errorf("Expected error for collection group name %q", name)
+		}
+	}
+}
+
+func testAggregate(t *testing.T, s store.Store) {
+	mustSet(t, mustDocument(t, s, "orders/1"), `{"status":"open","total":10}`)
+	mustSet(t, mustDocument(t, s, "orders/2"), `{"status":"paid","total":25.5}`)
+	mustSet(t, mustDocument(t, s, "orders/3"), `{"status":"open","total":"n/a"}`)
+	mustSet(t, mustDocument(t, s, "orders/4"), `{"status":"paid","total":4.5}`)
+	mustSet(t, mustDocument(t, s, "orders/5"), `{"total":1}`)
+	mustSet(t, mustDocument(t, s, "orders/5/items/1"), `{"status":"open","total":100}`)
+
+	c := mustCollection(t, s, "orders")
+	aggregations := []store.Aggregation{
+		{Function: store.Count},
+		{Function: store.Count, Field: "status"},
+		{Function: store.Sum, Field: "total"},
+		{Function: store.Avg, Field: "total", Alias: "average"},
+		{Function: store.Min, Field: "total"},
+		{Function: store.Max, Field: "total"},
+	}
+	tests := []struct {
+		query    store.Query
+		groupBy  []string
+		expected string
+	}{
+		{store.Query{}, nil,
+			`[{"values":{"average":10.25,"count":5,"count(status)":4,"max(total)":"n/a","min(total)":1,"sum(total)":41}}]`},
+		{store.Query{Field: "total", Operator: store.Gt, Value: 5}, nil,
+			`[{"values":{"average":17.75,"count":2,"count(status)":2,"max(total)":25.5,"min(total)":10,"sum(total)":35.5}}]`},
+		{store.Query{Field: "total", Operator: store.Gt, Value: 100}, nil,
+			`[{"values":{"average":null,"count":0,"count(status)":0,"max(total)":null,"min(total)":null,"sum(total)":0}}]`},
+		{store.Query{}, []string{"status"},
+			`[{"group":[null],"values":{"average":1,"count":1,"count(status)":0,"max(total)":1,"min(total)":1,"sum(total)":1}},` +
+				`{"group":["open"],"values":{"average":10,"count":2,"count(status)":2,"max(total)":"n/a","min(total)":10,"sum(total)":10}},` +
+				`{"group":["paid"],"values":{"average":15,"count":2,"count(status)":2,"max(total)":25.5,"min(total)":4.5,"sum(total)":30}}]`},
+		{store.Query{Field: "total", Operator: store.Gt, Value: 100}, []string{"status"}, `[]`},
+	}
+	for _, test := range tests {
+		groups, err := c.Aggregate(test.query, test.groupBy, aggregations)
+		if err != nil {
+			t.Fatalf("Aggregate: %v", err)
+		}
+		if groups == nil {
+			groups = []store.AggregateGroup{}
+		}
+		data, err := json.Marshal(groups)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != test.expected {
+			t.Errorf("Expected %s, got %s", test.expected, data)
+		}
+	}
+
+	for _, aggregations := range [][]store.Aggregation{
+		nil,
+		{{Function: "median", Field: "total"}},
+		{{Function: store.Sum}},
+		{{Function: store.Count}, {Function: store.Sum, Field: "total", Alias: "count"}},
+	} {
+		if _, err := c.Aggregate(store.Query{}, nil, aggregations); err == nil {
+			t.Errorf("Expected error for invalid aggregations %v", aggregations)
+		}
+	}
+}
+
+func testProjection(t *testing.T, s store.Store) {
+	mustSet(t, mustDocument(t, s, "users/1"), `{"name":"alice","age":30,"address":{"city":"Berlin","zip":"10115"}}`)
+	mustSet(t, mustDocument(t, s, "users/2"), `{"name":"bob","age":25}`)
+	mustSet(t, mustDocument(t, s, "teams/1/users/3"), `{"name":"carol","age":41}`)
+
+	data, err := mustDocument(t, s, "users/1").Get("name", "address.city")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if string(data) != `{"address":{"city":"Berlin"},"name":"alice"}` {
+		t.Errorf("Expected projected document, got %s", data)
+	}
+	if _, err := mustDocument(t, s, "users/9").Get("name"); !store.IsNotFound(err) {
+		t.Errorf("Expected not found error, got %v", err)
+	}
+
+	items, err := mustCollection(t, s, "users").Items(store.Query{Field: "age", Operator: store.Gt, Value: 20},
+		store.Order{OrderBy: "age", Ascending: true}, store.Limit{Limit: 2}, "name")
+	if err != nil {
+		t.Fatalf("Items: %v", err)
+	}
+	expectKeys(t, items, "users/2", "users/1")
+	if len(items) == 2 && (string(items[0].Value) != `{"name":"bob"}` || string(items[1].Value) != `{"name":"alice"}`) {
+		t.Errorf("Expected projected items, got %s and %s", items[0].Value, items[1].Value)
+	}
+
+	g, err := s.CollectionGroup("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err = g.Items(store.Query{}, store.Order{OrderBy: "age", Ascending: false}, store.Limit{Limit: 1}, "age")
+	if err != nil {
+		t.Fatalf("Items: %v", err)
+	}
+	expectKeys(t, items, "teams/1/users/3")
+	if len(items) == 1 && string(items[0].Value) != `{"age":41}` {
+		t.Errorf("Expected projected item, got %s", items[0].Value)
+	}
+}
+
+func testSearch(t *testing.T, s store.Store) {
+	c := mustCollection(t, s, "notes")
+	if _, err := c.Search("apple", 0); err == nil {
+		t.Errorf("Expected error when searching collection without search enabled")
+	}
+	if err := s.EnableSearch("notes/1", "title"); err == nil {
+		t.Errorf("Expected error when enabling search of document key")
+	}
+	if err := s.EnableSearch("notes"); err == nil {
+		t.Errorf("Expected error when enabling search without fields")
+	}
+
+	// Documents written before search is enabled are indexed, too.
+	mustSet(t, mustDocument(t, s, "notes/1"), `{"title":"Shopping list","body":"Buy apples and bananas"}`)
+	mustSet(t, mustDocument(t, s, "notes/3"), `{"title":"Apple pie","body":"Bake an apple pie with apples"}`)
+	mustSet(t, mustDocument(t, s, "notes/4"), `{"title":"Misc","author":"apple"}`)
+	if err := s.EnableSearch("notes", "title", "body"); err != nil {
+		t.Fatalf("EnableSearch: %v", err)
+	}
+	mustSet(t, mustDocument(t, s, "notes/2"), `{"title":"Running notes","body":["Ran 5km","Running again tomorrow"]}`)
+	mustSet(t, mustDocument(t, s, "notes/2/comments/1"), `{"title":"apple","body":"apple"}`)
+
+	results, err := c.Search("Apples", 0)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	expectSearchKeys(t, results, "notes/3", "notes/1")
+	if len(results) == 2 {
+		if string(results[0].Value) != `{"title":"Apple pie","body":"Bake an apple pie with apples"}` {
+			t.Errorf("Expected document of search result, got %s", results[0].Value)
+		}
+		if results[0].Score <= results[1].Score || results[1].Score <= 0 {
+			t.Errorf("Expected positive descending scores, got %v and %v", results[0].Score, results[1].Score)
+		}
+	}
+	tests := []struct {
+		text     string
+		limit    int
+		expected []string
+	}{
+		{"apple", 1, []string{"notes/3"}},
+		{"RUN", 0, []string{"notes/2"}},
+		{"bananas running", 0, []string{"notes/2", "notes/1"}},
+		{"misc", 0, []string{"notes/4"}},
+		{"pear", 0, nil},
+		{"", 0, nil},
+	}
+	for _, test := range tests {
+		results, err := c.Search(test.text, test.limit)
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		expectSearchKeys(t, results, test.expected...)
+	}
+	if _, err := c.Search("apple", -1); err == nil {
+		t.Errorf("Expected error for negative search limit")
+	}
+
+	// The index follows updates, deletes and transactions.
+	if err := mustDocument(t, s, "notes/1").Update([]byte(`{"body":"Buy pears"}`)); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if err := mustDocument(t, s, "notes/3").Delete(); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	expectSearch(t, c, "apples pears", "notes/1")
+	err = s.RunTransaction(func(tx store.Tx) error {
+		_, err := tx.Add("notes", []byte(`{"title":"Apple crumble"}`))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("RunTransaction: %v", err)
+	}
+	err = s.RunTransaction(func(tx store.Tx) error {
+		if err := tx.Set("notes/5", []byte(`{"title":"Apple tart"}`)); err != nil {
+			return err
+		}
+		return fmt.Errorf("rollback")
+	})
+	if err == nil {
+		t.Fatalf("Expected transaction error")
+	}
+	results, err = c.Search("apple", 0)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(results) != 1 || string(results[0].Value) != `{"title":"Apple crumble"}` {
+		t.Errorf("Expected added document only, got %v", results)
+	}
+	if _, err := c.Delete(false); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	expectSearch(t, c, "apple notes misc")
+}
+
+func testTransactionCommit(t *testing.T, s store.Store) {
+	mustSet(t, mustDocument(t, s, "accounts/a"), `{"balance":100,"owner":"alice"}`)
+	mustSet(t, mustDocument(t, s, "accounts/b"), `{"balance":0,"owner":"bob"}`)
+	mustSet(t, mustDocument(t, s, "accounts/c"), `{"balance":0,"owner":"carol"}`)
+
+	err := s.RunTransaction(func(tx store.Tx) error {
+		if err := tx.Update("accounts/a", []byte(`{"balance":50}`)); err != nil {
+			return err
+		}
+		if err := tx.Update("accounts/b", []byte(`{"balance":50}`)); err != nil {
+			return err
+		}
+		if err := tx.Delete("accounts/c"); err != nil {
+			return err
+		}
+		if err := tx.Set("accounts/d", []byte(`{"balance":0}`)); err != nil {
+			return err
+		}
+		// Reads see the writes of their own transaction.
+		data, err := tx.Get("accounts/a")
+		if err != nil {
+			return err
+		}
+		if string(data) != `{"balance":50,"owner":"alice"}` {
+			t.Errorf("Expected transaction to read its own update, got %s", data)
+		}
+		if _, err := tx.Get("accounts/c"); !store.IsNotFound(err) {
+			t.Errorf("Expected transaction to read its own delete, got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("RunTransaction: %v", err)
+	}
+	expectDocument(t, s, "accounts/a", `{"balance":50,"owner":"alice"}`)
+	expectDocument(t, s, "accounts/b", `{"balance":50,"owner":"bob"}`)
+	expectDocument(t, s, "accounts/d", `{"balance":0}`)
+	if _, err := mustDocument(t, s, "accounts/c").Get(); !store.IsNotFound(err) {
+		t.Errorf("Expected committed delete, got %v", err)
+	}
+}
+
+func testTransactionRollback(t *testing.T, s store.Store) {
+	mustSet(t, mustDocument(t, s, "accounts/a"), `{"balance":100}`)
+
+	err := s.RunTransaction(func(tx store.Tx) error {
+		if err := tx.Set("accounts/a", []byte(`{"balance":0}`)); err != nil {
+			return err
+		}
+		if err := tx.Set("accounts/b", []byte(`{"balance":100}`)); err != nil {
+			return err
+		}
+		// Fails as the document does not exist.
+		return tx.Update("accounts/c", []byte(`{"balance":0}`))
+	})
+	if !store.IsNotFound(err) {
+		t.Errorf("Expected not found error from transaction, got %v", err)
+	}
+	expectDocument(t, s, "accounts/a", `{"balance":100}`)
+	if _, err := mustDocument(t, s, "accounts/b").Get(); !store.IsNotFound(err) {
+		t.Errorf("Expected rolled back document not to exist, got %v", err)
+	}
+}
+
+func testTransactionKeys(t *testing.T, s store.Store) {
+	err := s.RunTransaction(func(tx store.Tx) error {
+		return tx.Set("accounts", []byte(`{}`))
+	})
+	if err == nil {
+		t.Errorf("Expected error when setting collection key %q in transaction", "accounts")
+	}
+}
+
+func testTransactionAdd(t *testing.T, s store.Store) {
+	var keys []string
+	err := s.RunTransaction(func(tx store.Tx) error {
+		for i := 0; i < 2; i++ {
+			key, err := tx.Add("users/1/posts", []byte(fmt.Sprintf(`{"n":%d}`, i)))
+			if err != nil {
+				return err
+			}
+			keys = append(keys, key)
+		}
+		_, err := tx.Add("users/1", []byte(`{}`))
+		if err == nil {
+			t.Errorf("Expected error when adding to document key %q", "users/1")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("RunTransaction: %v", err)
+	}
+	if keys[0] == keys[1] {
+		t.Errorf("Expected unique keys for added documents, got %v", keys)
+	}
+	for i, key := range keys {
+		if store.CollectionKey(key) != "users/1/posts" {
+			t.Errorf("Expected added document below %q, got %q", "users/1/posts", key)
+		}
+		expectDocument(t, s, key, fmt.Sprintf(`{"n":%d}`, i))
+	}
+}
+
+func testBatch(t *testing.T, s store.Store) {
+	mustSet(t, mustDocument(t, s, "users/a"), `{"name":"alice","age":30}`)
+	mustSet(t, mustDocument(t, s, "users/b"), `{"name":"bob"}`)
+
+	b := store.NewBatch()
+	b.Set("users/c", []byte(`{"name":"carol"}`))
+	b.Update("users/a", []byte(`{"age":31}`))
+	b.Delete("users/b")
+	b.Add("users", []byte(`{"name":"dave"}`))
+	if b.Len() != 4 {
+		t.Errorf("Expected batch of 4 writes, got %d", b.Len())
+	}
+	keys, err := b.Commit(s)
+	if err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if len(keys) != 4 || keys[0] != "users/c" || keys[1] != "users/a" || keys[2] != "users/b" {
+		t.Fatalf("Expected keys of written documents, got %v", keys)
+	}
+	expectDocument(t, s, "users/a", `{"age":31,"name":"alice"}`)
+	expectDocument(t, s, "users/c", `{"name":"carol"}`)
+	expectDocument(t, s, keys[3], `{"name":"dave"}`)
+	if _, err := mustDocument(t, s, "users/b").Get(); !store.IsNotFound(err) {
+		t.Errorf("Expected deleted document, got %v", err)
+	}
+}
+
+func testBatchRollback(t *testing.T, s store.Store) {
+	b := store.NewBatch()
+	b.Set("users/1", []byte(`{"name":"alice"}`))
+	b.Update("users/2", []byte(`{"name":"bob"}`))
+	if _, err := b.Commit(s); !store.IsNotFound(err) {
+		t.Errorf("Expected not found error from batch, got %v", err)
+	}
+	if _, err := mustDocument(t, s, "users/1").Get(); !store.IsNotFound(err) {
+		t.Errorf("Expected batch to be rolled back, got %v", err)
+	}
+}
+
+func testVersions(t *testing.T, s store.Store) {
+	d := mustDocument(t, s, "users/1")
+	mustSet(t, d, `{"name":"alice"}`)
+	expectVersion(t, d, 1)
+	mustSet(t, d, `{"name":"bob"}`)
+	expectVersion(t, d, 2)
+	if err := d.Update([]byte(`{"age":30}`)); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	expectVersion(t, d, 3)
+
+	if err := d.Delete(); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, _, err := d.GetWithMetadata(); !store.IsNotFound(err) {
+		t.Errorf("Expected not found error for deleted document, got %v", err)
+	}
+	// Versions start over once a document has been deleted.
+	mustSet(t, d, `{"name":"carol"}`)
+	expectVersion(t, d, 1)
+
+	added, err := mustCollection(t, s, "users").Add([]byte(`{}`))
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	expectVersion(t, added, 1)
+}
+
+func testTimestamps(t *testing.T, s store.Store) {
+	before := time.Now()
+	d := mustDocument(t, s, "users/1")
+	mustSet(t, d, `{"name":"alice"}`)
+	_, created, err := d.GetWithMetadata()
+	if err != nil {
+		t.Fatalf("GetWithMetadata: %v", err)
+	}
+	if created.CreateTime.Before(before.Add(-time.Second)) || created.CreateTime.After(time.Now()) {
+		t.Errorf("Expected creation time close to now, got %v", created.CreateTime)
+	}
+	if !created.UpdateTime.Equal(created.CreateTime) {
+		t.Errorf("Expected update time %v to equal creation time %v", created.UpdateTime, created.CreateTime)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	if err := d.Update([]byte(`{"age":30}`)); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	_, updated, err := d.GetWithMetadata()
+	if err != nil {
+		t.Fatalf("GetWithMetadata: %v", err)
+	}
+	if !updated.CreateTime.Equal(created.CreateTime) {
+		t.Errorf("Expected creation time %v to be kept, got %v", created.CreateTime, updated.CreateTime)
+	}
+	if !updated.UpdateTime.After(created.UpdateTime) {
+		t.Errorf("Expected update time after %v, got %v", created.UpdateTime, updated.UpdateTime)
+	}
+	// Timestamps are kept out of the document itself.
+	expectDocument(t, s, "users/1", `{"age":30,"name":"alice"}`)
+}
+
+func testExpiry(t *testing.T, s store.Store) {
+	expired := make(chan string, 10)
+	s.OnExpire(func(key string) {
+		expired <- key
+	})
+
+	d := mustDocument(t, s, "sessions/a")
+	if err := d.SetWithTTL([]byte(`{"user":"alice"}`), 100*time.Millisecond); err != nil {
+		t.Fatalf("SetWithTTL: %v", err)
+	}
+	added, err := mustCollection(t, s, "sessions").AddWithTTL([]byte(`{"user":"bob"}`), 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("AddWithTTL: %v", err)
+	}
+	mustSet(t, mustDocument(t, s, "sessions/z"), `{"user":"carol"}`)
+	expectKeys(t, mustItems(t, s, "sessions", store.Query{}, store.Order{}, store.Limit{}),
+		added.Key(), "sessions/a", "sessions/z")
+
+	_, meta, err := d.GetWithMetadata()
+	if err != nil {
+		t.Fatalf("GetWithMetadata: %v", err)
+	}
+	if meta.ExpireTime.Sub(meta.UpdateTime) != 100*time.Millisecond {
+		t.Errorf("Expected document to expire 100ms after it was written, got %v", meta.ExpireTime)
+	}
+
+	// Expired documents are gone right away, even before they are removed.
+	time.Sleep(150 * time.Millisecond)
+	if _, err := d.Get(); !store.IsNotFound(err) {
+		t.Errorf("Expected not found error for expired document, got %v", err)
+	}
+	expectKeys(t, mustItems(t, s, "sessions", store.Query{}, store.Order{}, store.Limit{}), "sessions/z")
+
+	want := map[string]bool{"sessions/a": true, added.Key(): true}
+	timeout := time.After(3 * store.SweepInterval)
+	for len(want) > 0 {
+		select {
+		case key := <-expired:
+			if !want[key] {
+				t.Errorf("Unexpected expired document %q", key)
+			}
+			delete(want, key)
+		case <-timeout:
+			t.Fatalf("Expected expiry of %v to be reported", want)
+		}
+	}
+}
+
+func testExpiryUpdate(t *testing.T, s store.Store) {
+	d := mustDocument(t, s, "sessions/a")
+	if err := d.SetWithTTL([]byte(`{"n":1}`), time.Hour); err != nil {
+		t.Fatalf("SetWithTTL: %v", err)
+	}
+	_, created, err := d.GetWithMetadata()
+	if err != nil {
+		t.Fatalf("GetWithMetadata: %v", err)
+	}
+
+	// Updates keep the expiration time..
+	if err := d.Update([]byte(`{"n":2}`)); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	_, updated, err := d.GetWithMetadata()
+	if err != nil {
+		t.Fatalf("GetWithMetadata: %v", err)
+	}
+	if !updated.ExpireTime.Equal(created.ExpireTime) {
+		t.Errorf("Expected expiration time %v to be kept, got %v", created.ExpireTime, updated.ExpireTime)
+	}
+
+	// .. while setting the document without a time-to-live clears it.
+	mustSet(t, d, `{"n":3}`)
+	_, set, err := d.GetWithMetadata()
+	if err != nil {
+		t.Fatalf("GetWithMetadata: %v", err)
+	}
+	if !set.ExpireTime.IsZero() {
+		t.Errorf("Expected document not to expire, got %v", set.ExpireTime)
+	}
+}
+
+func testPreconditions(t *testing.T, s store.Store) {
+	d := mustDocument(t, s, "users/1")
+
+	expectConflict(t, d.Set([]byte(`{"n":1}`), store.Exists()))
+	expectConflict(t, d.Set([]byte(`{"n":1}`), store.HasVersion(1)))
+	if err := d.Set([]byte(`{"n":1}`), store.NotExists()); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	expectConflict(t, d.Set([]byte(`{"n":2}`), store.NotExists()))
+	expectConflict(t, d.Set([]byte(`{"n":2}`), store.HasVersion(2)))
+	if err := d.Set([]byte(`{"n":2}`), store.Exists(), store.HasVersion(1)); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	expectConflict(t, d.Update([]byte(`{"n":3}`), store.HasVersion(1)))
+	if err := d.Update([]byte(`{"n":3}`), store.HasVersion(2)); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	expectConflict(t, d.Delete(store.HasVersion(2)))
+	expectDocument(t, s, "users/1", `{"n":3}`)
+	if err := d.Delete(store.HasVersion(3)); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	expectConflict(t, d.Delete(store.Exists()))
+}
+
+func testTransactionPreconditions(t *testing.T, s store.Store) {
+	mustSet(t, mustDocument(t, s, "users/1"), `{"n":1}`)
+
+	err := s.RunTransaction(func(tx store.Tx) error {
+		if err := tx.Set("users/2", []byte(`{"n":2}`), store.NotExists()); err != nil {
+			return err
+		}
+		return tx.Update("users/1", []byte(`{"n":2}`), store.HasVersion(2))
+	})
+	expectConflict(t, err)
+	if _, err := mustDocument(t, s, "users/2").Get(); !store.IsNotFound(err) {
+		t.Errorf("Expected conflicting transaction to be rolled back, got %v", err)
+	}
+
+	err = s.RunTransaction(func(tx store.Tx) error {
+		if err := tx.Set("users/2", []byte(`{"n":2}`), store.NotExists()); err != nil {
+			return err
+		}
+		// The transaction sees its own write.
+		return tx.Update("users/2", []byte(`{"n":3}`), store.HasVersion(1))
+	})
+	if err != nil {
+		t.Fatalf("RunTransaction: %v", err)
+	}
+	expectDocument(t, s, "users/2", `{"n":3}`)
+}
+
+func expectVersion(t *testing.T, d store.Document, version uint64) {
+	t.Helper()
+	_, meta, err := d.GetWithMetadata()
+	if err != nil {
+		t.Fatalf("GetWithMetadata(%q): %v", d.Key(), err)
+	}
+	if meta.Version != version {
+		t.Errorf("Expected %q to have version %d, got %d", d.Key(), version, meta.Version)
+	}
+}
+
+func expectConflict(t *testing.T, err error) {
+	t.Helper()
+	if !store.IsConflict(err) {
+		t.Errorf("Expected conflict error, got %v", err)
+	}
+}
+
+func mustDocument(t *testing.T, s store.Store, key string) store.Document {
+	t.Helper()
+	d, err := s.Document(key)
+	if err != nil {
+		t.Fatalf("Document(%q): %v", key, err)
+	}
+	return d
+}
+
+func mustCollection(t *testing.T, s store.Store, key string) store.Collection {
+	t.Helper()
+	c, err := s.Collection(key)
+	if err != nil {
+		t.Fatalf("Collection(%q): %v", key, err)
+	}
+	return c
+}
+
+func mustSet(t *testing.T, d store.Document, data string) {
+	t.Helper()
+	if err := d.Set([]byte(data)); err != nil {
+		t.Fatalf("Set(%q): %v", d.Key(), err)
+	}
+}
+
+func mustItems(t *testing.T, s store.Store, key string, q store.Query, o store.Order, l store.Limit) []store.CollectionItem {
+	t.Helper()
+	items, err := mustCollection(t, s, key).Items(q, o, l)
+	if err != nil {
+		t.Fatalf("Items(%q): %v", key, err)
+	}
+	return items
+}
+
+func expectDocument(t *testing.T, s store.Store, key string, expected string) {
+	t.Helper()
+	data, err := mustDocument(t, s, key).Get()
+	if err != nil {
+		t.Fatalf("Get(%q): %v", key, err)
+	}
+	if string(data) != expected {
+		t.Errorf("Expected %q to be %s, got %s", key, expected, data)
+	}
+}
+
+func expectDeleted(t *testing.T, actual []string, keys ...string) {
+	t.Helper()
+	sorted := append([]string{}, actual...)
+	sort.Strings(sorted)
+	if strings.Join(sorted, ",") != strings.Join(keys, ",") {
+		t.Errorf("Expected deleted documents %v, got %v", keys, sorted)
+	}
+}
+
+func expectKeys(t *testing.T, items []store.CollectionItem, keys ...string) {
+	t.Helper()
+	actual := make([]string, len(items))
+	for i, item := range items {
+		actual[i] = item.Key
+	}
+	if strings.Join(actual, ",") != strings.Join(keys, ",") {
+		t.Errorf("Expected items %v, got %v", keys, actual)
+	}
+}
+
+func expectSearch(t *testing.T, c store.Collection, text string, keys ...string) {
+	t.Helper()
+	results, err := c.Search(text, 0)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	expectSearchKeys(t, results, keys...)
+}
+
+func expectSearchKeys(t *testing.T, results []store.SearchResult, keys ...string) {
+	t.Helper()
+	actual := make([]string, len(results))
+	for i, result := range results {
+		actual[i] = result.Key
+	}
+	if strings.Join(actual, ",") != strings.Join(keys, ",") {
+		t.Errorf("Expected search results %v, got %v", keys, actual)
+	}
+}
@@ -0,0 +1,172 @@
+package store
+
+import (
+	"fmt"
+	"time"
+)
+
+// Tx gives access to documents within a transaction. Writes become visible
+// to other readers only once the transaction has been committed, but are
+// visible to reads within the same transaction right away.
+type Tx interface {
+	Get(key string) ([]byte, error)
+	GetWithMetadata(key string) ([]byte, Metadata, error)
+	Set(key string, data []byte, preconditions ...Precondition) error
+	SetWithTTL(key string, data []byte, ttl time.Duration, preconditions ...Precondition) error
+	Update(key string, data []byte, preconditions ...Precondition) error
+	Delete(key string, preconditions ...Precondition) error
+	// Add adds a document with a generated key to the collection and
+	// returns the document's key.
+	Add(collectionKey string, data []byte) (string, error)
+	AddWithTTL(collectionKey string, data []byte, ttl time.Duration) (string, error)
+}
+
+// Write is a buffered write of a BufferedTx. Data is nil for deletes.
+type Write struct {
+	Key      string
+	Data     []byte
+	Metadata Metadata
+}
+
+// BufferedTx is a Tx that keeps its writes in memory until the backend
+// applies them. It is meant for backends without native transactions,
+// which hold an exclusive lock for the life of the transaction.
+type BufferedTx struct {
+	get    func(key string) ([]byte, Metadata, error)
+	next   func(collectionKey string) (uint64, error)
+	writes map[string]Write
+	keys   []string
+}
+
+var _ Tx = &BufferedTx{}
+
+// NewBufferedTx returns a transaction that reads documents which haven't
+// been written within the transaction using get, which returns a
+// *NotFoundError for missing documents. The keys of added documents are
+// generated from the collection sequences returned by next.
+func NewBufferedTx(get func(key string) ([]byte, Metadata, error), next func(collectionKey string) (uint64, error)) *BufferedTx {
+	return &BufferedTx{get: get, next: next, writes: make(map[string]Write)}
+}
+
+func (tx *BufferedTx) Get(key string) ([]byte, error) {
+	data, _, err := tx.GetWithMetadata(key)
+	return data, err
+}
+
+func (tx *BufferedTx) GetWithMetadata(key string) ([]byte, Metadata, error) {
+	if !IsDocumentKey(key) {
+		return nil, Metadata{}, fmt.Errorf("not a document path: %s", key)
+	}
+	if w, written := tx.writes[key]; written {
+		if w.Data == nil {
+			return nil, Metadata{}, &NotFoundError{Key: key}
+		}
+		return w.Data, w.Metadata, nil
+	}
+	return tx.get(key)
+}
+
+// current returns the document's data and metadata, or nil metadata if
+// the document does not exist.
+func (tx *BufferedTx) current(key string) ([]byte, *Metadata, error) {
+	data, meta, err := tx.GetWithMetadata(key)
+	if IsNotFound(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, &meta, nil
+}
+
+func (tx *BufferedTx) Set(key string, data []byte, preconditions ...Precondition) error {
+	return tx.SetWithTTL(key, data, 0, preconditions...)
+}
+
+func (tx *BufferedTx) SetWithTTL(key string, data []byte, ttl time.Duration, preconditions ...Precondition) error {
+	_, meta, err := tx.current(key)
+	if err != nil {
+		return err
+	}
+	if err := CheckPreconditions(key, meta, preconditions); err != nil {
+		return err
+	}
+	if data == nil {
+		data = []byte{}
+	}
+	tx.write(key, append([]byte{}, data...), NextMetadataWithTTL(meta, ttl))
+	return nil
+}
+
+func (tx *BufferedTx) Update(key string, data []byte, preconditions ...Precondition) error {
+	value, meta, err := tx.current(key)
+	if err != nil {
+		return err
+	}
+	if err := CheckPreconditions(key, meta, preconditions); err != nil {
+		return err
+	}
+	if meta == nil {
+		return &NotFoundError{Key: key}
+	}
+	merged, err := MergeJSON(value, data)
+	if err != nil {
+		return err
+	}
+	tx.write(key, merged, NextMetadata(meta))
+	return nil
+}
+
+func (tx *BufferedTx) Delete(key string, preconditions ...Precondition) error {
+	_, meta, err := tx.current(key)
+	if err != nil {
+		return err
+	}
+	if err := CheckPreconditions(key, meta, preconditions); err != nil {
+		return err
+	}
+	tx.write(key, nil, Metadata{})
+	return nil
+}
+
+func (tx *BufferedTx) Add(collectionKey string, data []byte) (string, error) {
+	return tx.AddWithTTL(collectionKey, data, 0)
+}
+
+func (tx *BufferedTx) AddWithTTL(collectionKey string, data []byte, ttl time.Duration) (string, error) {
+	if !IsCollectionKey(collectionKey) {
+		return "", fmt.Errorf("not a collection path: %s", collectionKey)
+	}
+	// Skip the IDs of documents that have been set explicitly.
+	for {
+		num, err := tx.next(collectionKey)
+		if err != nil {
+			return "", err
+		}
+		key := fmt.Sprintf("%s/%d", collectionKey, num)
+		_, err = tx.Get(key)
+		if IsNotFound(err) {
+			return key, tx.SetWithTTL(key, data, ttl)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+func (tx *BufferedTx) write(key string, data []byte, meta Metadata) {
+	if _, written := tx.writes[key]; !written {
+		tx.keys = append(tx.keys, key)
+	}
+	tx.writes[key] = Write{Key: key, Data: data, Metadata: meta}
+}
+
+// Writes returns the final write of every document written within the
+// transaction, in the order the documents were first written.
+func (tx *BufferedTx) Writes() []Write {
+	writes := make([]Write, len(tx.keys))
+	for i, key := range tx.keys {
+		writes[i] = tx.writes[key]
+	}
+	return writes
+}
@@ -18,6 +18,6 @@ func New(s store.Store, logEvents bool) *Thunder {
 	}
 }
 
-func (t *Thunder) Open(enc store.Encoding) {
-	t.Store.Open(enc)
+func (t *Thunder) Open(enc store.Encoding) error {
+	return t.Store.Open(enc)
 }
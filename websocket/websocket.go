@@ -2,9 +2,11 @@ package websocket
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"log"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 
@@ -21,9 +23,19 @@ const (
 	Set       WebSocketOperation = "SET"
 	Update    WebSocketOperation = "UPDATE"
 	Delete    WebSocketOperation = "DELETE"
+	Commit    WebSocketOperation = "COMMIT"
+	Rollback  WebSocketOperation = "ROLLBACK"
+	Batch     WebSocketOperation = "BATCH"
+	// Explain reports how the items of a collection are read for the
+	// query, order and limit, see store.Explanation.
+	Explain WebSocketOperation = "EXPLAIN"
+	// Aggregate computes the aggregations of the operation parameters over
+	// the items of a collection, see store.Collection.Aggregate.
+	Aggregate WebSocketOperation = "AGGREGATE"
 
 	// Outgoing
-	ValueChange WebSocketOperation = "VALUE_CHANGE"
+	ValueChange   WebSocketOperation = "VALUE_CHANGE"
+	ErrorOccurred WebSocketOperation = "ERROR"
 
 	// Incoming & Outgoing
 	Snapshot WebSocketOperation = "SNAPSHOT"
@@ -46,18 +58,124 @@ type WebSocketMessage struct {
 	PayloadMetadata     PayloadMetadata     `json:"payloadMetadata,omitempty"`
 }
 
+// BatchOperation is a single write of the payload of a BATCH message.
+type BatchOperation struct {
+	Operation     WebSocketOperation   `json:"operation"`
+	Key           string               `json:"key"`
+	Payload       json.RawMessage      `json:"payload,omitempty"`
+	Preconditions []store.Precondition `json:"preconditions,omitempty"`
+}
+
 type OperationParameters struct {
-	Query store.Query `json:"query"`
-	Limit store.Limit `json:"limit"`
-	Order store.Order `json:"offset"`
+	Query         store.Query          `json:"query"`
+	Limit         store.Limit          `json:"limit"`
+	Order         store.Order          `json:"order"`
+	Preconditions []store.Precondition `json:"preconditions,omitempty"`
+	// TTL is the time-to-live in milliseconds of documents written by
+	// SET and ADD operations. Documents never expire if it is zero.
+	TTL int64 `json:"ttl,omitempty"`
+	// Recursive makes DELETE operations delete subcollections, too.
+	// Collections are deleted by DELETE operations on their key.
+	Recursive bool `json:"recursive,omitempty"`
+
+	// CollectionGroup makes SUBSCRIBE and EXPLAIN operations read the
+	// collection group named by the key rather than a collection.
+	CollectionGroup bool `json:"collectionGroup,omitempty"`
+	// Aggregations make subscriptions to collections publish the results
+	// of the aggregations, grouped by the GroupBy fields, instead of the
+	// items. AGGREGATE operations compute them once.
+	GroupBy      []string            `json:"groupBy,omitempty"`
+	Aggregations []store.Aggregation `json:"aggregations,omitempty"`
+	// Fields project the documents and items of subscriptions to the
+	// given fields, see store.ProjectJSON. Items keep the fields of the
+	// order, too, which their cursors are made of.
+	Fields []string `json:"fields,omitempty"`
+	// QueryText holds a query, order and limit in the textual query
+	// language, see store.ParseQuery, e.g. "age >= 21 ORDER BY age LIMIT
+	// 10". It replaces Query, Order and the limit and offset of Limit.
+	QueryText string `json:"queryText,omitempty"`
+	// Search makes subscriptions to collections publish the documents
+	// matching the text, ranked by relevance, instead of the items, see
+	// store.Collection.Search. Limit.Limit bounds their number and
+	// Fields project them.
+	Search string `json:"search,omitempty"`
+}
+
+// parseQueryText replaces the query, order and limit of the parameters
+// with those of the query text, if any.
+func (p *OperationParameters) parseQueryText() error {
+	if p.QueryText == "" {
+		return nil
+	}
+	q, o, l, err := store.ParseQuery(p.QueryText)
+	if err != nil {
+		return err
+	}
+	p.Query, p.Order = q, o
+	p.Limit.Limit, p.Limit.Offset = l.Limit, l.Offset
+	return nil
+}
+
+// topic returns the key that changes of the message's document, collection
+// or collection group are published under.
+func (m WebSocketMessage) topic() string {
+	if m.OperationParameters.CollectionGroup {
+		return thunder.CollectionGroupKey(m.Key)
+	}
+	return m.Key
+}
+
+// subscriptionKey returns the key that distinguishes the subscriptions of
+// a connection, i.e. the topic along with the parameters of the message.
+// Subscribing again with the same parameters is a no-op.
+func (m WebSocketMessage) subscriptionKey() (string, error) {
+	p := m.OperationParameters
+	// The query text has been parsed into the query, order and limit.
+	p.QueryText = ""
+	params, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	return m.topic() + " " + string(params), nil
 }
 
+// itemFields returns the fields to project the items of collections to.
+func (p OperationParameters) itemFields() []string {
+	if len(p.Fields) == 0 {
+		return nil
+	}
+	fields := append([]string{}, p.Fields...)
+	for _, field := range p.Order.Fields() {
+		fields = append(fields, field.OrderBy)
+	}
+	return fields
+}
+
+// ttl returns the time-to-live of the operation's documents.
+func (p OperationParameters) ttl() time.Duration {
+	return time.Duration(p.TTL) * time.Millisecond
+}
+
+type ErrorCode string
+
+const (
+	NotFound ErrorCode = "NOT_FOUND"
+	Conflict ErrorCode = "CONFLICT"
+)
+
 type Error struct {
-	Message string `json:"message"`
+	Message string    `json:"message"`
+	Code    ErrorCode `json:"code,omitempty"`
 }
 
 type PayloadMetadata struct {
-	Exists bool `json:"exists"`
+	Exists     bool       `json:"exists"`
+	Version    uint64     `json:"version,omitempty"`
+	CreateTime *time.Time `json:"createTime,omitempty"`
+	UpdateTime *time.Time `json:"updateTime,omitempty"`
+	// Cursor is the position of the last item of a collection. Passing it
+	// as startAfter of the limit continues the listing after the item.
+	Cursor *store.Cursor `json:"cursor,omitempty"`
 }
 
 func NewWebSocketHandler(thunder *thunder.Thunder) *WebSocketHandler {
@@ -79,21 +197,31 @@ func (h *WebSocketHandler) HandlerFunc() http.HandlerFunc {
 			return
 		}
 
-		// Create a map of subscriptions (mapped by key) to the underlying storage.
-		// Unsubscribe from them in the connection's close handler.
-		subscriptions := make(map[string]chan []byte)
-		conn.SetCloseHandler(func(code int, text string) error {
-			for key, channel := range subscriptions {
-				h.thunder.PubSub.Unsubscribe(key, channel)
+		// Create a map of subscriptions (mapped by key and parameters) to the
+		// underlying storage. Unsubscribe from them once the connection is gone.
+		type subscription struct {
+			topic   string
+			channel chan []byte
+		}
+		subscriptions := make(map[string]subscription)
+		defer func() {
+			for _, s := range subscriptions {
+				h.thunder.PubSub.Unsubscribe(s.topic, s.channel)
 			}
-			return nil;
-		})
+		}()
+
+		// Writes carrying a transaction ID are held back until the
+		// transaction is committed or rolled back.
+		transactions := make(map[uint64][]WebSocketMessage)
 
 		for {
 			msgType, msg, err := conn.ReadMessage()
 			if err != nil {
-				log.Println("[ERR] websocket.Conn.ReadMessage", err)
-				continue
+				// Reads keep failing once the connection is closed.
+				if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					log.Println("[ERR] websocket.Conn.ReadMessage", err)
+				}
+				return
 			}
 			if msgType != websocket.TextMessage {
 				log.Println("[ERR] messageType must be websocket.TextMessage")
@@ -106,81 +234,271 @@ func (h *WebSocketHandler) HandlerFunc() http.HandlerFunc {
 				log.Println("[ERR] json.Unmarshal", err)
 				continue
 			}
+			if err := m.OperationParameters.parseQueryText(); err != nil {
+				log.Println("[ERR] store.ParseQuery", err)
+				h.writeError(conn, m, err)
+				continue
+			}
+			if m.TransactionID != 0 {
+				switch m.Operation {
+				case Set, Update, Delete, Add:
+					transactions[m.TransactionID] = append(transactions[m.TransactionID], m)
+					continue
+				case Commit:
+					err := h.handleCommit(transactions[m.TransactionID])
+					if err != nil {
+						log.Println("[ERR:Commit]", err)
+						h.writeError(conn, m, err)
+					}
+					delete(transactions, m.TransactionID)
+					continue
+				case Rollback:
+					delete(transactions, m.TransactionID)
+					continue
+				}
+			}
 			switch m.Operation {
 			case Subscribe:
-				// TODO distinguish subscriptions to same key with different parameters
-				if _, exists := subscriptions[m.Key]; !exists {
+				key, err := m.subscriptionKey()
+				if err != nil {
+					log.Println("[ERR:Subscribe]", err)
+					h.writeError(conn, m, err)
+					continue
+				}
+				if _, exists := subscriptions[key]; !exists {
 					c, err := h.handleSubscribe(m, conn)
 					if err != nil {
-						log.Println("[ERR] h.handleSubscribe", err)
+						log.Println("[ERR:Subscribe]", err)
+						h.writeError(conn, m, err)
 						continue
 					}
-					subscriptions[m.Key] = c
+					subscriptions[key] = subscription{m.topic(), c}
 				}
-			case Set:
-				d, err := h.thunder.Store.Document(m.Key)
+			case Set, Update, Delete, Add:
+				err := h.handleWrite(m)
 				if err != nil {
-					log.Println("[ERR:Set]", err)
+					log.Printf("[ERR:%s] %v", m.Operation, err)
+					h.writeError(conn, m, err)
 				}
-				err = d.Set(m.Payload)
+			case Batch:
+				err := h.handleBatch(m)
 				if err != nil {
-					log.Println("[ERR:Set]", err)
+					log.Println("[ERR:Batch]", err)
+					h.writeError(conn, m, err)
 				}
-			case Update:
-				d, err := h.thunder.Store.Document(m.Key)
+			case Explain:
+				err := h.handleExplain(m, conn)
 				if err != nil {
-					log.Println("[ERR:Update]", err)
+					log.Println("[ERR:Explain]", err)
+					h.writeError(conn, m, err)
 				}
-				err = d.Update(m.Payload)
+			case Aggregate:
+				err := h.handleAggregate(m, conn)
 				if err != nil {
-					log.Println("[ERR:Update]", err)
+					log.Println("[ERR:Aggregate]", err)
+					h.writeError(conn, m, err)
 				}
+			}
+		}
+	}
+}
+
+func (h *WebSocketHandler) handleWrite(m WebSocketMessage) error {
+	preconditions := m.OperationParameters.Preconditions
+	if m.Operation == Add {
+		c, err := h.thunder.Store.Collection(m.Key)
+		if err != nil {
+			return err
+		}
+		_, err = c.AddWithTTL(m.Payload, m.OperationParameters.ttl())
+		return err
+	}
+	if m.Operation == Delete && store.IsCollectionKey(m.Key) {
+		c, err := h.thunder.Store.Collection(m.Key)
+		if err != nil {
+			return err
+		}
+		_, err = c.Delete(m.OperationParameters.Recursive)
+		return err
+	}
+	d, err := h.thunder.Store.Document(m.Key)
+	if err != nil {
+		return err
+	}
+	switch m.Operation {
+	case Set:
+		return d.SetWithTTL(m.Payload, m.OperationParameters.ttl(), preconditions...)
+	case Update:
+		return d.Update(m.Payload, preconditions...)
+	case Delete:
+		if m.OperationParameters.Recursive {
+			_, err := d.DeleteRecursive(preconditions...)
+			return err
+		}
+		return d.Delete(preconditions...)
+	}
+	return nil
+}
+
+func (h *WebSocketHandler) handleCommit(messages []WebSocketMessage) error {
+	return h.thunder.Store.RunTransaction(func(tx store.Tx) error {
+		for _, m := range messages {
+			var err error
+			switch m.Operation {
+			case Set:
+				err = tx.SetWithTTL(m.Key, m.Payload, m.OperationParameters.ttl(), m.OperationParameters.Preconditions...)
+			case Update:
+				err = tx.Update(m.Key, m.Payload, m.OperationParameters.Preconditions...)
 			case Delete:
-				d, err := h.thunder.Store.Document(m.Key)
-				if err != nil {
-					log.Println("[ERR:Delete]", err)
-				}
-				err = d.Delete()
-				if err != nil {
-					log.Println("[ERR:Delete]", err)
-				}
+				err = tx.Delete(m.Key, m.OperationParameters.Preconditions...)
 			case Add:
-				c, err := h.thunder.Store.Collection(m.Key)
-				if err != nil {
-					log.Println("[ERR:Add]", err)
-				}
-				_, err = c.Add(m.Payload)
-				if err != nil {
-					log.Println("[ERR:Add]", err)
-				}
+				_, err = tx.AddWithTTL(m.Key, m.Payload, m.OperationParameters.ttl())
+			}
+			if err != nil {
+				return err
 			}
 		}
+		return nil
+	})
+}
+
+func (h *WebSocketHandler) handleBatch(m WebSocketMessage) error {
+	var operations []BatchOperation
+	err := json.Unmarshal(m.Payload, &operations)
+	if err != nil {
+		return err
+	}
+	b := store.NewBatch()
+	for _, o := range operations {
+		switch o.Operation {
+		case Set:
+			b.Set(o.Key, o.Payload, o.Preconditions...)
+		case Update:
+			b.Update(o.Key, o.Payload, o.Preconditions...)
+		case Delete:
+			b.Delete(o.Key, o.Preconditions...)
+		case Add:
+			b.Add(o.Key, o.Payload)
+		default:
+			return fmt.Errorf("operation not supported within batches: %s", o.Operation)
+		}
 	}
+	_, err = b.Commit(h.thunder.Store)
+	return err
+}
+
+// queryable is implemented by collections and collection groups.
+type queryable interface {
+	Items(q store.Query, o store.Order, l store.Limit, fields ...string) ([]store.CollectionItem, error)
+	Explain(store.Query, store.Order, store.Limit) (store.Explanation, error)
+	Aggregate(q store.Query, groupBy []string, aggregations []store.Aggregation) ([]store.AggregateGroup, error)
+}
+
+// queryable returns the collection or collection group named by the key.
+func (h *WebSocketHandler) queryable(m WebSocketMessage) (queryable, error) {
+	if m.OperationParameters.CollectionGroup {
+		return h.thunder.Store.CollectionGroup(m.Key)
+	}
+	return h.thunder.Store.Collection(m.Key)
+}
+
+func (h *WebSocketHandler) handleExplain(m WebSocketMessage, conn *websocket.Conn) error {
+	collection, err := h.queryable(m)
+	if err != nil {
+		return err
+	}
+	p := m.OperationParameters
+	explanation, err := collection.Explain(p.Query, p.Order, p.Limit)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(explanation)
+	if err != nil {
+		return err
+	}
+	h.writeMessage(conn, &WebSocketMessage{
+		Operation: Explain,
+		Key:       m.Key,
+		RequestID: m.RequestID,
+		Payload:   data,
+	})
+	return nil
+}
+
+func (h *WebSocketHandler) handleAggregate(m WebSocketMessage, conn *websocket.Conn) error {
+	data, err := h.aggregate(m)
+	if err != nil {
+		return err
+	}
+	h.writeMessage(conn, &WebSocketMessage{
+		Operation: Aggregate,
+		Key:       m.Key,
+		RequestID: m.RequestID,
+		Payload:   data,
+	})
+	return nil
+}
+
+// aggregate returns the results of the aggregations of the message.
+func (h *WebSocketHandler) aggregate(m WebSocketMessage) ([]byte, error) {
+	collection, err := h.queryable(m)
+	if err != nil {
+		return nil, err
+	}
+	p := m.OperationParameters
+	groups, err := collection.Aggregate(p.Query, p.GroupBy, p.Aggregations)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(groups)
+}
+
+// search returns the documents matching the search text of the message.
+func (h *WebSocketHandler) search(m WebSocketMessage) ([]byte, error) {
+	if m.OperationParameters.CollectionGroup {
+		return nil, fmt.Errorf("collection groups can't be searched")
+	}
+	collection, err := h.thunder.Store.Collection(m.Key)
+	if err != nil {
+		return nil, err
+	}
+	p := m.OperationParameters
+	results, err := collection.Search(p.Search, p.Limit.Limit)
+	if err != nil {
+		return nil, err
+	}
+	for i := range results {
+		results[i].Value = store.ProjectJSON(results[i].Value, p.Fields)
+	}
+	return json.Marshal(results)
 }
 
 func (h *WebSocketHandler) handleSubscribe(m WebSocketMessage, conn *websocket.Conn) (chan []byte, error) {
 	var channel chan []byte
-	var initialData []byte
+	var initialMessage *WebSocketMessage
 	var err error
 
-	if store.IsDocumentKey(m.Key) {
+	if store.IsDocumentKey(m.Key) && !m.OperationParameters.CollectionGroup {
 		channel = h.thunder.PubSub.Subscribe(m.Key)
-		document, err := h.thunder.Store.Document(m.Key)
-		if err != nil {
-			return nil, err
-		}
-		initialData, err = document.Get()
+		initialMessage, err = h.documentMessage(m)
 		if err != nil {
+			h.thunder.PubSub.Unsubscribe(m.Key, channel)
 			return nil, err
 		}
 	} else {
 		queryFunc := func() ([]byte, error) {
-			collection, err := h.thunder.Store.Collection(m.Key)
+			if len(m.OperationParameters.Aggregations) > 0 {
+				return h.aggregate(m)
+			}
+			if m.OperationParameters.Search != "" {
+				return h.search(m)
+			}
+			collection, err := h.queryable(m)
 			if err != nil {
 				return nil, err
 			}
 			p := m.OperationParameters
-			items, err := collection.Items(p.Query, p.Order, p.Limit)
+			items, err := collection.Items(p.Query, p.Order, p.Limit, p.itemFields()...)
 			if err != nil {
 				return nil, err
 			}
@@ -191,36 +509,137 @@ func (h *WebSocketHandler) handleSubscribe(m WebSocketMessage, conn *websocket.C
 			return data, nil
 		}
 		// Subscribe to the collection with the given function.
-		channel = h.thunder.PubSub.SubscribeWithFunc(m.Key, queryFunc)
-		initialData, err = queryFunc();
+		channel = h.thunder.PubSub.SubscribeWithFunc(m.topic(), queryFunc)
+		initialData, err := queryFunc();
 		if err != nil {
+			h.thunder.PubSub.Unsubscribe(m.topic(), channel)
 			return nil, err
 		}
+		initialMessage = queryMessage(m, initialData)
 	}
 	// Publish initial data snapshot..
-	h.writeMessage(conn, &WebSocketMessage{
-		Operation: ValueChange,
-		Key:       m.Key,
-		Payload:   initialData,
-	})
-	go h.listen(m.Key, channel, conn)
+	h.writeMessage(conn, initialMessage)
+	go h.listen(m, channel, conn)
 	return channel, err
 }
 
-func (h *WebSocketHandler) listen(key string, channel chan []byte, conn *websocket.Conn) {
+func (h *WebSocketHandler) listen(subscription WebSocketMessage, channel chan []byte, conn *websocket.Conn) {
+	key := subscription.Key
 	for {
 		select {
 		case m, ok := <-channel:
 			if !ok {
 				return
 			}
-			h.writeMessage(conn, &WebSocketMessage{
-				Key:       key,
-				Payload:   m,
-				Operation: ValueChange,
-			})
+			if store.IsDocumentKey(key) {
+				// Read the document again to include its metadata.
+				message, err := h.documentMessage(subscription)
+				if err != nil {
+					log.Println("[ERR] h.documentMessage", err)
+					continue
+				}
+				h.writeMessage(conn, message)
+				continue
+			}
+			h.writeMessage(conn, queryMessage(subscription, m))
+		}
+	}
+}
+
+// queryMessage returns a VALUE_CHANGE message with the results of the
+// subscription to a collection, i.e. its items, aggregations or search
+// results, carrying the request ID of the subscription.
+func queryMessage(subscription WebSocketMessage, data []byte) *WebSocketMessage {
+	p := subscription.OperationParameters
+	if len(p.Aggregations) > 0 || p.Search != "" {
+		return &WebSocketMessage{
+			Operation:       ValueChange,
+			Key:             subscription.Key,
+			RequestID:       subscription.RequestID,
+			Payload:         data,
+			PayloadMetadata: PayloadMetadata{Exists: true},
 		}
 	}
+	message := collectionMessage(subscription.Key, data, subscription.OperationParameters.Order)
+	message.RequestID = subscription.RequestID
+	return message
+}
+
+// collectionMessage returns a VALUE_CHANGE message with the collection's
+// items, along with the cursor of the last item.
+func collectionMessage(key string, data []byte, order store.Order) *WebSocketMessage {
+	message := &WebSocketMessage{
+		Operation:       ValueChange,
+		Key:             key,
+		Payload:         data,
+		PayloadMetadata: PayloadMetadata{Exists: true},
+	}
+	var items []struct {
+		Key   string          `json:"key"`
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(data, &items); err != nil {
+		log.Println("[ERR] json.Unmarshal", err)
+		return message
+	}
+	if len(items) > 0 {
+		last := items[len(items)-1]
+		cursor := store.NewCursor(store.CollectionItem{Key: last.Key, Value: last.Value}, order)
+		message.PayloadMetadata.Cursor = &cursor
+	}
+	return message
+}
+
+// documentMessage returns a VALUE_CHANGE message with the current data of
+// the subscription's document, projected to the fields if any, and
+// metadata, carrying the request ID of the subscription.
+func (h *WebSocketHandler) documentMessage(subscription WebSocketMessage) (*WebSocketMessage, error) {
+	document, err := h.thunder.Store.Document(subscription.Key)
+	if err != nil {
+		return nil, err
+	}
+	fields := subscription.OperationParameters.Fields
+	message := &WebSocketMessage{
+		Operation: ValueChange,
+		Key:       subscription.Key,
+		RequestID: subscription.RequestID,
+	}
+	data, meta, err := document.GetWithMetadata()
+	if store.IsNotFound(err) {
+		return message, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	message.Payload = store.ProjectJSON(data, fields)
+	message.PayloadMetadata = PayloadMetadata{
+		Exists:  true,
+		Version: meta.Version,
+	}
+	if !meta.CreateTime.IsZero() {
+		message.PayloadMetadata.CreateTime = &meta.CreateTime
+	}
+	if !meta.UpdateTime.IsZero() {
+		message.PayloadMetadata.UpdateTime = &meta.UpdateTime
+	}
+	return message, nil
+}
+
+// writeError reports the error of a failed operation back to the client.
+func (h *WebSocketHandler) writeError(conn *websocket.Conn, m WebSocketMessage, err error) {
+	e := Error{Message: err.Error()}
+	if store.IsNotFound(err) {
+		e.Code = NotFound
+	} else if store.IsConflict(err) {
+		e.Code = Conflict
+	}
+	h.writeMessage(conn, &WebSocketMessage{
+		Operation:     ErrorOccurred,
+		Key:           m.Key,
+		RequestID:     m.RequestID,
+		TransactionID: m.TransactionID,
+		Error:         e,
+	})
 }
 
 func (h *WebSocketHandler) writeMessage(conn *websocket.Conn, message *WebSocketMessage) {
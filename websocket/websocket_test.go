@@ -0,0 +1,225 @@
+package websocket_test
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/imba3r/thunder"
+	"github.com/imba3r/thunder/store"
+	"github.com/imba3r/thunder/store/memory"
+	ws "github.com/imba3r/thunder/websocket"
+)
+
+func newTestServer(t *testing.T) (*thunder.Thunder, *httptest.Server) {
+	th := thunder.New(memory.New(), false)
+	if err := th.Open(store.Json); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(ws.NewWebSocketHandler(th).HandlerFunc())
+	return th, server
+}
+
+func dial(t *testing.T, server *httptest.Server) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// subscribe subscribes to the key and returns the payload of the initial
+// snapshot, which is sent once the subscription is in place.
+func subscribe(t *testing.T, conn *websocket.Conn, key string, p ws.OperationParameters) string {
+	t.Helper()
+	err := conn.WriteJSON(ws.WebSocketMessage{Operation: ws.Subscribe, Key: key, OperationParameters: p})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readPayload(t, conn)
+}
+
+func readPayload(t *testing.T, conn *websocket.Conn) string {
+	t.Helper()
+	return string(readMessage(t, conn).Payload)
+}
+
+func readMessage(t *testing.T, conn *websocket.Conn) ws.WebSocketMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var m ws.WebSocketMessage
+	if err := conn.ReadJSON(&m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Operation != ws.ValueChange {
+		t.Fatalf("Expected %s message, got %s: %s", ws.ValueChange, m.Operation, m.Error.Message)
+	}
+	return m
+}
+
+func expectPayload(t *testing.T, payload string, expected string) {
+	t.Helper()
+	if payload != expected {
+		t.Errorf("Expected payload %s, got %s", expected, payload)
+	}
+}
+
+func mustSet(t *testing.T, th *thunder.Thunder, key string, data string) {
+	t.Helper()
+	d, err := th.Store.Document(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubscribe_Aggregations(t *testing.T) {
+	th, server := newTestServer(t)
+	defer server.Close()
+	mustSet(t, th, "notes/1", `{"text":"first"}`)
+
+	items := dial(t, server)
+	defer items.Close()
+	aggregates := dial(t, server)
+	defer aggregates.Close()
+
+	// Subscriptions to the same collection with different parameters
+	// receive their own results.
+	expectPayload(t, subscribe(t, items, "notes", ws.OperationParameters{}),
+		`[{"key":"notes/1","value":{"text":"first"}}]`)
+	expectPayload(t, subscribe(t, aggregates, "notes", ws.OperationParameters{
+		Aggregations: []store.Aggregation{{Function: store.Count}},
+	}), `[{"values":{"count":1}}]`)
+
+	mustSet(t, th, "notes/2", `{"text":"second"}`)
+	expectPayload(t, readPayload(t, items),
+		`[{"key":"notes/1","value":{"text":"first"}},{"key":"notes/2","value":{"text":"second"}}]`)
+	expectPayload(t, readPayload(t, aggregates), `[{"values":{"count":2}}]`)
+}
+
+func TestSubscribe_Search(t *testing.T) {
+	th, server := newTestServer(t)
+	defer server.Close()
+	if err := th.Store.EnableSearch("notes", "text"); err != nil {
+		t.Fatal(err)
+	}
+	mustSet(t, th, "notes/1", `{"text":"apples"}`)
+
+	search := dial(t, server)
+	defer search.Close()
+	items := dial(t, server)
+	defer items.Close()
+
+	// Search results and items are published to the same collection's
+	// subscribers, whichever subscribed first.
+	expectPayload(t, subscribe(t, search, "notes", ws.OperationParameters{Search: "apple"}),
+		`[{"key":"notes/1","value":{"text":"apples"},"score":0.2876820724517809}]`)
+	expectPayload(t, subscribe(t, items, "notes", ws.OperationParameters{}),
+		`[{"key":"notes/1","value":{"text":"apples"}}]`)
+
+	mustSet(t, th, "notes/2", `{"text":"pears"}`)
+	expectPayload(t, readPayload(t, search),
+		`[{"key":"notes/1","value":{"text":"apples"},"score":0.6931471805599453}]`)
+	expectPayload(t, readPayload(t, items),
+		`[{"key":"notes/1","value":{"text":"apples"}},{"key":"notes/2","value":{"text":"pears"}}]`)
+}
+
+func TestSubscribe_Fields(t *testing.T) {
+	th, server := newTestServer(t)
+	defer server.Close()
+	mustSet(t, th, "users/1", `{"name":"alice","age":30}`)
+
+	names := dial(t, server)
+	defer names.Close()
+	ages := dial(t, server)
+	defer ages.Close()
+
+	expectPayload(t, subscribe(t, names, "users", ws.OperationParameters{Fields: []string{"name"}}),
+		`[{"key":"users/1","value":{"name":"alice"}}]`)
+	expectPayload(t, subscribe(t, ages, "users", ws.OperationParameters{Fields: []string{"age"}}),
+		`[{"key":"users/1","value":{"age":30}}]`)
+
+	mustSet(t, th, "users/1", `{"name":"alice","age":31}`)
+	expectPayload(t, readPayload(t, names), `[{"key":"users/1","value":{"name":"alice"}}]`)
+	expectPayload(t, readPayload(t, ages), `[{"key":"users/1","value":{"age":31}}]`)
+}
+
+func TestSubscribe_SameConnection(t *testing.T) {
+	th, server := newTestServer(t)
+	defer server.Close()
+	mustSet(t, th, "notes/1", `{"text":"first","done":true}`)
+
+	conn := dial(t, server)
+	defer conn.Close()
+
+	// Subscriptions to the same collection with different parameters on one
+	// connection receive their own results, told apart by request ID.
+	subscriptions := []ws.WebSocketMessage{
+		{Operation: ws.Subscribe, Key: "notes", RequestID: 1},
+		{Operation: ws.Subscribe, Key: "notes", RequestID: 2, OperationParameters: ws.OperationParameters{
+			QueryText: "done = true",
+		}},
+		{Operation: ws.Subscribe, Key: "notes", RequestID: 3, OperationParameters: ws.OperationParameters{
+			Aggregations: []store.Aggregation{{Function: store.Count}},
+		}},
+	}
+	expected := map[uint64]string{
+		1: `[{"key":"notes/1","value":{"text":"first","done":true}}]`,
+		2: `[{"key":"notes/1","value":{"text":"first","done":true}}]`,
+		3: `[{"values":{"count":1}}]`,
+	}
+	for _, m := range subscriptions {
+		if err := conn.WriteJSON(m); err != nil {
+			t.Fatal(err)
+		}
+		message := readMessage(t, conn)
+		if message.RequestID != m.RequestID {
+			t.Fatalf("Expected snapshot of request %d, got %d", m.RequestID, message.RequestID)
+		}
+		expectPayload(t, string(message.Payload), expected[m.RequestID])
+	}
+
+	mustSet(t, th, "notes/2", `{"text":"second","done":false}`)
+	expected = map[uint64]string{
+		1: `[{"key":"notes/1","value":{"text":"first","done":true}},{"key":"notes/2","value":{"text":"second","done":false}}]`,
+		2: `[{"key":"notes/1","value":{"text":"first","done":true}}]`,
+		3: `[{"values":{"count":2}}]`,
+	}
+	for range subscriptions {
+		message := readMessage(t, conn)
+		payload, ok := expected[message.RequestID]
+		if !ok {
+			t.Fatalf("Unexpected change of request %d: %s", message.RequestID, message.Payload)
+		}
+		expectPayload(t, string(message.Payload), payload)
+		delete(expected, message.RequestID)
+	}
+}
+
+func TestSubscribe_Error(t *testing.T) {
+	_, server := newTestServer(t)
+	defer server.Close()
+
+	conn := dial(t, server)
+	defer conn.Close()
+
+	err := conn.WriteJSON(ws.WebSocketMessage{Operation: ws.Subscribe, Key: "notes", RequestID: 7,
+		OperationParameters: ws.OperationParameters{Search: "apple"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var m ws.WebSocketMessage
+	if err := conn.ReadJSON(&m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Operation != ws.ErrorOccurred || m.RequestID != 7 || m.Error.Message == "" {
+		t.Errorf("Expected error of request 7, got %+v", m)
+	}
+}